@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"errors"
 	"fmt"
@@ -9,54 +10,120 @@ import (
 	"log"
 	"os"
 	"os/signal"
-	"strings"
+	"strconv"
 	"syscall"
+	"time"
 
 	"voylento/httpfromtcp/internal/headers"
+	"voylento/httpfromtcp/internal/middleware"
 	"voylento/httpfromtcp/internal/request"
 	"voylento/httpfromtcp/internal/response"
+	"voylento/httpfromtcp/internal/router"
 	"voylento/httpfromtcp/internal/server"
+	"voylento/httpfromtcp/internal/websocket"
 )
 
 const port = 42069
+const shutdownTimeout = 30 * time.Second
 
 func main() {
-	server, err := server.Serve(port, handler)
+	handler := server.Wrap(newRouter().Handler(), middleware.Logging(log.Default()))
+	opts := []server.Option{
+		server.WithReadHeaderTimeout(10*time.Second),
+		server.WithIdleTimeout(60*time.Second),
+		server.WithH2C(true),
+	}
+	// serve over TLS when given a certificate; replacing the files swaps
+	// the certificate without a restart
+	var srv *server.Server
+	var err error
+	if certFile := os.Getenv("TLS_CERT_FILE"); certFile != "" {
+		srv, err = server.ServeTLS(port, handler, certFile, os.Getenv("TLS_KEY_FILE"), opts...)
+	} else {
+		srv, err = server.Serve(port, handler, opts...)
+	}
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
-	defer server.Close()
 	log.Println("Server started on port", port)
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Fatalf("Error shutting down server: %v", err)
+	}
 	log.Println("Server gracefully stopped")
 }
 
-func handler(w *response.Writer, req *request.Request) {
-	if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin") {
-		proxyHandler(w, req)
+func newRouter() *router.Router {
+	rt := router.New()
+	rt.Handle("GET", "/", handler200)
+	rt.Handle("GET", "/success", handler200)
+	rt.Handle("GET", "/httpbin/{path...}", proxyHandler)
+	rt.Handle("GET", "/video", videoHandler)
+	rt.Handle("GET", "/yourproblem", handler400)
+	rt.Handle("GET", "/myproblem", handler500)
+	rt.Handle("GET", "/echo", echoHandler)
+	rt.Handle("GET", "/events", eventsHandler)
+	return rt
+}
+
+// eventsHandler streams the time as Server-Sent Events once a second,
+// numbering events so a reconnecting client picks up where it left off.
+func eventsHandler(w *response.Writer, req *request.Request) {
+	sse, err := response.NewSSEWriter(w, req)
+	if err != nil {
+		log.Printf("Error starting event stream: %v", err)
 		return
 	}
-	if strings.HasPrefix(req.RequestLine.RequestTarget, "/video") {
-		videoHandler(w, req)
-		return
+	defer sse.Close()
+	sse.Heartbeat(15*time.Second)
+
+	id, _ := strconv.Atoi(sse.LastEventID())
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sse.Done():
+			return
+		case now := <-ticker.C:
+			id++
+			err := sse.Send(response.Event{Event: "tick", ID: strconv.Itoa(id), Data: now.Format(time.RFC3339)})
+			if err != nil {
+				return
+			}
+		}
 	}
-	if req.RequestLine.RequestTarget == "/yourproblem" {
-		handler400(w, req)
-		return
-	} 
-	if req.RequestLine.RequestTarget == "/myproblem" {
-		handler500(w, req)
+}
+
+// echoHandler echoes WebSocket messages back to the client.
+func echoHandler(w *response.Writer, req *request.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, req)
+	if err != nil {
+		log.Printf("Error upgrading to websocket: %v", err)
 		return
 	}
-	handler200(w, req)
+	defer conn.Close()
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := conn.WriteMessage(messageType, message); err != nil {
+			return
+		}
+	}
 }
 
 func proxyHandler(w *response.Writer, req *request.Request) {
-	target := strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin/")
-	url := fmt.Sprintf("https://httpbin.org/%s", target)
+	url := fmt.Sprintf("https://httpbin.org/%s", req.PathValue("path"))
+	if req.URL.RawQuery != "" {
+		url += "?" + req.URL.RawQuery
+	}
 	fmt.Printf("Proxying to %s\n", url)
 	resp, err := http.Get(url)
 	if err != nil {
@@ -66,7 +133,7 @@ func proxyHandler(w *response.Writer, req *request.Request) {
 	defer resp.Body.Close()
 
 	h := response.GetDefaultHeaders(0)
-	h.Override("Transfer-Encoding", "chunked")
+	h.Set("Transfer-Encoding", "chunked")
 	h.Remove("Content-Length")
 	h.Set("Trailer", "X-Content-SHA256, X-Content-Length")
 	w.WriteStatusLine(response.StatusCodeSuccess)
@@ -125,7 +192,7 @@ func videoHandler(w *response.Writer, req *request.Request) {
 
 
 	h:= response.GetDefaultHeaders(len(fileBytes))
-	h.Override("Content-Type", "video/mp4")	
+	h.Set("Content-Type", "video/mp4")	
 	w.WriteStatusLine(response.StatusCodeSuccess)
 	w.WriteHeaders(h)
 	w.WriteBody(fileBytes)
@@ -183,9 +250,9 @@ func handler200(w *response.Writer, req *request.Request) {
 
 func writeResponse(w *response.Writer, _ *request.Request, code response.StatusCode, body []byte) {
 	w.WriteStatusLine(code)
-	h := response.GetDefaultHeaders(len(body))
-	h.Override("Content-Type", "text/html")
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/html")
 	w.WriteHeaders(h)
-	w.WriteBody(body)
+	w.Write(body)
 }
 
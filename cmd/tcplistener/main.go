@@ -43,8 +43,8 @@ func main() {
 		fmt.Printf("- Version: %s\n", req.RequestLine.HttpVersion)
 
 		fmt.Println("Headers:")
-		for header := range req.Headers {
-			fmt.Printf("- %s: %s\n", header, req.Headers[header])
+		for _, field := range req.Headers.Raw() {
+			fmt.Printf("- %s: %s\n", field.Name, field.Value)
 		}
 
 		fmt.Println("Body:")
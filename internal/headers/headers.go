@@ -7,7 +7,17 @@ import (
 	"strings"
 )
 
-type Headers map[string]string
+// Field is a single header field line, with the name as it was sent.
+type Field struct {
+	Name	string
+	Value	string
+}
+
+// Headers holds header field lines in the order they were parsed or added.
+// Names are matched case-insensitively, but the original casing is kept.
+type Headers struct {
+	fields	[]Field
+}
 
 const crlf = "\r\n"
 var headerNameRegex = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+\\-.^_`|~]+$")
@@ -18,58 +28,180 @@ func ValidateHeaderName(name string) bool {
 	return headerNameRegex.MatchString(name)
 }
 
-func NewHeaders() Headers {
-	return make(Headers)
+func NewHeaders() *Headers {
+	return &Headers{}
 }
 
-func (h Headers) Parse(data []byte) (n int, done bool, err error) {
-	idx := bytes.Index(data, []byte(crlf))	
-	if idx == -1 {
-		return 0, false, nil
+// Parse parses one field line from data, accepting leading whitespace
+// before the field name. Lines must end in CRLF. It returns done once it
+// reaches the empty line that ends the headers, and n == 0 if no complete
+// line is buffered yet.
+func (h *Headers) Parse(data []byte) (n int, done bool, err error) {
+	return h.parse(data, false, false)
+}
+
+// ParseAllowBareLF is Parse that also accepts a bare LF as a line ending,
+// as RFC 9112 allows.
+func (h *Headers) ParseAllowBareLF(data []byte) (n int, done bool, err error) {
+	return h.parse(data, false, true)
+}
+
+// ParseStrict is Parse for callers that must not be lenient: obsolete line
+// folding and leading whitespace are rejected, and values may not contain
+// control characters.
+func (h *Headers) ParseStrict(data []byte) (n int, done bool, err error) {
+	return h.parse(data, true, false)
+}
+
+func (h *Headers) parse(data []byte, strict, allowBareLF bool) (n int, done bool, err error) {
+	line, n, err := NextLine(data, allowBareLF)
+	if err != nil || n == 0 {
+		return 0, false, err
+	}
+	if len(line) == 0 {
+		return n, true, nil
 	}
-	if idx == 0 {
-		return 2, true, nil
+	if strict && (line[0] == ' ' || line[0] == '\t') {
+		return 0, false, fmt.Errorf("Error: obsolete line folding or leading whitespace: %q", line)
 	}
 
-	before, after, found:= bytes.Cut(data[:idx], []byte(":"))
+	before, after, found:= bytes.Cut(line, []byte(":"))
 	if !found {
-		return 0, false, fmt.Errorf("Error: invalid header format: %s", string(data[:idx]))
+		return 0, false, fmt.Errorf("Error: invalid header format: %s", string(line))
 	}
 
 	key := string(before)
-	if key != strings.TrimRight(key, " ") {
+	if key != strings.TrimRight(key, " \t") {
 		return 0, false, fmt.Errorf("Error: invalid header format: %s", key)
 	}
 
-	value := bytes.TrimSpace(after)
+	value := bytes.Trim(after, " \t")
 	key = strings.TrimSpace(key)
 
 	if !ValidateHeaderName(key) {
 		return 0, false, fmt.Errorf("Error: Invalid header name: %s", key)
 	}
+	if strict && !validateHeaderValue(value) {
+		return 0, false, fmt.Errorf("Error: invalid character in value of header %s", key)
+	}
+
+	h.Add(key, string(value))
+	return n, false, nil
+}
+
+// NextLine finds the first line in data. Lines end in CRLF; a bare LF is
+// only accepted when allowBareLF is set, as RFC 9112 allows. A CR anywhere
+// else is always an error. It returns the line without its ending and the
+// number of bytes it took up, or n == 0 if no complete line is buffered.
+func NextLine(data []byte, allowBareLF bool) (line []byte, n int, err error) {
+	idx := bytes.IndexByte(data, '\n')
+	if idx == -1 {
+		if cr := bytes.IndexByte(data, '\r'); cr != -1 && cr < len(data)-1 {
+			return nil, 0, fmt.Errorf("Error: bare CR in line")
+		}
+		return nil, 0, nil
+	}
+
+	line = data[:idx]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	} else if !allowBareLF {
+		return nil, 0, fmt.Errorf("Error: line ends in a bare LF")
+	}
+	if bytes.IndexByte(line, '\r') != -1 {
+		return nil, 0, fmt.Errorf("Error: bare CR in line")
+	}
+	return line, idx+1, nil
+}
+
+// validateHeaderValue reports whether value is free of control characters
+// other than horizontal tab.
+func validateHeaderValue(value []byte) bool {
+	for _, c := range value {
+		if (c < 0x20 && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// Add appends a field line, keeping any existing lines with the same name.
+func (h *Headers) Add(key, value string) {
+	h.fields = append(h.fields, Field{Name: key, Value: value})
+}
+
+// Set replaces every field line with the given name by a single line. The
+// replacement takes the position of the first line it replaces.
+func (h *Headers) Set(key, value string) {
+	for i, f := range h.fields {
+		if strings.EqualFold(f.Name, key) {
+			h.fields[i] = Field{Name: key, Value: value}
+			h.removeFrom(i+1, key)
+			return
+		}
+	}
+	h.Add(key, value)
+}
 
-	h.Set(key, string(value))
-	return idx+2, false, nil
+// Get returns the combined value of every field line with the given name,
+// joined with ", ". Use Values for fields such as Set-Cookie that cannot
+// be combined.
+func (h *Headers) Get(key string) (string, bool) {
+	values := h.Values(key)
+	if len(values) == 0 {
+		return "", false
+	}
+	return strings.Join(values, ", "), true
 }
 
-func (h Headers) Set(key, value string) {
-	existingValue, exists := h[key]
-	if exists {
-		h[strings.ToLower(key)] = existingValue + ", " + value
-	} else {
-		h[strings.ToLower(key)] = value
+// Values returns the value of each field line with the given name, in
+// order.
+func (h *Headers) Values(key string) []string {
+	var values []string
+	for _, f := range h.fields {
+		if strings.EqualFold(f.Name, key) {
+			values = append(values, f.Value)
+		}
 	}
+	return values
 }
 
-func (h Headers) Override(key, value string) {
-	h[strings.ToLower(key)] = value
+func (h *Headers) Remove(key string) {
+	h.removeFrom(0, key)
 }
 
-func (h Headers) Get(key string) (string, bool) {
-	value, exists := h[strings.ToLower(key)]
-	return value, exists
+func (h *Headers) removeFrom(start int, key string) {
+	kept := h.fields[:start]
+	for _, f := range h.fields[start:] {
+		if !strings.EqualFold(f.Name, key) {
+			kept = append(kept, f)
+		}
+	}
+	h.fields = kept
 }
 
-func (h Headers) Remove(key string) {
-	delete(h, strings.ToLower(key))
+// Raw returns a copy of every field line in order, with names cased as
+// they were parsed or added.
+func (h *Headers) Raw() []Field {
+	fields := make([]Field, len(h.fields))
+	copy(fields, h.fields)
+	return fields
+}
+
+// Len returns the number of field lines.
+func (h *Headers) Len() int {
+	return len(h.fields)
+}
+
+// HasToken reports whether the comma separated list in the named header
+// contains token, compared case-insensitively.
+func (h *Headers) HasToken(key, token string) bool {
+	for _, value := range h.Values(key) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
 }
@@ -7,6 +7,12 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+// get returns the combined value of a header, or "" if it is missing.
+func get(h *Headers, key string) string {
+	value, _ := h.Get(key)
+	return value
+}
+
 func TestHeaderParsing(t *testing.T) {
 	// Test: Valid single header
 	headers := NewHeaders()
@@ -14,7 +20,7 @@ func TestHeaderParsing(t *testing.T) {
 	n, done, err := headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, "localhost:42069", get(headers, "host"))
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 
@@ -24,7 +30,7 @@ func TestHeaderParsing(t *testing.T) {
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, "localhost:42069", get(headers, "host"))
 	assert.Equal(t, 28, n)
 	assert.False(t, done)
 
@@ -35,15 +41,15 @@ func TestHeaderParsing(t *testing.T) {
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, "localhost:42069", get(headers, "host"))
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 
 	// Test: 2nd of 2 headers
 	n2, done, err := headers.Parse(data[n:])
 	require.NoError(t, err)
-	assert.Equal(t, 2, len(headers))
-	require.Equal(t, "curl/7.81.0", headers["user-agent"])
+	assert.Equal(t, 2, headers.Len())
+	require.Equal(t, "curl/7.81.0", get(headers, "user-agent"))
 	assert.Equal(t, 25, n2)
 	assert.False(t, done)
 	
@@ -84,7 +90,7 @@ func TestHeaderParsing(t *testing.T) {
 	_, done, err = headers.Parse(data[n+n2+n3:])
 	require.NoError(t, err)
 	assert.True(t, done)
-	assert.Equal(t, "testity1, testity2", headers["set-person"])
+	assert.Equal(t, "testity1, testity2", get(headers, "set-person"))
 
 	// Test: headers with empty values
 	headers = NewHeaders()
@@ -92,6 +98,82 @@ func TestHeaderParsing(t *testing.T) {
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	assert.False(t, done)
-	assert.Equal(t, "", headers["set-person"])
+	assert.Equal(t, "", get(headers, "set-person"))
+
+	// Test: A bare LF is rejected by default
+	headers = NewHeaders()
+	data = []byte("Host: localhost:42069\n\n")
+	n, done, err = headers.Parse(data)
+	require.Error(t, err)
+	assert.Equal(t, 0, n)
+	assert.False(t, done)
+
+	// Test: ...and accepted when allowed
+	headers = NewHeaders()
+	n, done, err = headers.ParseAllowBareLF(data)
+	require.NoError(t, err)
+	assert.Equal(t, 22, n)
+	assert.False(t, done)
+	assert.Equal(t, "localhost:42069", get(headers, "host"))
+	_, done, err = headers.ParseAllowBareLF(data[n:])
+	require.NoError(t, err)
+	assert.True(t, done)
 }
 
+
+func TestHeaderFieldLines(t *testing.T) {
+	// Test: Repeated fields keep every line, in order and with their casing
+	headers := NewHeaders()
+	data := []byte("Host: localhost:42069\r\nSet-Cookie: a=1\r\nX-Trace: on\r\nset-cookie: b=2; Path=/\r\n\r\n")
+	total := 0
+	for {
+		n, done, err := headers.Parse(data[total:])
+		require.NoError(t, err)
+		total += n
+		if done {
+			break
+		}
+	}
+	assert.Equal(t, []string{"a=1", "b=2; Path=/"}, headers.Values("SET-COOKIE"))
+	assert.Equal(t, []Field{
+		{Name: "Host", Value: "localhost:42069"},
+		{Name: "Set-Cookie", Value: "a=1"},
+		{Name: "X-Trace", Value: "on"},
+		{Name: "set-cookie", Value: "b=2; Path=/"},
+	}, headers.Raw())
+	assert.Equal(t, 4, headers.Len())
+
+	// Test: Set replaces every line in place of the first
+	headers.Set("Set-Cookie", "c=3")
+	assert.Equal(t, []Field{
+		{Name: "Host", Value: "localhost:42069"},
+		{Name: "Set-Cookie", Value: "c=3"},
+		{Name: "X-Trace", Value: "on"},
+	}, headers.Raw())
+
+	// Test: Add keeps existing lines
+	headers.Add("set-cookie", "d=4")
+	assert.Equal(t, []string{"c=3", "d=4"}, headers.Values("Set-Cookie"))
+
+	// Test: Set on a new name adds it at the end
+	headers.Set("Content-Type", "text/plain")
+	assert.Equal(t, "Content-Type", headers.Raw()[headers.Len()-1].Name)
+
+	// Test: Remove drops every line with the name
+	headers.Remove("SET-COOKIE")
+	_, exists := headers.Get("set-cookie")
+	assert.False(t, exists)
+	assert.Nil(t, headers.Values("set-cookie"))
+
+	// Test: Raw returns a copy
+	raw := headers.Raw()
+	raw[0].Value = "changed"
+	assert.Equal(t, "localhost:42069", get(headers, "host"))
+
+	// Test: HasToken looks through every line
+	headers = NewHeaders()
+	headers.Add("Connection", "keep-alive")
+	headers.Add("Connection", "Upgrade, Close")
+	assert.True(t, headers.HasToken("connection", "close"))
+	assert.False(t, headers.HasToken("connection", "te"))
+}
@@ -0,0 +1,81 @@
+package http2
+
+import (
+	"fmt"
+)
+
+// ErrCode is the error code of an RST_STREAM or GOAWAY frame.
+type ErrCode uint32
+
+const (
+	ErrCodeNo					ErrCode = 0x0
+	ErrCodeProtocol				ErrCode = 0x1
+	ErrCodeInternal				ErrCode = 0x2
+	ErrCodeFlowControl			ErrCode = 0x3
+	ErrCodeSettingsTimeout		ErrCode = 0x4
+	ErrCodeStreamClosed			ErrCode = 0x5
+	ErrCodeFrameSize			ErrCode = 0x6
+	ErrCodeRefusedStream		ErrCode = 0x7
+	ErrCodeCancel				ErrCode = 0x8
+	ErrCodeCompression			ErrCode = 0x9
+	ErrCodeConnect				ErrCode = 0xa
+	ErrCodeEnhanceYourCalm		ErrCode = 0xb
+	ErrCodeInadequateSecurity	ErrCode = 0xc
+	ErrCodeHTTP11Required		ErrCode = 0xd
+)
+
+var errCodeNames = map[ErrCode]string{
+	ErrCodeNo:					"NO_ERROR",
+	ErrCodeProtocol:			"PROTOCOL_ERROR",
+	ErrCodeInternal:			"INTERNAL_ERROR",
+	ErrCodeFlowControl:			"FLOW_CONTROL_ERROR",
+	ErrCodeSettingsTimeout:		"SETTINGS_TIMEOUT",
+	ErrCodeStreamClosed:		"STREAM_CLOSED",
+	ErrCodeFrameSize:			"FRAME_SIZE_ERROR",
+	ErrCodeRefusedStream:		"REFUSED_STREAM",
+	ErrCodeCancel:				"CANCEL",
+	ErrCodeCompression:			"COMPRESSION_ERROR",
+	ErrCodeConnect:				"CONNECT_ERROR",
+	ErrCodeEnhanceYourCalm:		"ENHANCE_YOUR_CALM",
+	ErrCodeInadequateSecurity:	"INADEQUATE_SECURITY",
+	ErrCodeHTTP11Required:		"HTTP_1_1_REQUIRED",
+}
+
+func (c ErrCode) String() string {
+	if name, ok := errCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN_ERROR_%d", uint32(c))
+}
+
+// connError is a connection error: the connection is ended with a GOAWAY
+// carrying the code.
+type connError struct {
+	code	ErrCode
+	reason	string
+}
+
+func (e connError) Error() string {
+	return fmt.Sprintf("Error: connection error %s: %s", e.code, e.reason)
+}
+
+// streamError is a stream error: just the stream is reset.
+type streamError struct {
+	streamID	uint32
+	code		ErrCode
+	reason		string
+}
+
+func (e streamError) Error() string {
+	return fmt.Sprintf("Error: stream %d error %s: %s", e.streamID, e.code, e.reason)
+}
+
+// StreamResetError is what a handler sees when writing to, or reading the
+// body of, a stream that was reset.
+type StreamResetError struct {
+	Code	ErrCode
+}
+
+func (e StreamResetError) Error() string {
+	return fmt.Sprintf("Error: stream reset with %s", e.Code)
+}
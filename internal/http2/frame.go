@@ -0,0 +1,178 @@
+package http2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// frameHeaderLen is the size of the header in front of every frame.
+const frameHeaderLen = 9
+
+type FrameType uint8
+
+const (
+	FrameData			FrameType = 0x0
+	FrameHeaders		FrameType = 0x1
+	FramePriority		FrameType = 0x2
+	FrameRSTStream		FrameType = 0x3
+	FrameSettings		FrameType = 0x4
+	FramePushPromise	FrameType = 0x5
+	FramePing			FrameType = 0x6
+	FrameGoAway			FrameType = 0x7
+	FrameWindowUpdate	FrameType = 0x8
+	FrameContinuation	FrameType = 0x9
+)
+
+func (t FrameType) String() string {
+	switch t {
+	case FrameData:
+		return "DATA"
+	case FrameHeaders:
+		return "HEADERS"
+	case FramePriority:
+		return "PRIORITY"
+	case FrameRSTStream:
+		return "RST_STREAM"
+	case FrameSettings:
+		return "SETTINGS"
+	case FramePushPromise:
+		return "PUSH_PROMISE"
+	case FramePing:
+		return "PING"
+	case FrameGoAway:
+		return "GOAWAY"
+	case FrameWindowUpdate:
+		return "WINDOW_UPDATE"
+	case FrameContinuation:
+		return "CONTINUATION"
+	default:
+		return fmt.Sprintf("UNKNOWN_FRAME_TYPE_%d", uint8(t))
+	}
+}
+
+type Flags uint8
+
+const (
+	FlagEndStream	Flags = 0x1
+	FlagAck			Flags = 0x1
+	FlagEndHeaders	Flags = 0x4
+	FlagPadded		Flags = 0x8
+	FlagPriority	Flags = 0x20
+)
+
+func (f Flags) Has(flag Flags) bool {
+	return f&flag != 0
+}
+
+// SettingID identifies a SETTINGS parameter.
+type SettingID uint16
+
+const (
+	SettingHeaderTableSize		SettingID = 0x1
+	SettingEnablePush			SettingID = 0x2
+	SettingMaxConcurrentStreams	SettingID = 0x3
+	SettingInitialWindowSize	SettingID = 0x4
+	SettingMaxFrameSize			SettingID = 0x5
+	SettingMaxHeaderListSize	SettingID = 0x6
+)
+
+type Setting struct {
+	ID		SettingID
+	Value	uint32
+}
+
+const (
+	// defaultWindowSize is the initial flow control window of both the
+	// connection and every stream
+	defaultWindowSize	= 65535
+	maxWindowSize		= 1<<31 - 1
+	// minMaxFrameSize is the frame size every endpoint has to accept, and
+	// maxMaxFrameSize the largest anyone may ask for
+	minMaxFrameSize	= 1 << 14
+	maxMaxFrameSize	= 1<<24 - 1
+)
+
+// frameHeader is the fixed part of a frame.
+type frameHeader struct {
+	length		uint32
+	typ			FrameType
+	flags		Flags
+	streamID	uint32
+}
+
+func (h frameHeader) String() string {
+	return fmt.Sprintf("%s stream=%d len=%d flags=%#x", h.typ, h.streamID, h.length, uint8(h.flags))
+}
+
+// readFrame reads the next frame, refusing any whose payload is larger
+// than maxSize before reading it.
+func readFrame(r io.Reader, buf []byte, maxSize uint32) (frameHeader, []byte, error) {
+	var hdr [frameHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return frameHeader{}, nil, err
+	}
+	h := frameHeader{
+		length: uint32(hdr[0])<<16 | uint32(hdr[1])<<8 | uint32(hdr[2]),
+		typ: FrameType(hdr[3]),
+		flags: Flags(hdr[4]),
+		streamID: binary.BigEndian.Uint32(hdr[5:]) & (1<<31 - 1),
+	}
+	if h.length > maxSize {
+		return h, nil, connError{ErrCodeFrameSize, fmt.Sprintf("%s frame of %d bytes is larger than %d", h.typ, h.length, maxSize)}
+	}
+	if uint32(cap(buf)) < h.length {
+		buf = make([]byte, h.length)
+	}
+	payload := buf[:h.length]
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return h, nil, err
+	}
+	return h, payload, nil
+}
+
+// appendFrameHeader appends the fixed part of a frame to dst.
+func appendFrameHeader(dst []byte, h frameHeader) []byte {
+	dst = append(dst, byte(h.length>>16), byte(h.length>>8), byte(h.length), byte(h.typ), byte(h.flags))
+	return binary.BigEndian.AppendUint32(dst, h.streamID&(1<<31-1))
+}
+
+// removePadding strips the padding of a DATA or HEADERS frame.
+func removePadding(h frameHeader, payload []byte) ([]byte, error) {
+	if !h.flags.Has(FlagPadded) {
+		return payload, nil
+	}
+	if len(payload) == 0 {
+		return nil, connError{ErrCodeProtocol, fmt.Sprintf("padded %s frame without a pad length", h.typ)}
+	}
+	padLength := int(payload[0])
+	if padLength >= len(payload) {
+		// the padding takes up the whole frame, or more
+		return nil, connError{ErrCodeProtocol, fmt.Sprintf("%s frame padding too long", h.typ)}
+	}
+	return payload[1 : len(payload)-padLength], nil
+}
+
+func appendSettings(dst []byte, settings []Setting) []byte {
+	for _, s := range settings {
+		dst = binary.BigEndian.AppendUint16(dst, uint16(s.ID))
+		dst = binary.BigEndian.AppendUint32(dst, s.Value)
+	}
+	return dst
+}
+
+// parseSettings parses the payload of a SETTINGS frame, or the base64url
+// decoded HTTP2-Settings header of an h2c upgrade.
+func parseSettings(payload []byte) ([]Setting, error) {
+	if len(payload)%6 != 0 {
+		return nil, connError{ErrCodeFrameSize, "SETTINGS payload is not a multiple of 6 bytes"}
+	}
+	settings := make([]Setting, 0, len(payload)/6)
+	for i := 0; i < len(payload); i += 6 {
+		settings = append(settings, Setting{
+			ID: SettingID(binary.BigEndian.Uint16(payload[i:])),
+			Value: binary.BigEndian.Uint32(payload[i+2:]),
+		})
+	}
+	return settings, nil
+}
@@ -0,0 +1,161 @@
+package hpack
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrInvalidIndex			= errors.New("hpack: invalid table index")
+	ErrTableSizeUpdate		= errors.New("hpack: dynamic table size update not at the start of a header block")
+	ErrTableSizeTooLarge	= errors.New("hpack: dynamic table size update above the allowed maximum")
+	ErrHeaderListTooLarge	= errors.New("hpack: header list too large")
+)
+
+// Decoder decodes header blocks, keeping the dynamic table the peer's
+// encoder builds up across them.
+type Decoder struct {
+	table	dynamicTable
+	// maxTableSize is the limit we advertised in SETTINGS_HEADER_TABLE_SIZE
+	maxTableSize	uint32
+	// MaxStringLength bounds a single name or value; zero means no limit
+	MaxStringLength	int
+	// MaxHeaderListSize bounds the decoded list, counting each field by
+	// its Size; zero means no limit
+	MaxHeaderListSize	uint32
+}
+
+func NewDecoder(maxTableSize uint32) *Decoder {
+	return &Decoder{
+		table: dynamicTable{maxSize: maxTableSize},
+		maxTableSize: maxTableSize,
+	}
+}
+
+// SetMaxTableSize changes the limit the peer's encoder has to keep its
+// table under. The table itself only shrinks once the encoder says so,
+// except that it may never exceed the limit.
+func (d *Decoder) SetMaxTableSize(n uint32) {
+	d.maxTableSize = n
+	if d.table.maxSize > n {
+		d.table.setMaxSize(n)
+	}
+}
+
+// Decode decodes a complete header block, CONTINUATION frames included.
+// A list over MaxHeaderListSize returns ErrHeaderListTooLarge, and the
+// rest of the block is still read so the dynamic table stays usable. Any
+// other error leaves the decoder unusable.
+func (d *Decoder) Decode(block []byte) ([]HeaderField, error) {
+	fields, err := d.decode(block)
+	if errors.Is(err, ErrHeaderListTooLarge) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, DecodingError{Err: err}
+	}
+	return fields, nil
+}
+
+func (d *Decoder) decode(p []byte) ([]HeaderField, error) {
+	var fields []HeaderField
+	var listSize uint32
+	tooLarge := false
+	sawField := false
+	for len(p) > 0 {
+		b := p[0]
+		var f HeaderField
+		var n int
+		var err error
+		switch {
+		case b&0x80 != 0:
+			// indexed header field
+			var index uint64
+			index, n, err = readInteger(p, 7)
+			if err != nil {
+				return nil, err
+			}
+			var ok bool
+			if f, ok = d.table.field(index); !ok {
+				return nil, fmt.Errorf("%w: %d", ErrInvalidIndex, index)
+			}
+		case b&0xC0 == 0x40:
+			// literal with incremental indexing
+			f, n, err = d.readLiteral(p, 6)
+			if err != nil {
+				return nil, err
+			}
+			d.table.add(f)
+		case b&0xE0 == 0x20:
+			// dynamic table size update
+			if sawField {
+				return nil, ErrTableSizeUpdate
+			}
+			var size uint64
+			size, n, err = readInteger(p, 5)
+			if err != nil {
+				return nil, err
+			}
+			if size > uint64(d.maxTableSize) {
+				return nil, ErrTableSizeTooLarge
+			}
+			d.table.setMaxSize(uint32(size))
+			p = p[n:]
+			continue
+		default:
+			// literal without indexing (0000) or never indexed (0001)
+			f, n, err = d.readLiteral(p, 4)
+			if err != nil {
+				return nil, err
+			}
+			f.Sensitive = b&0x10 != 0
+		}
+		p = p[n:]
+		sawField = true
+		if tooLarge {
+			continue
+		}
+		listSize += f.Size()
+		if d.MaxHeaderListSize > 0 && listSize > d.MaxHeaderListSize {
+			// keep reading for the table updates, but stop collecting
+			tooLarge = true
+			fields = nil
+			continue
+		}
+		fields = append(fields, f)
+	}
+	if tooLarge {
+		return nil, ErrHeaderListTooLarge
+	}
+	return fields, nil
+}
+
+// readLiteral reads a literal field whose name index has an n-bit prefix,
+// a zero index meaning the name follows as a string literal.
+func (d *Decoder) readLiteral(p []byte, prefix uint) (HeaderField, int, error) {
+	index, n, err := readInteger(p, prefix)
+	if err != nil {
+		return HeaderField{}, 0, err
+	}
+	var f HeaderField
+	if index == 0 {
+		name, m, err := readString(p[n:], d.MaxStringLength)
+		if err != nil {
+			return HeaderField{}, 0, err
+		}
+		f.Name = name
+		n += m
+	} else {
+		entry, ok := d.table.field(index)
+		if !ok {
+			return HeaderField{}, 0, fmt.Errorf("%w: %d", ErrInvalidIndex, index)
+		}
+		f.Name = entry.Name
+	}
+	value, m, err := readString(p[n:], d.MaxStringLength)
+	if err != nil {
+		return HeaderField{}, 0, err
+	}
+	f.Value = value
+	return f, n + m, nil
+}
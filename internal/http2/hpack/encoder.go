@@ -0,0 +1,73 @@
+package hpack
+
+// Encoder encodes header blocks, keeping a dynamic table that mirrors the
+// one the peer's decoder builds.
+type Encoder struct {
+	table	dynamicTable
+	// maxTableSize is the largest table we are willing to use, whatever
+	// the peer allows
+	maxTableSize	uint32
+	// minSize is the smallest size the table went through since the last
+	// header block, and sizeUpdate whether the peer needs telling
+	minSize		uint32
+	sizeUpdate	bool
+}
+
+func NewEncoder() *Encoder {
+	return &Encoder{
+		table: dynamicTable{maxSize: DefaultTableSize},
+		maxTableSize: DefaultTableSize,
+	}
+}
+
+// SetMaxTableSize applies the peer's SETTINGS_HEADER_TABLE_SIZE. The
+// change is announced at the start of the next header block.
+func (e *Encoder) SetMaxTableSize(n uint32) {
+	n = min(n, e.maxTableSize)
+	if n == e.table.maxSize {
+		return
+	}
+	if !e.sizeUpdate || n < e.minSize {
+		e.minSize = n
+	}
+	e.sizeUpdate = true
+	e.table.setMaxSize(n)
+}
+
+// Encode appends the header block for fields to dst.
+func (e *Encoder) Encode(dst []byte, fields []HeaderField) []byte {
+	if e.sizeUpdate {
+		// a table shrunk and then grown again has to say so, or the
+		// decoder would keep entries we evicted
+		if e.minSize < e.table.maxSize {
+			dst = appendInteger(dst, 0x20, 5, uint64(e.minSize))
+		}
+		dst = appendInteger(dst, 0x20, 5, uint64(e.table.maxSize))
+		e.sizeUpdate = false
+	}
+	for _, f := range fields {
+		dst = e.encodeField(dst, f)
+	}
+	return dst
+}
+
+func (e *Encoder) encodeField(dst []byte, f HeaderField) []byte {
+	index, nameValueMatch := e.table.search(f)
+	if nameValueMatch && !f.Sensitive {
+		return appendInteger(dst, 0x80, 7, index)
+	}
+	switch {
+	case f.Sensitive:
+		dst = appendInteger(dst, 0x10, 4, index)
+	case f.Size() <= e.table.maxSize:
+		dst = appendInteger(dst, 0x40, 6, index)
+		e.table.add(f)
+	default:
+		// a field that would empty the table is better left out of it
+		dst = appendInteger(dst, 0, 4, index)
+	}
+	if index == 0 {
+		dst = appendString(dst, f.Name)
+	}
+	return appendString(dst, f.Value)
+}
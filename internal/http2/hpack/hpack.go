@@ -0,0 +1,123 @@
+// Package hpack implements HPACK, the header compression format of HTTP/2
+// (RFC 7541).
+package hpack
+
+import (
+	"errors"
+	"fmt"
+)
+
+// DefaultTableSize is the dynamic table size both ends start with.
+const DefaultTableSize = 4096
+
+var (
+	ErrIntegerOverflow	= errors.New("hpack: integer overflow")
+	ErrTruncated		= errors.New("hpack: truncated header block")
+	ErrStringTooLong	= errors.New("hpack: string literal too long")
+)
+
+// maxInteger bounds the integers a decoder accepts; nothing in a header
+// block legitimately comes close.
+const maxInteger = 1<<32 - 1
+
+// appendInteger appends i using an n-bit prefix (RFC 7541 section 5.1).
+// first carries the bits above the prefix.
+func appendInteger(dst []byte, first byte, n uint, i uint64) []byte {
+	limit := uint64(1)<<n - 1
+	if i < limit {
+		return append(dst, first|byte(i))
+	}
+	dst = append(dst, first|byte(limit))
+	i -= limit
+	for i >= 128 {
+		dst = append(dst, byte(i&0x7F)|0x80)
+		i >>= 7
+	}
+	return append(dst, byte(i))
+}
+
+// readInteger reads an integer with an n-bit prefix from the start of p,
+// returning it and the number of bytes it took.
+func readInteger(p []byte, n uint) (uint64, int, error) {
+	if len(p) == 0 {
+		return 0, 0, ErrTruncated
+	}
+	limit := uint64(1)<<n - 1
+	i := uint64(p[0]) & limit
+	if i < limit {
+		return i, 1, nil
+	}
+	var shift uint
+	for pos := 1; pos < len(p); pos++ {
+		b := p[pos]
+		i += uint64(b&0x7F) << shift
+		if i > maxInteger {
+			return 0, 0, ErrIntegerOverflow
+		}
+		if b&0x80 == 0 {
+			return i, pos + 1, nil
+		}
+		shift += 7
+	}
+	return 0, 0, ErrTruncated
+}
+
+// appendString appends a string literal, Huffman encoded when that is
+// shorter (RFC 7541 section 5.2).
+func appendString(dst []byte, s string) []byte {
+	if n := huffmanEncodedLen(s); n < len(s) {
+		dst = appendInteger(dst, 0x80, 7, uint64(n))
+		return appendHuffman(dst, s)
+	}
+	dst = appendInteger(dst, 0, 7, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// readString reads a string literal from the start of p, returning it and
+// the number of bytes it took. Strings longer than maxLen are refused
+// before they are decoded.
+func readString(p []byte, maxLen int) (string, int, error) {
+	if len(p) == 0 {
+		return "", 0, ErrTruncated
+	}
+	huffman := p[0]&0x80 != 0
+	length, n, err := readInteger(p, 7)
+	if err != nil {
+		return "", 0, err
+	}
+	if uint64(len(p)-n) < length {
+		return "", 0, ErrTruncated
+	}
+	if maxLen > 0 && length > uint64(maxLen) {
+		return "", 0, ErrStringTooLong
+	}
+	raw := p[n : n+int(length)]
+	n += int(length)
+	if !huffman {
+		return string(raw), n, nil
+	}
+	s, err := decodeHuffman(raw)
+	if err != nil {
+		return "", 0, err
+	}
+	// a Huffman code is at least five bits, so the decoded string is at
+	// most 8/5 of the encoded one; checking again catches the rest
+	if maxLen > 0 && len(s) > maxLen {
+		return "", 0, ErrStringTooLong
+	}
+	return s, n, nil
+}
+
+// DecodingError is a malformed header block. The connection has to be
+// torn down with COMPRESSION_ERROR, as the dynamic table is now unusable.
+type DecodingError struct {
+	Err error
+}
+
+func (e DecodingError) Error() string {
+	return fmt.Sprintf("hpack: decoding error: %v", e.Err)
+}
+
+func (e DecodingError) Unwrap() error {
+	return e.Err
+}
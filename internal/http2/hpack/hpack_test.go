@@ -0,0 +1,299 @@
+package hpack
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fromHex decodes the hex dumps of RFC 7541 Appendix C, spaces allowed.
+func fromHex(t *testing.T, s string) []byte {
+	t.Helper()
+	p, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	require.NoError(t, err)
+	return p
+}
+
+func fields(pairs ...string) []HeaderField {
+	var f []HeaderField
+	for i := 0; i < len(pairs); i += 2 {
+		f = append(f, HeaderField{Name: pairs[i], Value: pairs[i+1]})
+	}
+	return f
+}
+
+var requestVectors = []struct {
+	plain	string
+	huffman	string
+	fields	[]HeaderField
+	size	uint32
+}{
+	{
+		plain: "8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d",
+		huffman: "8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff",
+		fields: fields(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "www.example.com"),
+		size: 57,
+	},
+	{
+		plain: "8286 84be 5808 6e6f 2d63 6163 6865",
+		huffman: "8286 84be 5886 a8eb 1064 9cbf",
+		fields: fields(":method", "GET", ":scheme", "http", ":path", "/", ":authority", "www.example.com",
+			"cache-control", "no-cache"),
+		size: 110,
+	},
+	{
+		plain: "8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65",
+		huffman: "8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf",
+		fields: fields(":method", "GET", ":scheme", "https", ":path", "/index.html", ":authority", "www.example.com",
+			"custom-key", "custom-value"),
+		size: 164,
+	},
+}
+
+var responseVectors = []struct {
+	plain	string
+	huffman	string
+	fields	[]HeaderField
+	size	uint32
+}{
+	{
+		plain: "4803 3330 3258 0770 7269 7661 7465 611d 4d6f 6e2c 2032 3120 4f63 7420 3230 3133 2032 303a " +
+			"3133 3a32 3120 474d 546e 1768 7474 7073 3a2f 2f77 7777 2e65 7861 6d70 6c65 2e63 6f6d",
+		huffman: "4882 6402 5885 aec3 771a 4b61 96d0 7abe 9410 54d4 44a8 2005 9504 0b81 66e0 82a6 2d1b ff6e " +
+			"919d 29ad 1718 63c7 8f0b 97c8 e9ae 82ae 43d3",
+		fields: fields(":status", "302", "cache-control", "private", "date", "Mon, 21 Oct 2013 20:13:21 GMT",
+			"location", "https://www.example.com"),
+		size: 222,
+	},
+	{
+		plain: "4803 3330 37c1 c0bf",
+		huffman: "4883 640e ffc1 c0bf",
+		fields: fields(":status", "307", "cache-control", "private", "date", "Mon, 21 Oct 2013 20:13:21 GMT",
+			"location", "https://www.example.com"),
+		size: 222,
+	},
+	{
+		plain: "88c1 611d 4d6f 6e2c 2032 3120 4f63 7420 3230 3133 2032 303a 3133 3a32 3220 474d 54c0 5a04 " +
+			"677a 6970 7738 666f 6f3d 4153 444a 4b48 514b 425a 584f 5157 454f 5049 5541 5851 5745 4f49 " +
+			"553b 206d 6178 2d61 6765 3d33 3630 303b 2076 6572 7369 6f6e 3d31",
+		huffman: "88c1 6196 d07a be94 1054 d444 a820 0595 040b 8166 e084 a62d 1bff c05a 839b d9ab 77ad 94e7 " +
+			"821d d7f2 e6c7 b335 dfdf cd5b 3960 d5af 2708 7f36 72c1 ab27 0fb5 291f 9587 3160 65c0 03ed " +
+			"4ee5 b106 3d50 07",
+		fields: fields(":status", "200", "cache-control", "private", "date", "Mon, 21 Oct 2013 20:13:22 GMT",
+			"location", "https://www.example.com", "content-encoding", "gzip",
+			"set-cookie", "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1"),
+		size: 215,
+	},
+}
+
+func TestDecoderFieldRepresentations(t *testing.T) {
+	// Test: Literal with indexing adds to the dynamic table (C.2.1)
+	d := NewDecoder(DefaultTableSize)
+	got, err := d.Decode(fromHex(t, "400a 6375 7374 6f6d 2d6b 6579 0d63 7573 746f 6d2d 6865 6164 6572"))
+	require.NoError(t, err)
+	assert.Equal(t, fields("custom-key", "custom-header"), got)
+	assert.Equal(t, uint32(55), d.table.size)
+
+	// Test: Literal without indexing leaves the table alone (C.2.2)
+	d = NewDecoder(DefaultTableSize)
+	got, err = d.Decode(fromHex(t, "040c 2f73 616d 706c 652f 7061 7468"))
+	require.NoError(t, err)
+	assert.Equal(t, fields(":path", "/sample/path"), got)
+	assert.Empty(t, d.table.entries)
+
+	// Test: Never indexed literal is marked sensitive (C.2.3)
+	got, err = d.Decode(fromHex(t, "1008 7061 7373 776f 7264 0673 6563 7265 74"))
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{{Name: "password", Value: "secret", Sensitive: true}}, got)
+	assert.Empty(t, d.table.entries)
+
+	// Test: Indexed field from the static table (C.2.4)
+	got, err = d.Decode(fromHex(t, "82"))
+	require.NoError(t, err)
+	assert.Equal(t, fields(":method", "GET"), got)
+}
+
+func TestDecoderRequestVectors(t *testing.T) {
+	// Test: Requests without Huffman coding share a table (C.3)
+	d := NewDecoder(DefaultTableSize)
+	for _, v := range requestVectors {
+		got, err := d.Decode(fromHex(t, v.plain))
+		require.NoError(t, err)
+		assert.Equal(t, v.fields, got)
+		assert.Equal(t, v.size, d.table.size)
+	}
+
+	// Test: Requests with Huffman coding (C.4)
+	d = NewDecoder(DefaultTableSize)
+	for _, v := range requestVectors {
+		got, err := d.Decode(fromHex(t, v.huffman))
+		require.NoError(t, err)
+		assert.Equal(t, v.fields, got)
+		assert.Equal(t, v.size, d.table.size)
+	}
+}
+
+func TestDecoderResponseVectors(t *testing.T) {
+	// Test: Responses evicting from a 256 byte table, without Huffman (C.5)
+	d := NewDecoder(256)
+	for _, v := range responseVectors {
+		got, err := d.Decode(fromHex(t, v.plain))
+		require.NoError(t, err)
+		assert.Equal(t, v.fields, got)
+		assert.Equal(t, v.size, d.table.size)
+	}
+	assert.Equal(t, fields("set-cookie", "foo=ASDJKHQKBZXOQWEOPIUAXQWEOIU; max-age=3600; version=1",
+		"content-encoding", "gzip", "date", "Mon, 21 Oct 2013 20:13:22 GMT"), reversed(d.table.entries))
+
+	// Test: The same with Huffman (C.6)
+	d = NewDecoder(256)
+	for _, v := range responseVectors {
+		got, err := d.Decode(fromHex(t, v.huffman))
+		require.NoError(t, err)
+		assert.Equal(t, v.fields, got)
+		assert.Equal(t, v.size, d.table.size)
+	}
+}
+
+func reversed(entries []HeaderField) []HeaderField {
+	out := make([]HeaderField, 0, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		out = append(out, entries[i])
+	}
+	return out
+}
+
+func TestDecoderErrors(t *testing.T) {
+	cases := []struct {
+		name	string
+		block	string
+		err		error
+	}{
+		{"index zero", "80", ErrInvalidIndex},
+		{"index past the tables", "be", ErrInvalidIndex},
+		{"truncated integer", "ff", ErrTruncated},
+		{"truncated string", "400a 6375", ErrTruncated},
+		{"integer overflow", "ff ffff ffff ff0f", ErrIntegerOverflow},
+		{"size update after a field", "82 3f e1 1f", ErrTableSizeUpdate},
+		{"size update above the limit", "3f e2 1f", ErrTableSizeTooLarge},
+		// "a" is 00011 in Huffman; eight bits of padding are too many
+		{"padding longer than 7 bits", "0082 1fff 0161", ErrInvalidHuffman},
+		// padding has to be the start of EOS, all ones
+		{"padding with a zero bit", "0081 1e 0161", ErrInvalidHuffman},
+		{"EOS in the string", "0084 ffff ffff 0161", ErrInvalidHuffman},
+	}
+	for _, c := range cases {
+		// Test: Malformed blocks are decoding errors
+		_, err := NewDecoder(DefaultTableSize).Decode(fromHex(t, c.block))
+		require.Error(t, err, c.name)
+		assert.ErrorIs(t, err, c.err, c.name)
+		var decodingErr DecodingError
+		assert.ErrorAs(t, err, &decodingErr, c.name)
+	}
+
+	// Test: Header list size limit
+	d := NewDecoder(DefaultTableSize)
+	d.MaxHeaderListSize = 60
+	_, err := d.Decode(fromHex(t, "82 82"))
+	assert.ErrorIs(t, err, ErrHeaderListTooLarge)
+
+	// Test: ...which still reads the rest of the block, so table entries
+	// added after the limit was passed can be used by the next one
+	d = NewDecoder(DefaultTableSize)
+	d.MaxHeaderListSize = 60
+	_, err = d.Decode(fromHex(t, "8282 4007 782d 6164 6465 6403 7965 73"))
+	assert.ErrorIs(t, err, ErrHeaderListTooLarge)
+	got, err := d.Decode(fromHex(t, "be"))
+	require.NoError(t, err)
+	assert.Equal(t, fields("x-added", "yes"), got)
+
+	// Test: String length limit
+	d = NewDecoder(DefaultTableSize)
+	d.MaxStringLength = 4
+	_, err = d.Decode(fromHex(t, "040c 2f73 616d 706c 652f 7061 7468"))
+	assert.ErrorIs(t, err, ErrStringTooLong)
+}
+
+func TestDecoderTableSizeUpdate(t *testing.T) {
+	// Test: Size update at the start of a block evicts entries
+	d := NewDecoder(DefaultTableSize)
+	_, err := d.Decode(fromHex(t, requestVectors[0].plain))
+	require.NoError(t, err)
+	got, err := d.Decode(fromHex(t, "20 82"))
+	require.NoError(t, err)
+	assert.Equal(t, fields(":method", "GET"), got)
+	assert.Empty(t, d.table.entries)
+
+	// Test: Evicted entries can no longer be referenced
+	_, err = d.Decode(fromHex(t, "be"))
+	assert.ErrorIs(t, err, ErrInvalidIndex)
+
+	// Test: Lowering our advertised limit caps later updates
+	d = NewDecoder(DefaultTableSize)
+	d.SetMaxTableSize(100)
+	_, err = d.Decode(fromHex(t, "3f 45"))
+	assert.NoError(t, err)
+	_, err = d.Decode(fromHex(t, "3f 46"))
+	assert.ErrorIs(t, err, ErrTableSizeTooLarge)
+}
+
+func TestEncoder(t *testing.T) {
+	// Test: Requests encode to the Huffman vectors of C.4
+	e := NewEncoder()
+	for _, v := range requestVectors {
+		assert.Equal(t, fromHex(t, v.huffman), e.Encode(nil, v.fields))
+		assert.Equal(t, v.size, e.table.size)
+	}
+
+	// Test: Sensitive fields are never indexed
+	e = NewEncoder()
+	block := e.Encode(nil, []HeaderField{{Name: "authorization", Value: "secret", Sensitive: true}})
+	assert.Equal(t, byte(0x1F), block[0])
+	assert.Empty(t, e.table.entries)
+	got, err := NewDecoder(DefaultTableSize).Decode(block)
+	require.NoError(t, err)
+	assert.Equal(t, []HeaderField{{Name: "authorization", Value: "secret", Sensitive: true}}, got)
+
+	// Test: Shrinking then growing the table announces both sizes
+	e = NewEncoder()
+	e.Encode(nil, requestVectors[0].fields)
+	e.SetMaxTableSize(0)
+	e.SetMaxTableSize(1000)
+	block = e.Encode(nil, fields(":method", "GET"))
+	assert.Equal(t, fromHex(t, "20 3f c9 07 82"), block)
+	assert.Empty(t, e.table.entries)
+	e.SetMaxTableSize(1000)
+	assert.Equal(t, fromHex(t, "82"), e.Encode(nil, fields(":method", "GET")))
+
+	// Test: The encoder never goes above its own default size
+	e = NewEncoder()
+	e.SetMaxTableSize(1 << 20)
+	assert.Empty(t, e.Encode(nil, nil))
+}
+
+func TestRoundTrip(t *testing.T) {
+	// Test: A decoder follows an encoder across blocks and evictions
+	e := NewEncoder()
+	e.SetMaxTableSize(256)
+	d := NewDecoder(256)
+	for i := 0; i < 3; i++ {
+		for _, v := range responseVectors {
+			got, err := d.Decode(e.Encode(nil, v.fields))
+			require.NoError(t, err)
+			assert.Equal(t, v.fields, got)
+		}
+	}
+	assert.Equal(t, e.table.entries, d.table.entries)
+
+	// Test: Every byte survives Huffman coding
+	var all strings.Builder
+	for i := 0; i < 256; i++ {
+		all.WriteByte(byte(i))
+	}
+	s, err := decodeHuffman(appendHuffman(nil, all.String()))
+	require.NoError(t, err)
+	assert.Equal(t, all.String(), s)
+}
@@ -0,0 +1,95 @@
+package hpack
+
+import (
+	"errors"
+)
+
+var ErrInvalidHuffman = errors.New("hpack: invalid Huffman-encoded data")
+
+// huffmanNode is a node of the decoding tree. Leaves have no children and
+// hold a symbol.
+type huffmanNode struct {
+	children	[2]*huffmanNode
+	symbol		byte
+}
+
+var huffmanRoot = buildHuffmanTree()
+
+func buildHuffmanTree() *huffmanNode {
+	root := &huffmanNode{}
+	for symbol, code := range huffmanCodes {
+		node := root
+		for i := int(huffmanCodeLens[symbol]) - 1; i >= 0; i-- {
+			bit := (code >> i) & 1
+			if node.children[bit] == nil {
+				node.children[bit] = &huffmanNode{}
+			}
+			node = node.children[bit]
+		}
+		node.symbol = byte(symbol)
+	}
+	return root
+}
+
+func (n *huffmanNode) isLeaf() bool {
+	return n.children[0] == nil && n.children[1] == nil
+}
+
+// huffmanEncodedLen returns the length of s once Huffman encoded.
+func huffmanEncodedLen(s string) int {
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		bits += int(huffmanCodeLens[s[i]])
+	}
+	return (bits + 7) / 8
+}
+
+// appendHuffman appends the Huffman encoding of s to dst, padded with the
+// most significant bits of EOS.
+func appendHuffman(dst []byte, s string) []byte {
+	var acc uint64
+	bits := 0
+	for i := 0; i < len(s); i++ {
+		acc = acc<<huffmanCodeLens[s[i]] | uint64(huffmanCodes[s[i]])
+		bits += int(huffmanCodeLens[s[i]])
+		for bits >= 8 {
+			bits -= 8
+			dst = append(dst, byte(acc>>bits))
+		}
+	}
+	if bits > 0 {
+		dst = append(dst, byte(acc<<(8-bits))|byte(0xFF>>bits))
+	}
+	return dst
+}
+
+// decodeHuffman decodes a Huffman-encoded string. Padding longer than seven
+// bits, padding that is not a prefix of EOS and an encoded EOS are errors.
+func decodeHuffman(p []byte) (string, error) {
+	out := make([]byte, 0, len(p)*8/5)
+	node := huffmanRoot
+	// bits read since the last complete symbol, and whether all were ones
+	pending, allOnes := 0, true
+	for _, b := range p {
+		for i := 7; i >= 0; i-- {
+			bit := (b >> i) & 1
+			node = node.children[bit]
+			if node == nil {
+				// only EOS runs off the tree, its 30 ones being longer than
+				// any code
+				return "", ErrInvalidHuffman
+			}
+			pending++
+			allOnes = allOnes && bit == 1
+			if node.isLeaf() {
+				out = append(out, node.symbol)
+				node = huffmanRoot
+				pending, allOnes = 0, true
+			}
+		}
+	}
+	if pending > 7 || !allOnes {
+		return "", ErrInvalidHuffman
+	}
+	return string(out), nil
+}
@@ -0,0 +1,156 @@
+package hpack
+
+// HeaderField is a name-value pair in a header list. Sensitive fields are
+// never added to a dynamic table, by us or by intermediaries.
+type HeaderField struct {
+	Name		string
+	Value		string
+	Sensitive	bool
+}
+
+// Size is the size of the field as counted against a dynamic table.
+func (f HeaderField) Size() uint32 {
+	return uint32(len(f.Name) + len(f.Value) + 32)
+}
+
+// staticTable is the static table of RFC 7541 Appendix A. Index 1 is the
+// first entry.
+var staticTable = []HeaderField{
+	{Name: ":authority"},
+	{Name: ":method", Value: "GET"},
+	{Name: ":method", Value: "POST"},
+	{Name: ":path", Value: "/"},
+	{Name: ":path", Value: "/index.html"},
+	{Name: ":scheme", Value: "http"},
+	{Name: ":scheme", Value: "https"},
+	{Name: ":status", Value: "200"},
+	{Name: ":status", Value: "204"},
+	{Name: ":status", Value: "206"},
+	{Name: ":status", Value: "304"},
+	{Name: ":status", Value: "400"},
+	{Name: ":status", Value: "404"},
+	{Name: ":status", Value: "500"},
+	{Name: "accept-charset"},
+	{Name: "accept-encoding", Value: "gzip, deflate"},
+	{Name: "accept-language"},
+	{Name: "accept-ranges"},
+	{Name: "accept"},
+	{Name: "access-control-allow-origin"},
+	{Name: "age"},
+	{Name: "allow"},
+	{Name: "authorization"},
+	{Name: "cache-control"},
+	{Name: "content-disposition"},
+	{Name: "content-encoding"},
+	{Name: "content-language"},
+	{Name: "content-length"},
+	{Name: "content-location"},
+	{Name: "content-range"},
+	{Name: "content-type"},
+	{Name: "cookie"},
+	{Name: "date"},
+	{Name: "etag"},
+	{Name: "expect"},
+	{Name: "expires"},
+	{Name: "from"},
+	{Name: "host"},
+	{Name: "if-match"},
+	{Name: "if-modified-since"},
+	{Name: "if-none-match"},
+	{Name: "if-range"},
+	{Name: "if-unmodified-since"},
+	{Name: "last-modified"},
+	{Name: "link"},
+	{Name: "location"},
+	{Name: "max-forwards"},
+	{Name: "proxy-authenticate"},
+	{Name: "proxy-authorization"},
+	{Name: "range"},
+	{Name: "referer"},
+	{Name: "refresh"},
+	{Name: "retry-after"},
+	{Name: "server"},
+	{Name: "set-cookie"},
+	{Name: "strict-transport-security"},
+	{Name: "transfer-encoding"},
+	{Name: "user-agent"},
+	{Name: "vary"},
+	{Name: "via"},
+	{Name: "www-authenticate"},
+}
+
+// dynamicTable is the table of recently sent fields (RFC 7541 section
+// 2.3.2). entries holds the oldest first, while HPACK indexes start from
+// the newest.
+type dynamicTable struct {
+	entries	[]HeaderField
+	size	uint32
+	maxSize	uint32
+}
+
+func (t *dynamicTable) add(f HeaderField) {
+	t.entries = append(t.entries, f)
+	t.size += f.Size()
+	t.evict()
+}
+
+func (t *dynamicTable) setMaxSize(maxSize uint32) {
+	t.maxSize = maxSize
+	t.evict()
+}
+
+// evict drops the oldest entries until the table fits its maximum size. A
+// field bigger than the whole table empties it.
+func (t *dynamicTable) evict() {
+	n := 0
+	for t.size > t.maxSize && n < len(t.entries) {
+		t.size -= t.entries[n].Size()
+		n++
+	}
+	t.entries = t.entries[n:]
+}
+
+// field returns the entry at the combined static and dynamic index.
+func (t *dynamicTable) field(index uint64) (HeaderField, bool) {
+	if index == 0 {
+		return HeaderField{}, false
+	}
+	if index <= uint64(len(staticTable)) {
+		return staticTable[index-1], true
+	}
+	i := index - uint64(len(staticTable))
+	if i > uint64(len(t.entries)) {
+		return HeaderField{}, false
+	}
+	return t.entries[uint64(len(t.entries))-i], true
+}
+
+// search returns the index of an entry matching f by name and value, or
+// failing that by name alone, or 0.
+func (t *dynamicTable) search(f HeaderField) (index uint64, nameValueMatch bool) {
+	for i, entry := range staticTable {
+		if entry.Name != f.Name {
+			continue
+		}
+		if entry.Value == f.Value {
+			return uint64(i + 1), true
+		}
+		if index == 0 {
+			index = uint64(i + 1)
+		}
+	}
+	for i := len(t.entries) - 1; i >= 0; i-- {
+		entry := t.entries[i]
+		if entry.Name != f.Name {
+			continue
+		}
+		dynamicIndex := uint64(len(staticTable) + len(t.entries) - i)
+		if entry.Value == f.Value {
+			return dynamicIndex, true
+		}
+		if index == 0 {
+			index = dynamicIndex
+		}
+	}
+	return index, false
+}
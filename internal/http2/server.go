@@ -0,0 +1,557 @@
+// Package http2 serves HTTP/2 over cleartext TCP (h2c), both to clients
+// that start with the connection preface and to HTTP/1.1 requests that ask
+// to upgrade. Each stream is handed to the handler as an ordinary request
+// and response writer.
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"voylento/httpfromtcp/internal/http2/hpack"
+	"voylento/httpfromtcp/internal/request"
+	"voylento/httpfromtcp/internal/response"
+)
+
+// ClientPreface is what a client sends first on an HTTP/2 connection, or
+// right after the 101 response to an upgrade.
+const ClientPreface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// DefaultMaxConcurrentStreams is how many streams a client may have open
+// at once when Server.MaxConcurrentStreams is zero.
+const DefaultMaxConcurrentStreams = 250
+
+var errConnClosed = errors.New("connection closed")
+
+// Server holds the settings shared by the HTTP/2 connections of a server.
+type Server struct {
+	// Handler serves the request on a stream. It returns an error if the
+	// response could not be completed, in which case the stream is reset.
+	Handler	func(w *response.Writer, req *request.Request) error
+	// BadRequest answers a stream whose request was refused by Limits or
+	// could not be built, such as one with an invalid target.
+	BadRequest	func(w *response.Writer, err error)
+	Limits		request.Limits
+	// MaxConcurrentStreams caps the streams a client may have open, and
+	// falls back to DefaultMaxConcurrentStreams when zero.
+	MaxConcurrentStreams	uint32
+	// IdleTimeout closes a connection that has had no open streams for
+	// that long. Zero means no timeout.
+	IdleTimeout	time.Duration
+	// ConnState, if set, is told whenever the connection goes idle, with
+	// no open streams, or becomes active again.
+	ConnState	func(idle bool)
+	// Draining, if set, reports whether the server is shutting down. A
+	// draining server sends GOAWAY and takes no new streams.
+	Draining	func() bool
+}
+
+// serverConn is one HTTP/2 connection. A single goroutine reads frames
+// and each stream's handler runs in its own; writes from all of them are
+// serialized by writeMu.
+type serverConn struct {
+	srv		*Server
+	conn	net.Conn
+	br		*bufio.Reader
+	readBuf	[]byte
+	dec		*hpack.Decoder
+
+	// header block being assembled from HEADERS and CONTINUATION frames
+	headerStream	uint32
+	headerBlock		[]byte
+	headerEndStream	bool
+	headerErr		error
+	sawSettings		bool
+
+	writeMu	sync.Mutex
+	bw		*bufio.Writer
+	enc		*hpack.Encoder
+
+	// mu guards what follows and the flow control and state of every
+	// stream; cond is broadcast whenever any of it changes
+	mu					sync.Mutex
+	cond				*sync.Cond
+	streams				map[uint32]*stream
+	maxStreamID			uint32
+	sendWindow			int64
+	recvWindow			int64
+	initialSendWindow	int64
+	maxFrameSize		uint32
+	goingAway			bool
+	err					error
+	idle				bool
+	idleTimer			*time.Timer
+
+	handlers	sync.WaitGroup
+}
+
+func (s *Server) newConn(conn net.Conn, buffered []byte) *serverConn {
+	var r io.Reader = conn
+	if len(buffered) > 0 {
+		r = io.MultiReader(bytes.NewReader(buffered), conn)
+	}
+	sc := &serverConn{
+		srv: s,
+		conn: conn,
+		br: bufio.NewReader(r),
+		dec: hpack.NewDecoder(hpack.DefaultTableSize),
+		bw: bufio.NewWriter(conn),
+		enc: hpack.NewEncoder(),
+		streams: make(map[uint32]*stream),
+		sendWindow: defaultWindowSize,
+		recvWindow: defaultWindowSize,
+		initialSendWindow: defaultWindowSize,
+		maxFrameSize: minMaxFrameSize,
+	}
+	sc.cond = sync.NewCond(&sc.mu)
+	sc.dec.MaxStringLength = s.Limits.MaxHeaderBytes
+	if s.Limits.MaxHeaderBytes > 0 {
+		// enforce the advertised SETTINGS_MAX_HEADER_LIST_SIZE while
+		// decoding, so a small block of indexed fields cannot expand into
+		// a huge list
+		sc.dec.MaxHeaderListSize = uint32(s.maxHeaderBlock())
+	}
+	return sc
+}
+
+// ServeConn serves a connection whose client opened with the preface.
+// buffered holds anything already read from conn. It returns once the
+// connection is closed and every handler has returned.
+func (s *Server) ServeConn(conn net.Conn, buffered []byte) error {
+	sc := s.newConn(conn, buffered)
+	return sc.serve(nil)
+}
+
+// ServeUpgrade serves a connection that switched to HTTP/2 from an
+// HTTP/1.1 request with "Upgrade: h2c". The 101 response must already
+// have been sent. settings is the decoded HTTP2-Settings header, and req,
+// its body already read, becomes stream 1.
+func (s *Server) ServeUpgrade(conn net.Conn, buffered []byte, settings []byte, req *request.Request) error {
+	sc := s.newConn(conn, buffered)
+	parsed, err := parseSettings(settings)
+	if err == nil {
+		err = sc.applySettings(parsed)
+	}
+	if err != nil {
+		return fmt.Errorf("Error: invalid HTTP2-Settings: %w", err)
+	}
+	return sc.serve(req)
+}
+
+func (s *Server) maxConcurrentStreams() uint32 {
+	if s.MaxConcurrentStreams > 0 {
+		return s.MaxConcurrentStreams
+	}
+	return DefaultMaxConcurrentStreams
+}
+
+// maxHeaderBlock bounds a header block before it is decoded. It leaves
+// room above the limits, so that a request just over them still decodes
+// and is refused with a 431 rather than by dropping the connection.
+func (s *Server) maxHeaderBlock() int {
+	if s.Limits.MaxHeaderBytes <= 0 {
+		return 16 << 20
+	}
+	return 2 * (s.Limits.MaxHeaderBytes + s.Limits.MaxRequestLineBytes)
+}
+
+func (sc *serverConn) serve(upgraded *request.Request) error {
+	settings := []Setting{{SettingMaxConcurrentStreams, sc.srv.maxConcurrentStreams()}}
+	if sc.srv.Limits.MaxHeaderBytes > 0 {
+		settings = append(settings, Setting{SettingMaxHeaderListSize, uint32(sc.srv.Limits.MaxHeaderBytes)})
+	}
+	sc.mu.Lock()
+	sc.setIdle(true)
+	sc.mu.Unlock()
+	if err := sc.writeFrame(FrameSettings, 0, 0, appendSettings(nil, settings)); err != nil {
+		sc.close(err)
+		return err
+	}
+	if upgraded != nil {
+		sc.startUpgradedStream(upgraded)
+	}
+
+	err := sc.readPreface()
+	for err == nil {
+		var h frameHeader
+		var payload []byte
+		h, payload, err = readFrame(sc.br, sc.readBuf, minMaxFrameSize)
+		if err == nil {
+			sc.readBuf = payload[:0]
+			err = sc.processFrame(h, payload)
+		}
+		var se streamError
+		if errors.As(err, &se) {
+			sc.resetStream(se.streamID, se.code)
+			err = nil
+		}
+	}
+
+	var ce connError
+	if errors.As(err, &ce) {
+		log.Printf("Closing HTTP/2 connection from %s: %v", sc.conn.RemoteAddr(), err)
+		sc.goAway(ce.code, ce.reason)
+	}
+	sc.close(err)
+	sc.handlers.Wait()
+	if errors.As(err, &ce) || errors.Is(err, io.EOF) || errors.Is(err, errConnClosed) || errors.Is(err, net.ErrClosed) {
+		// the client went away, or was told why it had to
+		return nil
+	}
+	return err
+}
+
+func (sc *serverConn) readPreface() error {
+	preface := make([]byte, len(ClientPreface))
+	if _, err := io.ReadFull(sc.br, preface); err != nil {
+		return err
+	}
+	if string(preface) != ClientPreface {
+		return connError{ErrCodeProtocol, "invalid connection preface"}
+	}
+	return nil
+}
+
+// close marks the connection dead, failing every stream, and closes it.
+func (sc *serverConn) close(err error) {
+	if err == nil {
+		err = errConnClosed
+	}
+	sc.mu.Lock()
+	if sc.err == nil {
+		sc.err = err
+	}
+	for _, st := range sc.streams {
+		st.fail(errConnClosed)
+	}
+	if sc.idleTimer != nil {
+		sc.idleTimer.Stop()
+	}
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+	sc.conn.Close()
+}
+
+// setIdle tracks whether any streams are open, arming the idle timeout
+// and telling ConnState. The caller holds mu.
+func (sc *serverConn) setIdle(idle bool) {
+	if idle == sc.idle {
+		return
+	}
+	sc.idle = idle
+	if sc.srv.ConnState != nil {
+		sc.srv.ConnState(idle)
+	}
+	switch {
+	case sc.srv.IdleTimeout <= 0:
+	case !idle && sc.idleTimer != nil:
+		sc.idleTimer.Stop()
+	case idle && sc.idleTimer == nil:
+		sc.idleTimer = time.AfterFunc(sc.srv.IdleTimeout, sc.idleTimeout)
+	case idle:
+		sc.idleTimer.Reset(sc.srv.IdleTimeout)
+	}
+}
+
+func (sc *serverConn) idleTimeout() {
+	sc.mu.Lock()
+	if !sc.idle || sc.err != nil {
+		sc.mu.Unlock()
+		return
+	}
+	sc.goingAway = true
+	sc.mu.Unlock()
+	log.Printf("Closing idle HTTP/2 connection from %s", sc.conn.RemoteAddr())
+	sc.goAway(ErrCodeNo, "idle timeout")
+	sc.close(errConnClosed)
+}
+
+func (sc *serverConn) processFrame(h frameHeader, payload []byte) error {
+	if sc.headerStream != 0 && h.typ != FrameContinuation {
+		return connError{ErrCodeProtocol, fmt.Sprintf("%s frame in the middle of a header block", h.typ)}
+	}
+	if !sc.sawSettings && (h.typ != FrameSettings || h.flags.Has(FlagAck)) {
+		return connError{ErrCodeProtocol, fmt.Sprintf("expected SETTINGS after the preface, got %s", h.typ)}
+	}
+
+	switch h.typ {
+	case FrameData:
+		return sc.processData(h, payload)
+	case FrameHeaders:
+		return sc.processHeaders(h, payload)
+	case FrameContinuation:
+		return sc.processContinuation(h, payload)
+	case FramePriority:
+		return sc.processPriority(h, payload)
+	case FrameRSTStream:
+		return sc.processRSTStream(h, payload)
+	case FrameSettings:
+		return sc.processSettings(h, payload)
+	case FramePushPromise:
+		return connError{ErrCodeProtocol, "clients cannot push"}
+	case FramePing:
+		return sc.processPing(h, payload)
+	case FrameGoAway:
+		return sc.processGoAway(h, payload)
+	case FrameWindowUpdate:
+		return sc.processWindowUpdate(h, payload)
+	default:
+		// unknown frame types are ignored
+		return nil
+	}
+}
+
+func (sc *serverConn) processSettings(h frameHeader, payload []byte) error {
+	if h.streamID != 0 {
+		return connError{ErrCodeProtocol, "SETTINGS on a stream"}
+	}
+	if h.flags.Has(FlagAck) {
+		if len(payload) != 0 {
+			return connError{ErrCodeFrameSize, "SETTINGS ACK with a payload"}
+		}
+		return nil
+	}
+	settings, err := parseSettings(payload)
+	if err != nil {
+		return err
+	}
+	if err := sc.applySettings(settings); err != nil {
+		return err
+	}
+	sc.sawSettings = true
+	return sc.writeFrame(FrameSettings, FlagAck, 0, nil)
+}
+
+func (sc *serverConn) applySettings(settings []Setting) error {
+	for _, s := range settings {
+		switch s.ID {
+		case SettingHeaderTableSize:
+			sc.writeMu.Lock()
+			sc.enc.SetMaxTableSize(s.Value)
+			sc.writeMu.Unlock()
+		case SettingEnablePush:
+			if s.Value > 1 {
+				return connError{ErrCodeProtocol, fmt.Sprintf("invalid SETTINGS_ENABLE_PUSH %d", s.Value)}
+			}
+		case SettingInitialWindowSize:
+			if s.Value > maxWindowSize {
+				return connError{ErrCodeFlowControl, fmt.Sprintf("invalid SETTINGS_INITIAL_WINDOW_SIZE %d", s.Value)}
+			}
+			if err := sc.setInitialSendWindow(int64(s.Value)); err != nil {
+				return err
+			}
+		case SettingMaxFrameSize:
+			if s.Value < minMaxFrameSize || s.Value > maxMaxFrameSize {
+				return connError{ErrCodeProtocol, fmt.Sprintf("invalid SETTINGS_MAX_FRAME_SIZE %d", s.Value)}
+			}
+			sc.mu.Lock()
+			sc.maxFrameSize = s.Value
+			sc.mu.Unlock()
+		}
+	}
+	return nil
+}
+
+// setInitialSendWindow applies a new SETTINGS_INITIAL_WINDOW_SIZE, which
+// moves the window of every open stream by the difference.
+func (sc *serverConn) setInitialSendWindow(size int64) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	delta := size - sc.initialSendWindow
+	sc.initialSendWindow = size
+	for _, st := range sc.streams {
+		st.sendWindow += delta
+		if st.sendWindow > maxWindowSize {
+			return connError{ErrCodeFlowControl, fmt.Sprintf("stream %d window overflow", st.id)}
+		}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) processPing(h frameHeader, payload []byte) error {
+	if h.streamID != 0 {
+		return connError{ErrCodeProtocol, "PING on a stream"}
+	}
+	if len(payload) != 8 {
+		return connError{ErrCodeFrameSize, "PING payload is not 8 bytes"}
+	}
+	if h.flags.Has(FlagAck) {
+		return nil
+	}
+	return sc.writeFrame(FramePing, FlagAck, 0, payload)
+}
+
+func (sc *serverConn) processGoAway(h frameHeader, payload []byte) error {
+	if h.streamID != 0 {
+		return connError{ErrCodeProtocol, "GOAWAY on a stream"}
+	}
+	if len(payload) < 8 {
+		return connError{ErrCodeFrameSize, "GOAWAY payload too short"}
+	}
+	code := ErrCode(binary.BigEndian.Uint32(payload[4:]))
+	if code != ErrCodeNo {
+		log.Printf("HTTP/2 client %s sent GOAWAY: %s %q", sc.conn.RemoteAddr(), code, payload[8:])
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.goingAway = true
+	if len(sc.streams) == 0 {
+		return errConnClosed
+	}
+	return nil
+}
+
+func (sc *serverConn) processWindowUpdate(h frameHeader, payload []byte) error {
+	if len(payload) != 4 {
+		return connError{ErrCodeFrameSize, "WINDOW_UPDATE payload is not 4 bytes"}
+	}
+	increment := int64(binary.BigEndian.Uint32(payload) & (1<<31 - 1))
+	if increment == 0 {
+		if h.streamID == 0 {
+			return connError{ErrCodeProtocol, "WINDOW_UPDATE with a zero increment"}
+		}
+		return streamError{h.streamID, ErrCodeProtocol, "WINDOW_UPDATE with a zero increment"}
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if h.streamID == 0 {
+		sc.sendWindow += increment
+		if sc.sendWindow > maxWindowSize {
+			return connError{ErrCodeFlowControl, "connection window overflow"}
+		}
+		sc.cond.Broadcast()
+		return nil
+	}
+	st := sc.streams[h.streamID]
+	if st == nil {
+		if h.streamID > sc.maxStreamID {
+			return connError{ErrCodeProtocol, fmt.Sprintf("WINDOW_UPDATE on idle stream %d", h.streamID)}
+		}
+		// the stream is closed, and the update no longer matters
+		return nil
+	}
+	st.sendWindow += increment
+	if st.sendWindow > maxWindowSize {
+		return streamError{h.streamID, ErrCodeFlowControl, "stream window overflow"}
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) processRSTStream(h frameHeader, payload []byte) error {
+	if h.streamID == 0 {
+		return connError{ErrCodeProtocol, "RST_STREAM on stream 0"}
+	}
+	if len(payload) != 4 {
+		return connError{ErrCodeFrameSize, "RST_STREAM payload is not 4 bytes"}
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if h.streamID > sc.maxStreamID {
+		return connError{ErrCodeProtocol, fmt.Sprintf("RST_STREAM on idle stream %d", h.streamID)}
+	}
+	if st := sc.streams[h.streamID]; st != nil {
+		st.fail(StreamResetError{Code: ErrCode(binary.BigEndian.Uint32(payload))})
+		sc.forgetStream(st)
+	}
+	return nil
+}
+
+func (sc *serverConn) processPriority(h frameHeader, payload []byte) error {
+	if h.streamID == 0 {
+		return connError{ErrCodeProtocol, "PRIORITY on stream 0"}
+	}
+	if len(payload) != 5 {
+		return streamError{h.streamID, ErrCodeFrameSize, "PRIORITY payload is not 5 bytes"}
+	}
+	// priorities are advisory, and deprecated; all that matters is that a
+	// stream does not depend on itself
+	if binary.BigEndian.Uint32(payload)&(1<<31-1) == h.streamID {
+		return streamError{h.streamID, ErrCodeProtocol, "stream depends on itself"}
+	}
+	return nil
+}
+
+// writeFrame sends a single frame.
+func (sc *serverConn) writeFrame(typ FrameType, flags Flags, streamID uint32, payload []byte) error {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	return sc.writeFrameLocked(typ, flags, streamID, payload)
+}
+
+func (sc *serverConn) writeFrameLocked(typ FrameType, flags Flags, streamID uint32, payload []byte) error {
+	var hdr [frameHeaderLen]byte
+	appendFrameHeader(hdr[:0], frameHeader{length: uint32(len(payload)), typ: typ, flags: flags, streamID: streamID})
+	if _, err := sc.bw.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := sc.bw.Write(payload); err != nil {
+		return err
+	}
+	return sc.bw.Flush()
+}
+
+func (sc *serverConn) writeWindowUpdate(streamID uint32, increment int64) error {
+	if increment <= 0 {
+		return nil
+	}
+	return sc.writeFrame(FrameWindowUpdate, 0, streamID, binary.BigEndian.AppendUint32(nil, uint32(increment)))
+}
+
+// goAway tells the client no more streams will be served, and why. The
+// connection is only marked as going away once the frame is out, since the
+// last stream finishing closes it from then on.
+func (sc *serverConn) goAway(code ErrCode, reason string) {
+	sc.mu.Lock()
+	lastStreamID := sc.maxStreamID
+	sc.mu.Unlock()
+	payload := binary.BigEndian.AppendUint32(nil, lastStreamID)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(code))
+	if code != ErrCodeNo {
+		payload = append(payload, reason...)
+	}
+	sc.writeFrame(FrameGoAway, 0, 0, payload)
+	sc.mu.Lock()
+	sc.goingAway = true
+	sc.mu.Unlock()
+}
+
+// resetStream sends RST_STREAM and fails what is left of the stream.
+func (sc *serverConn) resetStream(streamID uint32, code ErrCode) {
+	sc.mu.Lock()
+	if st := sc.streams[streamID]; st != nil {
+		st.fail(StreamResetError{Code: code})
+		sc.forgetStream(st)
+	}
+	sc.mu.Unlock()
+	sc.writeFrame(FrameRSTStream, 0, streamID, binary.BigEndian.AppendUint32(nil, uint32(code)))
+}
+
+// forgetStream removes a stream that is closed or reset, so it no longer
+// counts against MaxConcurrentStreams. The caller holds mu.
+func (sc *serverConn) forgetStream(st *stream) {
+	if sc.streams[st.id] != st {
+		return
+	}
+	delete(sc.streams, st.id)
+	sc.cond.Broadcast()
+	if len(sc.streams) > 0 {
+		return
+	}
+	sc.setIdle(true)
+	if sc.goingAway {
+		// the client said it is done, or we did, and the last stream has
+		// finished
+		sc.conn.Close()
+	}
+}
@@ -0,0 +1,705 @@
+package http2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"voylento/httpfromtcp/internal/headers"
+	"voylento/httpfromtcp/internal/http2/hpack"
+	"voylento/httpfromtcp/internal/request"
+	"voylento/httpfromtcp/internal/response"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testFrame struct {
+	frameHeader
+	payload	[]byte
+}
+
+// testClient speaks raw HTTP/2 to a server over a pipe.
+type testClient struct {
+	t		*testing.T
+	conn	net.Conn
+	frames	chan testFrame
+	enc		*hpack.Encoder
+	dec		*hpack.Decoder
+}
+
+// startConn serves one connection and returns a client that has sent the
+// preface and its settings, and read the server's settings.
+func startConn(t *testing.T, srv *Server, settings ...Setting) *testClient {
+	t.Helper()
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		srv.ServeConn(server, nil)
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	c := newTestClient(t, client)
+	_, err := io.WriteString(client, ClientPreface)
+	require.NoError(t, err)
+	c.writeFrame(FrameSettings, 0, 0, appendSettings(nil, settings))
+
+	f := c.readFrame()
+	require.Equal(t, FrameSettings, f.typ)
+	require.False(t, f.flags.Has(FlagAck))
+	f = c.readFrame()
+	require.Equal(t, FrameSettings, f.typ)
+	require.True(t, f.flags.Has(FlagAck))
+	return c
+}
+
+func newTestClient(t *testing.T, conn net.Conn) *testClient {
+	c := &testClient{
+		t: t,
+		conn: conn,
+		frames: make(chan testFrame, 100),
+		enc: hpack.NewEncoder(),
+		dec: hpack.NewDecoder(hpack.DefaultTableSize),
+	}
+	go func() {
+		defer close(c.frames)
+		for {
+			h, payload, err := readFrame(conn, nil, maxMaxFrameSize)
+			if err != nil {
+				return
+			}
+			c.frames <- testFrame{h, payload}
+		}
+	}()
+	return c
+}
+
+func (c *testClient) writeFrame(typ FrameType, flags Flags, streamID uint32, payload []byte) {
+	c.t.Helper()
+	frame := appendFrameHeader(nil, frameHeader{length: uint32(len(payload)), typ: typ, flags: flags, streamID: streamID})
+	_, err := c.conn.Write(append(frame, payload...))
+	require.NoError(c.t, err)
+}
+
+// readFrame returns the next frame, skipping WINDOW_UPDATEs, which the
+// server sends as it reads request bodies.
+func (c *testClient) readFrame() testFrame {
+	c.t.Helper()
+	for {
+		select {
+		case f, ok := <-c.frames:
+			require.True(c.t, ok, "connection closed")
+			if f.typ == FrameWindowUpdate {
+				continue
+			}
+			return f
+		case <-time.After(2 * time.Second):
+			require.FailNow(c.t, "timed out waiting for a frame")
+		}
+	}
+}
+
+// writeRequest sends a HEADERS frame for a request with the usual pseudo
+// headers, followed by extra fields.
+func (c *testClient) writeRequest(streamID uint32, method, path string, endStream bool, extra ...string) {
+	c.t.Helper()
+	fields := []hpack.HeaderField{
+		{Name: ":method", Value: method},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: path},
+		{Name: ":authority", Value: "example.com"},
+	}
+	for i := 0; i < len(extra); i += 2 {
+		fields = append(fields, hpack.HeaderField{Name: extra[i], Value: extra[i+1]})
+	}
+	c.writeHeaders(streamID, endStream, fields)
+}
+
+func (c *testClient) writeHeaders(streamID uint32, endStream bool, fields []hpack.HeaderField) {
+	c.t.Helper()
+	flags := FlagEndHeaders
+	if endStream {
+		flags |= FlagEndStream
+	}
+	c.writeFrame(FrameHeaders, flags, streamID, c.enc.Encode(nil, fields))
+}
+
+// readResponse reads the response on a stream: its header fields, body
+// and trailers.
+func (c *testClient) readResponse(streamID uint32) (map[string]string, string, map[string]string) {
+	c.t.Helper()
+	var fields, trailers map[string]string
+	var body strings.Builder
+	for {
+		f := c.readFrame()
+		require.Equal(c.t, streamID, f.streamID, "unexpected %s", f.frameHeader)
+		switch f.typ {
+		case FrameHeaders:
+			decoded, err := c.dec.Decode(f.payload)
+			require.NoError(c.t, err)
+			m := make(map[string]string)
+			for _, field := range decoded {
+				m[field.Name] = field.Value
+			}
+			if fields == nil {
+				fields = m
+			} else {
+				trailers = m
+			}
+		case FrameData:
+			body.Write(f.payload)
+		default:
+			require.FailNow(c.t, "unexpected frame", "%s", f.frameHeader)
+		}
+		if f.flags.Has(FlagEndStream) {
+			return fields, body.String(), trailers
+		}
+	}
+}
+
+// expectGoAway reads frames until a GOAWAY and returns its error code.
+func (c *testClient) expectGoAway() ErrCode {
+	c.t.Helper()
+	for {
+		f := c.readFrame()
+		if f.typ == FrameGoAway {
+			return ErrCode(binary.BigEndian.Uint32(f.payload[4:]))
+		}
+	}
+}
+
+// expectReset reads frames until an RST_STREAM and returns its stream and
+// error code.
+func (c *testClient) expectReset() (uint32, ErrCode) {
+	c.t.Helper()
+	for {
+		f := c.readFrame()
+		require.NotEqual(c.t, FrameGoAway, f.typ)
+		if f.typ == FrameRSTStream {
+			return f.streamID, ErrCode(binary.BigEndian.Uint32(f.payload))
+		}
+	}
+}
+
+func echoHandler(w *response.Writer, req *request.Request) error {
+	body, err := req.ReadBody()
+	if err != nil {
+		return err
+	}
+	h := response.GetDefaultHeaders(0)
+	h.Remove("content-length")
+	h.Set("X-Method", req.RequestLine.Method)
+	h.Set("X-Host", req.Headers.Values("host")[0])
+	w.WriteStatusLine(response.StatusCodeSuccess)
+	w.WriteHeaders(h)
+	w.Write([]byte(req.RequestLine.RequestTarget + " " + string(body)))
+	return w.Finish()
+}
+
+func newTestServer(handler func(w *response.Writer, req *request.Request) error) *Server {
+	return &Server{
+		Handler: handler,
+		BadRequest: func(w *response.Writer, err error) {
+			statusCode := response.StatusCodeBadRequest
+			if errors.Is(err, request.ErrBodyTooLarge) {
+				statusCode = response.StatusCodeContentTooLarge
+			}
+			w.WriteStatusLine(statusCode)
+			w.WriteHeaders(response.GetDefaultHeaders(0))
+		},
+		Limits: request.DefaultLimits,
+	}
+}
+
+func TestServeRequests(t *testing.T) {
+	c := startConn(t, newTestServer(echoHandler))
+
+	// Test: A GET is answered with headers and a body framed by the writer
+	c.writeRequest(1, "GET", "/hello", true)
+	fields, body, _ := c.readResponse(1)
+	assert.Equal(t, "200", fields[":status"])
+	assert.Equal(t, "/hello ", body)
+	assert.Equal(t, "7", fields["content-length"])
+	assert.Equal(t, "GET", fields["x-method"])
+	assert.Equal(t, "example.com", fields["x-host"])
+	_, hasConnection := fields["connection"]
+	assert.False(t, hasConnection)
+
+	// Test: A POST body arrives in DATA frames
+	c.writeRequest(3, "POST", "/upload", false, "content-length", "11")
+	c.writeFrame(FrameData, 0, 3, []byte("hello "))
+	c.writeFrame(FrameData, FlagEndStream, 3, []byte("world"))
+	_, body, _ = c.readResponse(3)
+	assert.Equal(t, "/upload hello world", body)
+
+	// Test: Padding is stripped from DATA frames
+	c.writeRequest(5, "POST", "/padded", false)
+	c.writeFrame(FrameData, FlagPadded|FlagEndStream, 5, append([]byte{3}, "abc\x00\x00\x00"...))
+	_, body, _ = c.readResponse(5)
+	assert.Equal(t, "/padded abc", body)
+
+	// Test: HEAD gets the headers of a GET and no DATA
+	c.writeRequest(7, "HEAD", "/hello", true)
+	fields, body, _ = c.readResponse(7)
+	assert.Equal(t, "7", fields["content-length"])
+	assert.Empty(t, body)
+
+	// Test: A header block split across CONTINUATION frames
+	block := c.enc.Encode(nil, []hpack.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/continued"},
+		{Name: ":authority", Value: "example.com"},
+	})
+	c.writeFrame(FrameHeaders, FlagEndStream, 9, block[:3])
+	c.writeFrame(FrameContinuation, 0, 9, block[3:6])
+	c.writeFrame(FrameContinuation, FlagEndHeaders, 9, block[6:])
+	_, body, _ = c.readResponse(9)
+	assert.Equal(t, "/continued ", body)
+}
+
+func TestPing(t *testing.T) {
+	c := startConn(t, newTestServer(echoHandler))
+
+	// Test: A PING is answered with the same payload
+	c.writeFrame(FramePing, 0, 0, []byte("12345678"))
+	f := c.readFrame()
+	assert.Equal(t, FramePing, f.typ)
+	assert.True(t, f.flags.Has(FlagAck))
+	assert.Equal(t, []byte("12345678"), f.payload)
+}
+
+func TestMultiplexing(t *testing.T) {
+	release := make(chan struct{})
+	handler := func(w *response.Writer, req *request.Request) error {
+		if req.RequestLine.RequestTarget == "/slow" {
+			<-release
+		}
+		return echoHandler(w, req)
+	}
+	c := startConn(t, newTestServer(handler))
+
+	// Test: A slow stream does not hold up the one opened after it
+	c.writeRequest(1, "GET", "/slow", true)
+	c.writeRequest(3, "GET", "/fast", true)
+	_, body, _ := c.readResponse(3)
+	assert.Equal(t, "/fast ", body)
+	close(release)
+	_, body, _ = c.readResponse(1)
+	assert.Equal(t, "/slow ", body)
+}
+
+func TestFlowControl(t *testing.T) {
+	payload := strings.Repeat("x", 25)
+	handler := func(w *response.Writer, req *request.Request) error {
+		w.WriteStatusLine(response.StatusCodeSuccess)
+		w.WriteHeaders(response.GetDefaultHeaders(len(payload)))
+		w.Write([]byte(payload))
+		return w.Finish()
+	}
+	c := startConn(t, newTestServer(handler), Setting{SettingInitialWindowSize, 10})
+
+	// Test: The response stops when the stream window runs out
+	c.writeRequest(1, "GET", "/", true)
+	f := c.readFrame()
+	require.Equal(t, FrameHeaders, f.typ)
+	f = c.readFrame()
+	require.Equal(t, FrameData, f.typ)
+	assert.Len(t, f.payload, 10)
+	select {
+	case f := <-c.frames:
+		assert.Fail(t, "frame sent past the window", "%s", f.frameHeader)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Test: WINDOW_UPDATE lets the rest through
+	c.writeFrame(FrameWindowUpdate, 0, 1, binary.BigEndian.AppendUint32(nil, 100))
+	_, body, _ := c.readResponse(1)
+	assert.Equal(t, payload[10:], body)
+
+	// Test: A larger SETTINGS_INITIAL_WINDOW_SIZE applies to open streams
+	c.writeRequest(3, "GET", "/", true)
+	f = c.readFrame()
+	require.Equal(t, FrameHeaders, f.typ)
+	f = c.readFrame()
+	assert.Len(t, f.payload, 10)
+	c.writeFrame(FrameSettings, 0, 0, appendSettings(nil, []Setting{{SettingInitialWindowSize, 100}}))
+	var rest strings.Builder
+	for f.typ != FrameData || !f.flags.Has(FlagEndStream) {
+		f = c.readFrame()
+		if f.typ == FrameData {
+			rest.Write(f.payload)
+		}
+	}
+	assert.Equal(t, payload[10:], rest.String())
+}
+
+func TestRequestBodyFlowControl(t *testing.T) {
+	read := make(chan string)
+	hold := make(chan struct{})
+	handler := func(w *response.Writer, req *request.Request) error {
+		if req.RequestLine.RequestTarget == "/hold" {
+			<-hold
+			return nil
+		}
+		body, err := req.ReadBody()
+		if err != nil {
+			return err
+		}
+		read <- string(body)
+		w.WriteStatusLine(response.StatusCodeNoContent)
+		w.WriteHeaders(headers.NewHeaders())
+		return w.Finish()
+	}
+	c := startConn(t, newTestServer(handler))
+	t.Cleanup(func() { close(hold) })
+
+	// Test: Reading the body hands the window back to the connection; the
+	// stream has ended, so it gets nothing back
+	c.writeRequest(1, "POST", "/", false)
+	c.writeFrame(FrameData, FlagEndStream, 1, []byte("hello"))
+	assert.Equal(t, "hello", <-read)
+	f := <-c.frames
+	require.Equal(t, FrameWindowUpdate, f.typ)
+	assert.Equal(t, uint32(0), f.streamID)
+	assert.Equal(t, uint32(5), binary.BigEndian.Uint32(f.payload))
+
+	// Test: DATA beyond the window of a body nobody reads is a connection
+	// error
+	c.writeRequest(3, "POST", "/hold", false)
+	chunk := make([]byte, minMaxFrameSize)
+	for i := 0; i < 4; i++ {
+		c.writeFrame(FrameData, 0, 3, chunk)
+	}
+	assert.Equal(t, ErrCodeFlowControl, c.expectGoAway())
+}
+
+func TestTrailers(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) error {
+		body, err := req.ReadBody()
+		if err != nil {
+			return err
+		}
+		h := headers.NewHeaders()
+		h.Set("Trailer", "X-Checksum")
+		w.WriteStatusLine(response.StatusCodeSuccess)
+		w.WriteHeaders(h)
+		w.Write(body)
+		trailers := headers.NewHeaders()
+		checksum, _ := req.Trailers.Get("x-checksum")
+		trailers.Set("X-Checksum", checksum)
+		w.WriteTrailers(trailers)
+		return w.Finish()
+	}
+	c := startConn(t, newTestServer(handler))
+
+	// Test: Request trailers reach the handler, and response trailers end
+	// the stream
+	c.writeRequest(1, "POST", "/", false, "te", "trailers")
+	c.writeFrame(FrameData, 0, 1, []byte("data"))
+	c.writeHeaders(1, true, []hpack.HeaderField{{Name: "x-checksum", Value: "abc"}})
+	fields, body, trailers := c.readResponse(1)
+	assert.Equal(t, "200", fields[":status"])
+	assert.Equal(t, "data", body)
+	assert.Equal(t, map[string]string{"x-checksum": "abc"}, trailers)
+}
+
+func TestHandlerFailures(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) error {
+		switch req.RequestLine.RequestTarget {
+		case "/short":
+			w.WriteStatusLine(response.StatusCodeSuccess)
+			w.WriteHeaders(response.GetDefaultHeaders(10))
+			w.Write([]byte("abc"))
+			return w.Finish()
+		case "/early":
+			w.WriteStatusLine(response.StatusCodeNoContent)
+			w.WriteHeaders(headers.NewHeaders())
+			return w.Finish()
+		}
+		return nil
+	}
+	c := startConn(t, newTestServer(handler))
+
+	// Test: A body shorter than its Content-Length resets the stream
+	c.writeRequest(1, "GET", "/short", true)
+	streamID, code := c.expectReset()
+	assert.Equal(t, uint32(1), streamID)
+	assert.Equal(t, ErrCodeInternal, code)
+
+	// Test: Answering before the request body ended resets the stream
+	// with NO_ERROR after the response
+	c.writeRequest(3, "POST", "/early", false)
+	fields, _, _ := c.readResponse(3)
+	assert.Equal(t, "204", fields[":status"])
+	streamID, code = c.expectReset()
+	assert.Equal(t, uint32(3), streamID)
+	assert.Equal(t, ErrCodeNo, code)
+
+	// Test: DATA arriving for the finished stream is ignored
+	c.writeFrame(FrameData, FlagEndStream, 3, []byte("late"))
+	c.writeFrame(FramePing, 0, 0, []byte("still ok"))
+	f := c.readFrame()
+	assert.Equal(t, FramePing, f.typ)
+}
+
+func TestLimits(t *testing.T) {
+	srv := newTestServer(echoHandler)
+	srv.Limits.MaxBodyBytes = 4
+	srv.MaxConcurrentStreams = 1
+	release := make(chan struct{})
+	srv.Handler = func(w *response.Writer, req *request.Request) error {
+		if req.RequestLine.RequestTarget == "/block" {
+			<-release
+		}
+		return echoHandler(w, req)
+	}
+
+	// Test: A declared body over the limit is answered with 413
+	c := startConn(t, srv)
+	c.writeRequest(1, "POST", "/", true, "content-length", "5")
+	fields, _, _ := c.readResponse(1)
+	assert.Equal(t, "413", fields[":status"])
+
+	// Test: Streams past MaxConcurrentStreams are refused
+	c = startConn(t, srv)
+	c.writeRequest(1, "GET", "/block", true)
+	c.writeRequest(3, "GET", "/", true)
+	streamID, code := c.expectReset()
+	assert.Equal(t, uint32(3), streamID)
+	assert.Equal(t, ErrCodeRefusedStream, code)
+	close(release)
+	_, body, _ := c.readResponse(1)
+	assert.Equal(t, "/block ", body)
+}
+
+func TestHeaderListLimit(t *testing.T) {
+	srv := newTestServer(echoHandler)
+	srv.Limits.MaxRequestLineBytes = 1024
+	srv.Limits.MaxHeaderBytes = 1024
+
+	// Test: A small block of indexed fields that decodes past the header
+	// list limit is refused, without decoding it all
+	c := startConn(t, srv)
+	block := c.enc.Encode(nil, []hpack.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "http"},
+		{Name: ":path", Value: "/big"},
+		{Name: ":authority", Value: "example.com"},
+	})
+	// each 0x82 byte is another ":method: GET", 42 bytes of header list
+	block = append(block, bytes.Repeat([]byte{0x82}, 3000)...)
+	c.writeFrame(FrameHeaders, FlagEndHeaders|FlagEndStream, 1, block)
+	streamID, code := c.expectReset()
+	assert.Equal(t, uint32(1), streamID)
+	assert.Equal(t, ErrCodeRefusedStream, code)
+
+	// Test: ...and the connection goes on serving requests
+	c.writeRequest(3, "GET", "/next", true)
+	fields, body, _ := c.readResponse(3)
+	assert.Equal(t, "200", fields[":status"])
+	assert.Equal(t, "/next ", body)
+}
+
+func TestMalformedRequests(t *testing.T) {
+	cases := []struct {
+		name	string
+		fields	[]hpack.HeaderField
+	}{
+		{"uppercase name", []hpack.HeaderField{{Name: "X-Upper", Value: "a"}}},
+		{"connection-specific field", []hpack.HeaderField{{Name: "connection", Value: "keep-alive"}}},
+		{"TE other than trailers", []hpack.HeaderField{{Name: "te", Value: "gzip"}}},
+		{"pseudo-header after regular field", []hpack.HeaderField{{Name: "accept", Value: "*/*"}, {Name: ":status", Value: "200"}}},
+		{"value with surrounding space", []hpack.HeaderField{{Name: "accept", Value: " */*"}}},
+	}
+	c := startConn(t, newTestServer(echoHandler))
+	streamID := uint32(1)
+	for _, tc := range cases {
+		// Test: Malformed requests reset their stream with PROTOCOL_ERROR
+		fields := append([]hpack.HeaderField{
+			{Name: ":method", Value: "GET"},
+			{Name: ":scheme", Value: "http"},
+			{Name: ":path", Value: "/"},
+		}, tc.fields...)
+		c.writeHeaders(streamID, true, fields)
+		id, code := c.expectReset()
+		assert.Equal(t, streamID, id, tc.name)
+		assert.Equal(t, ErrCodeProtocol, code, tc.name)
+		streamID += 2
+	}
+
+	// Test: Missing pseudo-headers
+	c.writeHeaders(streamID, true, []hpack.HeaderField{{Name: ":method", Value: "GET"}})
+	_, code := c.expectReset()
+	assert.Equal(t, ErrCodeProtocol, code)
+	streamID += 2
+
+	// Test: A body that does not match its Content-Length
+	c.writeRequest(streamID, "POST", "/", false, "content-length", "10")
+	c.writeFrame(FrameData, FlagEndStream, streamID, []byte("short"))
+	_, code = c.expectReset()
+	assert.Equal(t, ErrCodeProtocol, code)
+}
+
+func TestConnectionErrors(t *testing.T) {
+	cases := []struct {
+		name	string
+		send	func(c *testClient)
+		code	ErrCode
+	}{
+		{"DATA on stream 0", func(c *testClient) { c.writeFrame(FrameData, 0, 0, []byte("x")) }, ErrCodeProtocol},
+		{"HEADERS on an even stream", func(c *testClient) { c.writeRequest(2, "GET", "/", true) }, ErrCodeProtocol},
+		{"decreasing stream ID", func(c *testClient) {
+			c.writeRequest(5, "GET", "/", true)
+			c.writeRequest(3, "GET", "/", true)
+		}, ErrCodeProtocol},
+		{"CONTINUATION without HEADERS", func(c *testClient) { c.writeFrame(FrameContinuation, FlagEndHeaders, 1, nil) }, ErrCodeProtocol},
+		{"frame inside a header block", func(c *testClient) {
+			c.writeFrame(FrameHeaders, 0, 1, c.enc.Encode(nil, []hpack.HeaderField{{Name: ":method", Value: "GET"}}))
+			c.writeFrame(FramePing, 0, 0, []byte("12345678"))
+		}, ErrCodeProtocol},
+		{"SETTINGS of the wrong length", func(c *testClient) { c.writeFrame(FrameSettings, 0, 0, []byte{1, 2, 3}) }, ErrCodeFrameSize},
+		{"SETTINGS ACK with a payload", func(c *testClient) { c.writeFrame(FrameSettings, FlagAck, 0, make([]byte, 6)) }, ErrCodeFrameSize},
+		{"invalid SETTINGS_ENABLE_PUSH", func(c *testClient) {
+			c.writeFrame(FrameSettings, 0, 0, appendSettings(nil, []Setting{{SettingEnablePush, 2}}))
+		}, ErrCodeProtocol},
+		{"invalid SETTINGS_MAX_FRAME_SIZE", func(c *testClient) {
+			c.writeFrame(FrameSettings, 0, 0, appendSettings(nil, []Setting{{SettingMaxFrameSize, 100}}))
+		}, ErrCodeProtocol},
+		{"SETTINGS_INITIAL_WINDOW_SIZE too large", func(c *testClient) {
+			c.writeFrame(FrameSettings, 0, 0, appendSettings(nil, []Setting{{SettingInitialWindowSize, 1 << 31}}))
+		}, ErrCodeFlowControl},
+		{"PING of the wrong length", func(c *testClient) { c.writeFrame(FramePing, 0, 0, []byte("1234")) }, ErrCodeFrameSize},
+		{"WINDOW_UPDATE of zero on the connection", func(c *testClient) {
+			c.writeFrame(FrameWindowUpdate, 0, 0, make([]byte, 4))
+		}, ErrCodeProtocol},
+		{"connection window overflow", func(c *testClient) {
+			c.writeFrame(FrameWindowUpdate, 0, 0, binary.BigEndian.AppendUint32(nil, maxWindowSize))
+		}, ErrCodeFlowControl},
+		{"RST_STREAM on an idle stream", func(c *testClient) { c.writeFrame(FrameRSTStream, 0, 7, make([]byte, 4)) }, ErrCodeProtocol},
+		{"PUSH_PROMISE from the client", func(c *testClient) { c.writeFrame(FramePushPromise, FlagEndHeaders, 1, make([]byte, 4)) }, ErrCodeProtocol},
+		{"frame over the maximum size", func(c *testClient) {
+			// the server stops reading at the frame header, so the write
+			// of the payload fails
+			frame := appendFrameHeader(nil, frameHeader{length: minMaxFrameSize + 1, typ: FrameData, streamID: 1})
+			c.conn.Write(append(frame, make([]byte, minMaxFrameSize+1)...))
+		}, ErrCodeFrameSize},
+		{"invalid HPACK", func(c *testClient) { c.writeFrame(FrameHeaders, FlagEndHeaders, 1, []byte{0x80}) }, ErrCodeCompression},
+	}
+	for _, tc := range cases {
+		// Test: Protocol violations end the connection with GOAWAY
+		c := startConn(t, newTestServer(echoHandler))
+		tc.send(c)
+		assert.Equal(t, tc.code, c.expectGoAway(), tc.name)
+	}
+
+	// Test: The first frame after the preface has to be SETTINGS
+	client, server := net.Pipe()
+	defer client.Close()
+	go (&Server{Handler: echoHandler}).ServeConn(server, nil)
+	c := newTestClient(t, client)
+	io.WriteString(client, ClientPreface)
+	c.writeFrame(FramePing, 0, 0, []byte("12345678"))
+	assert.Equal(t, ErrCodeProtocol, c.expectGoAway())
+}
+
+func TestStreamResets(t *testing.T) {
+	started := make(chan struct{})
+	var mu sync.Mutex
+	var readErr error
+	handler := func(w *response.Writer, req *request.Request) error {
+		close(started)
+		_, err := io.ReadAll(req.BodyReader)
+		mu.Lock()
+		readErr = err
+		mu.Unlock()
+		return err
+	}
+	c := startConn(t, newTestServer(handler))
+
+	// Test: A client reset fails the handler's body reads
+	c.writeRequest(1, "POST", "/", false)
+	<-started
+	c.writeFrame(FrameRSTStream, 0, 1, binary.BigEndian.AppendUint32(nil, uint32(ErrCodeCancel)))
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return readErr != nil
+	}, time.Second, 10*time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, StreamResetError{Code: ErrCodeCancel}, readErr)
+	mu.Unlock()
+
+	// Test: Stream errors leave the connection usable
+	c.writeFrame(FrameWindowUpdate, 0, 1, binary.BigEndian.AppendUint32(nil, 10))
+	c.writeFrame(FramePing, 0, 0, []byte("12345678"))
+	f := c.readFrame()
+	assert.Equal(t, FramePing, f.typ)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	srv := newTestServer(echoHandler)
+	srv.IdleTimeout = 50 * time.Millisecond
+	var mu sync.Mutex
+	var states []bool
+	srv.ConnState = func(idle bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		states = append(states, idle)
+	}
+	c := startConn(t, srv)
+
+	// Test: A connection with no open streams is sent GOAWAY and closed
+	c.writeRequest(1, "GET", "/", true)
+	c.readResponse(1)
+	assert.Equal(t, ErrCodeNo, c.expectGoAway())
+	mu.Lock()
+	assert.Equal(t, []bool{true, false, true}, states)
+	mu.Unlock()
+}
+
+func TestServeUpgrade(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	h := headers.NewHeaders()
+	h.Set("host", "example.com")
+	req, err := request.NewRequest("GET", "/upgraded", "2.0", h, io.NopCloser(strings.NewReader("")), request.DefaultLimits)
+	require.NoError(t, err)
+	go newTestServer(echoHandler).ServeUpgrade(server, nil, appendSettings(nil, []Setting{{SettingInitialWindowSize, 3}}), req)
+
+	// Test: The upgrade request is answered on stream 1, under the
+	// settings from HTTP2-Settings, once the client sends its preface
+	c := newTestClient(t, client)
+	f := c.readFrame()
+	require.Equal(t, FrameSettings, f.typ)
+	io.WriteString(client, ClientPreface)
+	c.writeFrame(FrameSettings, 0, 0, nil)
+	// the response does not wait for the SETTINGS ACK
+	var sawHeaders bool
+	var body strings.Builder
+	for body.Len() < len("/upgraded ") {
+		f = c.readFrame()
+		switch f.typ {
+		case FrameSettings:
+			assert.True(t, f.flags.Has(FlagAck))
+		case FrameHeaders:
+			sawHeaders = true
+		case FrameData:
+			// Test: Stream 1 starts with the window HTTP2-Settings gave it
+			assert.LessOrEqual(t, len(f.payload), 3)
+			body.Write(f.payload)
+			c.writeFrame(FrameWindowUpdate, 0, 1, binary.BigEndian.AppendUint32(nil, 3))
+		}
+	}
+	assert.True(t, sawHeaders)
+	assert.Equal(t, "/upgraded ", body.String())
+}
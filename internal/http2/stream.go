@@ -0,0 +1,706 @@
+package http2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	"voylento/httpfromtcp/internal/headers"
+	"voylento/httpfromtcp/internal/http2/hpack"
+	"voylento/httpfromtcp/internal/request"
+	"voylento/httpfromtcp/internal/response"
+)
+
+// stream is a request and its response. Everything but id is guarded by
+// the connection's mu.
+type stream struct {
+	sc	*serverConn
+	id	uint32
+
+	sendWindow		int64
+	recvWindow		int64
+	// remoteClosed is set once the client ended the request, and
+	// localClosed once the response was ended
+	remoteClosed	bool
+	localClosed		bool
+	// err is set when the stream was reset or the connection died
+	err				error
+
+	req				*request.Request
+	body			bytes.Buffer
+	// bodyErr is returned once body is drained: io.EOF at the end of the
+	// request, or why the rest of it will never arrive
+	bodyErr			error
+	// discard is set when nobody will read the rest of the body, which is
+	// then dropped as it arrives
+	discard			bool
+	declaredLength	int64
+	received		int64
+}
+
+// fail ends the stream for good, waking anyone waiting on it. The caller
+// holds the connection's mu.
+func (st *stream) fail(err error) {
+	if st.err == nil {
+		st.err = err
+	}
+	if st.bodyErr == nil {
+		st.bodyErr = err
+	}
+	st.sc.cond.Broadcast()
+}
+
+func (sc *serverConn) processHeaders(h frameHeader, payload []byte) error {
+	if h.streamID == 0 {
+		return connError{ErrCodeProtocol, "HEADERS on stream 0"}
+	}
+	if h.streamID%2 == 0 {
+		return connError{ErrCodeProtocol, fmt.Sprintf("HEADERS on even stream %d", h.streamID)}
+	}
+	block, err := removePadding(h, payload)
+	if err != nil {
+		return err
+	}
+	sc.headerErr = nil
+	if h.flags.Has(FlagPriority) {
+		if len(block) < 5 {
+			return connError{ErrCodeFrameSize, "HEADERS frame too short for its priority"}
+		}
+		if binary.BigEndian.Uint32(block)&(1<<31-1) == h.streamID {
+			// the block still has to be decoded to keep HPACK in step
+			sc.headerErr = streamError{h.streamID, ErrCodeProtocol, "stream depends on itself"}
+		}
+		block = block[5:]
+	}
+	sc.headerStream = h.streamID
+	sc.headerBlock = append(sc.headerBlock[:0], block...)
+	sc.headerEndStream = h.flags.Has(FlagEndStream)
+	if h.flags.Has(FlagEndHeaders) {
+		return sc.processHeaderBlock()
+	}
+	return nil
+}
+
+func (sc *serverConn) processContinuation(h frameHeader, payload []byte) error {
+	if sc.headerStream == 0 || h.streamID != sc.headerStream {
+		return connError{ErrCodeProtocol, "CONTINUATION without a header block to continue"}
+	}
+	if len(sc.headerBlock)+len(payload) > sc.srv.maxHeaderBlock() {
+		return connError{ErrCodeEnhanceYourCalm, "header block too large"}
+	}
+	sc.headerBlock = append(sc.headerBlock, payload...)
+	if h.flags.Has(FlagEndHeaders) {
+		return sc.processHeaderBlock()
+	}
+	return nil
+}
+
+// processHeaderBlock handles a complete header block: the start of a new
+// stream, or the trailers of an open one.
+func (sc *serverConn) processHeaderBlock() error {
+	streamID := sc.headerStream
+	sc.headerStream = 0
+	fields, err := sc.dec.Decode(sc.headerBlock)
+	if errors.Is(err, hpack.ErrHeaderListTooLarge) {
+		// the decoder is still in step with the client, so only this
+		// stream has to go
+		sc.bumpStreamID(streamID)
+		return streamError{streamID, ErrCodeRefusedStream, err.Error()}
+	}
+	if err != nil {
+		return connError{ErrCodeCompression, err.Error()}
+	}
+	if sc.headerErr != nil {
+		sc.bumpStreamID(streamID)
+		return sc.headerErr
+	}
+
+	sc.mu.Lock()
+	st := sc.streams[streamID]
+	maxStreamID := sc.maxStreamID
+	sc.mu.Unlock()
+	if st != nil {
+		return sc.processTrailers(st, fields)
+	}
+	if streamID <= maxStreamID {
+		return connError{ErrCodeProtocol, fmt.Sprintf("HEADERS on closed stream %d", streamID)}
+	}
+	sc.bumpStreamID(streamID)
+
+	sc.mu.Lock()
+	refuse := sc.goingAway || len(sc.streams) >= int(sc.srv.maxConcurrentStreams())
+	sc.mu.Unlock()
+	if !refuse && sc.srv.Draining != nil && sc.srv.Draining() {
+		sc.goAway(ErrCodeNo, "")
+		refuse = true
+	}
+	if refuse {
+		return streamError{streamID, ErrCodeRefusedStream, "not taking new streams"}
+	}
+
+	st = &stream{
+		sc: sc,
+		id: streamID,
+		recvWindow: defaultWindowSize,
+		declaredLength: -1,
+	}
+	req, err := sc.newRequest(st, fields)
+	if _, ok := err.(streamError); ok {
+		return err
+	}
+	// a request refused by the limits, or one we cannot serve, still gets
+	// a response, but nobody reads its body
+	st.discard = err != nil
+	sc.mu.Lock()
+	st.sendWindow = sc.initialSendWindow
+	sc.streams[streamID] = st
+	sc.setIdle(false)
+	sc.mu.Unlock()
+	if sc.headerEndStream {
+		if endErr := sc.endRequest(st); endErr != nil {
+			return endErr
+		}
+	}
+
+	if err != nil {
+		sc.startStream(st, "", func(w *response.Writer) error {
+			sc.srv.BadRequest(w, err)
+			return w.Finish()
+		})
+		return nil
+	}
+	st.req = req
+	sc.startStream(st, req.RequestLine.Method, func(w *response.Writer) error {
+		return sc.srv.Handler(w, req)
+	})
+	return nil
+}
+
+func (sc *serverConn) bumpStreamID(streamID uint32) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if streamID > sc.maxStreamID {
+		sc.maxStreamID = streamID
+	}
+}
+
+// startUpgradedStream serves the request that asked for the upgrade as
+// stream 1, half closed since its body was read over HTTP/1.1.
+func (sc *serverConn) startUpgradedStream(req *request.Request) {
+	st := &stream{
+		sc: sc,
+		id: 1,
+		recvWindow: defaultWindowSize,
+		declaredLength: -1,
+		remoteClosed: true,
+		bodyErr: io.EOF,
+		req: req,
+	}
+	sc.mu.Lock()
+	sc.maxStreamID = 1
+	st.sendWindow = sc.initialSendWindow
+	sc.streams[1] = st
+	sc.setIdle(false)
+	sc.mu.Unlock()
+	sc.startStream(st, req.RequestLine.Method, func(w *response.Writer) error {
+		return sc.srv.Handler(w, req)
+	})
+}
+
+func (sc *serverConn) startStream(st *stream, method string, serve func(w *response.Writer) error) {
+	sc.handlers.Add(1)
+	go func() {
+		defer sc.handlers.Done()
+		w := response.NewStreamWriter(&responseWriter{st: st})
+		w.SetRequestMethod(method)
+		err := serve(w)
+		sc.finishStream(st, err)
+	}()
+}
+
+// finishStream cleans up after a handler. A response that was not ended
+// resets the stream, and so does one sent before the request ended: the
+// client is told to stop sending a body nobody will read.
+func (sc *serverConn) finishStream(st *stream, err error) {
+	sc.mu.Lock()
+	failed := st.err != nil
+	localClosed := st.localClosed
+	remoteClosed := st.remoteClosed
+	sc.mu.Unlock()
+	switch {
+	case failed:
+	case !localClosed:
+		if err != nil {
+			log.Printf("Resetting HTTP/2 stream %d: %v", st.id, err)
+		}
+		sc.resetStream(st.id, ErrCodeInternal)
+	case !remoteClosed:
+		sc.resetStream(st.id, ErrCodeNo)
+	}
+	sc.mu.Lock()
+	sc.forgetStream(st)
+	sc.mu.Unlock()
+}
+
+// processTrailers handles the second header block of a request, which has
+// to end it.
+func (sc *serverConn) processTrailers(st *stream, fields []hpack.HeaderField) error {
+	sc.mu.Lock()
+	remoteClosed := st.remoteClosed
+	sc.mu.Unlock()
+	if remoteClosed {
+		return streamError{st.id, ErrCodeStreamClosed, "HEADERS after the end of the request"}
+	}
+	if !sc.headerEndStream {
+		return streamError{st.id, ErrCodeProtocol, "trailers without END_STREAM"}
+	}
+	trailers := headers.NewHeaders()
+	for _, f := range fields {
+		if strings.HasPrefix(f.Name, ":") {
+			return streamError{st.id, ErrCodeProtocol, "pseudo-header in trailers"}
+		}
+		if err := validateField(f); err != nil {
+			return streamError{st.id, ErrCodeProtocol, err.Error()}
+		}
+		trailers.Add(f.Name, f.Value)
+	}
+	sc.mu.Lock()
+	if st.req != nil {
+		for _, f := range trailers.Raw() {
+			st.req.Trailers.Add(f.Name, f.Value)
+		}
+	}
+	sc.mu.Unlock()
+	return sc.endRequest(st)
+}
+
+// endRequest marks the end of the request body, checking it against the
+// declared Content-Length.
+func (sc *serverConn) endRequest(st *stream) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	st.remoteClosed = true
+	if st.declaredLength >= 0 && st.received != st.declaredLength && !st.discard {
+		return streamError{st.id, ErrCodeProtocol, fmt.Sprintf("body of %d bytes, Content-Length %d", st.received, st.declaredLength)}
+	}
+	if st.bodyErr == nil {
+		st.bodyErr = io.EOF
+	}
+	sc.cond.Broadcast()
+	return nil
+}
+
+func (sc *serverConn) processData(h frameHeader, payload []byte) error {
+	if h.streamID == 0 {
+		return connError{ErrCodeProtocol, "DATA on stream 0"}
+	}
+	size := int64(len(payload))
+	sc.mu.Lock()
+	if size > sc.recvWindow {
+		sc.mu.Unlock()
+		return connError{ErrCodeFlowControl, "DATA beyond the connection window"}
+	}
+	sc.recvWindow -= size
+	st := sc.streams[h.streamID]
+	maxStreamID := sc.maxStreamID
+	sc.mu.Unlock()
+
+	data, err := removePadding(h, payload)
+	if err != nil {
+		return err
+	}
+	if st == nil || st.isRemoteClosed() {
+		// nothing will read it, so the connection gets its window back
+		if err := sc.returnWindow(nil, size); err != nil {
+			return err
+		}
+		switch {
+		case h.streamID > maxStreamID:
+			return connError{ErrCodeProtocol, fmt.Sprintf("DATA on idle stream %d", h.streamID)}
+		case st != nil:
+			return streamError{h.streamID, ErrCodeStreamClosed, "DATA after the end of the request"}
+		}
+		// the stream was reset or finished, and the client may not know
+		// yet
+		return nil
+	}
+
+	sc.mu.Lock()
+	if size > st.recvWindow {
+		sc.mu.Unlock()
+		sc.returnWindow(nil, size)
+		return streamError{st.id, ErrCodeFlowControl, "DATA beyond the stream window"}
+	}
+	st.recvWindow -= size
+	st.received += int64(len(data))
+	if st.declaredLength >= 0 && st.received > st.declaredLength && !st.discard {
+		sc.mu.Unlock()
+		sc.returnWindow(nil, size)
+		return streamError{st.id, ErrCodeProtocol, "body longer than its Content-Length"}
+	}
+	if limit := sc.srv.Limits.MaxBodyBytes; limit > 0 && st.received > limit && !st.discard {
+		st.discard = true
+		if st.bodyErr == nil {
+			st.bodyErr = fmt.Errorf("Error: %w: more than %d bytes", request.ErrBodyTooLarge, limit)
+		}
+	}
+	discard := st.discard || st.err != nil
+	if !discard {
+		st.body.Write(data)
+	}
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+
+	// padding, and data nobody will read, are handed straight back
+	unread := size - int64(len(data))
+	if discard {
+		unread = size
+	}
+	if unread > 0 {
+		if err := sc.returnWindow(st, unread); err != nil {
+			return err
+		}
+	}
+	if h.flags.Has(FlagEndStream) {
+		return sc.endRequest(st)
+	}
+	return nil
+}
+
+func (st *stream) isRemoteClosed() bool {
+	st.sc.mu.Lock()
+	defer st.sc.mu.Unlock()
+	return st.remoteClosed
+}
+
+// returnWindow lets the client send n more bytes on the connection and,
+// if st is still receiving, on the stream.
+func (sc *serverConn) returnWindow(st *stream, n int64) error {
+	sc.mu.Lock()
+	sc.recvWindow += n
+	streamUpdate := st != nil && !st.remoteClosed && st.err == nil
+	if streamUpdate {
+		st.recvWindow += n
+	}
+	sc.mu.Unlock()
+	if err := sc.writeWindowUpdate(0, n); err != nil {
+		return err
+	}
+	if streamUpdate {
+		return sc.writeWindowUpdate(st.id, n)
+	}
+	return nil
+}
+
+// requestBody streams the DATA of a request to the handler, handing flow
+// control window back to the client as it is read.
+type requestBody struct {
+	st	*stream
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	st := b.st
+	sc := st.sc
+	sc.mu.Lock()
+	for st.body.Len() == 0 && st.bodyErr == nil {
+		sc.cond.Wait()
+	}
+	if st.body.Len() == 0 {
+		err := st.bodyErr
+		sc.mu.Unlock()
+		return 0, err
+	}
+	n, _ := st.body.Read(p)
+	sc.mu.Unlock()
+	if err := sc.returnWindow(st, int64(n)); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// Close drops the rest of the body. Whatever was buffered goes back to the
+// connection window.
+func (b *requestBody) Close() error {
+	st := b.st
+	sc := st.sc
+	sc.mu.Lock()
+	st.discard = true
+	unread := int64(st.body.Len())
+	st.body.Reset()
+	sc.mu.Unlock()
+	if unread > 0 {
+		return sc.returnWindow(nil, unread)
+	}
+	return nil
+}
+
+// newRequest builds the request for a new stream. Malformed header lists
+// are stream errors; requests the limits refuse come back as a plain
+// error, to be answered with a status code.
+func (sc *serverConn) newRequest(st *stream, fields []hpack.HeaderField) (*request.Request, error) {
+	malformed := func(format string, args ...any) error {
+		return streamError{st.id, ErrCodeProtocol, fmt.Sprintf(format, args...)}
+	}
+	pseudo := make(map[string]string)
+	h := headers.NewHeaders()
+	sawRegular := false
+	for _, f := range fields {
+		if strings.HasPrefix(f.Name, ":") {
+			if sawRegular {
+				return nil, malformed("pseudo-header %s after regular fields", f.Name)
+			}
+			switch f.Name {
+			case ":method", ":scheme", ":path", ":authority":
+			default:
+				return nil, malformed("unknown pseudo-header %s", f.Name)
+			}
+			if _, dup := pseudo[f.Name]; dup {
+				return nil, malformed("duplicate pseudo-header %s", f.Name)
+			}
+			pseudo[f.Name] = f.Value
+			continue
+		}
+		sawRegular = true
+		if err := validateField(f); err != nil {
+			return nil, malformed("%v", err)
+		}
+		h.Add(f.Name, f.Value)
+	}
+
+	method := pseudo[":method"]
+	target := pseudo[":path"]
+	_, hasScheme := pseudo[":scheme"]
+	_, hasPath := pseudo[":path"]
+	switch {
+	case method == "":
+		return nil, malformed("missing :method")
+	case method == "CONNECT":
+		if hasScheme || hasPath || pseudo[":authority"] == "" {
+			return nil, malformed("CONNECT takes only :authority")
+		}
+		target = pseudo[":authority"]
+	case !hasScheme || target == "":
+		return nil, malformed("missing :scheme or :path")
+	}
+
+	if values := h.Values("content-length"); len(values) > 0 {
+		n, err := strconv.ParseInt(values[0], 10, 64)
+		if err != nil || n < 0 || strings.Trim(values[0], "0123456789") != "" {
+			return nil, malformed("invalid Content-Length %q", values[0])
+		}
+		for _, v := range values[1:] {
+			if v != values[0] {
+				return nil, malformed("conflicting Content-Length values")
+			}
+		}
+		st.declaredLength = n
+		if limit := sc.srv.Limits.MaxBodyBytes; limit > 0 && n > limit {
+			return nil, fmt.Errorf("Error: %w: more than %d bytes", request.ErrBodyTooLarge, limit)
+		}
+	}
+	if authority := pseudo[":authority"]; authority != "" {
+		if _, exists := h.Get("host"); !exists {
+			h.Add("host", authority)
+		}
+	}
+	return request.NewRequest(method, target, "2.0", h, &requestBody{st: st}, sc.srv.Limits)
+}
+
+// validateField checks a regular field of a request header list: names
+// are lower case, values have no line breaks or surrounding whitespace,
+// and fields specific to an HTTP/1.1 connection are not allowed.
+func validateField(f hpack.HeaderField) error {
+	if !headers.ValidateHeaderName(f.Name) || strings.ToLower(f.Name) != f.Name {
+		return fmt.Errorf("invalid field name %q", f.Name)
+	}
+	if strings.ContainsAny(f.Value, "\x00\r\n") || strings.TrimSpace(f.Value) != f.Value {
+		return fmt.Errorf("invalid value for %s", f.Name)
+	}
+	switch f.Name {
+	case "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade":
+		return fmt.Errorf("connection-specific field %s", f.Name)
+	case "te":
+		if f.Value != "trailers" {
+			return fmt.Errorf("TE other than trailers")
+		}
+	}
+	return nil
+}
+
+// responseWriter sends a response.Writer's output on a stream. The final
+// header block is held back until there is body or the response ends, so
+// a response without a body is a single HEADERS frame.
+type responseWriter struct {
+	st				*stream
+	pending			bool
+	statusCode		response.StatusCode
+	fields			[]headers.Field
+}
+
+func (rw *responseWriter) WriteHeaders(statusCode response.StatusCode, fields []headers.Field) error {
+	if statusCode < 200 {
+		return rw.st.sc.writeHeaders(rw.st, statusCode, fields, false)
+	}
+	rw.pending = true
+	rw.statusCode = statusCode
+	rw.fields = fields
+	return nil
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	if err := rw.Flush(); err != nil {
+		return 0, err
+	}
+	return rw.st.sc.writeData(rw.st, p, false)
+}
+
+// Flush sends the held back header block.
+func (rw *responseWriter) Flush() error {
+	if !rw.pending {
+		return nil
+	}
+	rw.pending = false
+	return rw.st.sc.writeHeaders(rw.st, rw.statusCode, rw.fields, false)
+}
+
+func (rw *responseWriter) Close(trailers []headers.Field) error {
+	sc := rw.st.sc
+	if rw.pending && len(trailers) == 0 {
+		rw.pending = false
+		return sc.writeHeaders(rw.st, rw.statusCode, rw.fields, true)
+	}
+	if err := rw.Flush(); err != nil {
+		return err
+	}
+	if len(trailers) > 0 {
+		return sc.writeHeaders(rw.st, 0, trailers, true)
+	}
+	_, err := sc.writeData(rw.st, nil, true)
+	return err
+}
+
+// writeHeaders sends a header block, split into CONTINUATION frames as
+// needed. A zero statusCode sends trailers.
+func (sc *serverConn) writeHeaders(st *stream, statusCode response.StatusCode, fields []headers.Field, endStream bool) error {
+	sc.mu.Lock()
+	err := sc.streamErr(st)
+	maxFrameSize := int(sc.maxFrameSize)
+	sc.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	list := make([]hpack.HeaderField, 0, len(fields)+1)
+	if statusCode != 0 {
+		list = append(list, hpack.HeaderField{Name: ":status", Value: strconv.Itoa(int(statusCode))})
+	}
+	for _, f := range fields {
+		list = append(list, hpack.HeaderField{Name: f.Name, Value: f.Value, Sensitive: f.Name == "set-cookie"})
+	}
+
+	sc.writeMu.Lock()
+	// the block has to go out in the order it was encoded in, so encoding
+	// happens under writeMu too
+	block := sc.enc.Encode(nil, list)
+	typ := FrameHeaders
+	flags := Flags(0)
+	if endStream {
+		flags |= FlagEndStream
+	}
+	for {
+		chunk := block[:min(len(block), maxFrameSize)]
+		block = block[len(chunk):]
+		if len(block) == 0 {
+			flags |= FlagEndHeaders
+		}
+		if err = sc.writeFrameLocked(typ, flags, st.id, chunk); err != nil || len(block) == 0 {
+			break
+		}
+		typ = FrameContinuation
+		flags = 0
+	}
+	sc.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if endStream {
+		sc.markLocalClosed(st)
+	}
+	return nil
+}
+
+// writeData sends p as DATA frames, as fast as flow control allows.
+func (sc *serverConn) writeData(st *stream, p []byte, endStream bool) (int, error) {
+	written := 0
+	for {
+		n, err := sc.reserveWindow(st, len(p))
+		if err != nil {
+			return written, err
+		}
+		flags := Flags(0)
+		last := n == len(p)
+		if last && endStream {
+			flags = FlagEndStream
+		}
+		if err := sc.writeFrame(FrameData, flags, st.id, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+		if last {
+			break
+		}
+	}
+	if endStream {
+		sc.markLocalClosed(st)
+	}
+	return written, nil
+}
+
+// reserveWindow waits until some of want bytes may be sent on the stream,
+// and takes them out of the send windows.
+func (sc *serverConn) reserveWindow(st *stream, want int) (int, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for {
+		if err := sc.streamErr(st); err != nil {
+			return 0, err
+		}
+		if want == 0 {
+			return 0, nil
+		}
+		n := min(int64(want), sc.sendWindow, st.sendWindow, int64(sc.maxFrameSize))
+		if n > 0 {
+			sc.sendWindow -= n
+			st.sendWindow -= n
+			return int(n), nil
+		}
+		sc.cond.Wait()
+	}
+}
+
+// streamErr reports why nothing more can be sent on st. The caller holds
+// mu.
+func (sc *serverConn) streamErr(st *stream) error {
+	if st.err != nil {
+		return st.err
+	}
+	if sc.err != nil {
+		return errConnClosed
+	}
+	if st.localClosed {
+		return fmt.Errorf("Error: stream %d already ended", st.id)
+	}
+	return nil
+}
+
+func (sc *serverConn) markLocalClosed(st *stream) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	st.localClosed = true
+}
@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"fmt"
+	"path"
+
+	"voylento/httpfromtcp/internal/request"
+	"voylento/httpfromtcp/internal/response"
+	"voylento/httpfromtcp/internal/server"
+)
+
+// AllowSubjects lets a request through only if it has a verified client
+// certificate whose subject common name or full distinguished name matches
+// one of the patterns. Patterns use path.Match syntax, so "svc-*" matches
+// any common name starting with "svc-". Other requests get 403 Forbidden.
+func AllowSubjects(patterns ...string) server.Middleware {
+	return requireClientCert(func(req *request.Request) []string {
+		return []string{req.ClientCertificate().Subject.CommonName, req.ClientSubject()}
+	}, patterns)
+}
+
+// AllowSANs lets a request through only if it has a verified client
+// certificate with a subject alternative name matching one of the
+// patterns, such as "*.internal.example.com" or
+// "spiffe://example.org/ns/*". Patterns use path.Match syntax. Other
+// requests get 403 Forbidden.
+func AllowSANs(patterns ...string) server.Middleware {
+	return requireClientCert(func(req *request.Request) []string {
+		return req.ClientSANs()
+	}, patterns)
+}
+
+func requireClientCert(names func(*request.Request) []string, patterns []string) server.Middleware {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			panic(fmt.Sprintf("middleware: bad certificate pattern %q: %v", pattern, err))
+		}
+	}
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			if req.ClientCertificate() == nil || !matchesAny(names(req), patterns) {
+				response.WriteStatus(w, response.StatusCodeForbidden, nil)
+				return
+			}
+			next(w, req)
+		}
+	}
+}
+
+func matchesAny(names, patterns []string) bool {
+	for _, name := range names {
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, name); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
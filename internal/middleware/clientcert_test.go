@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"strings"
+	"testing"
+
+	"voylento/httpfromtcp/internal/request"
+	"voylento/httpfromtcp/internal/response"
+	"voylento/httpfromtcp/internal/server"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// serveWithCert runs mw in front of a handler that answers 200, for a
+// request whose client certificate is cert, and returns the status line.
+func serveWithCert(mw server.Middleware, cert *x509.Certificate, verified bool) string {
+	req := &request.Request{TLS: &tls.ConnectionState{}}
+	if cert != nil {
+		req.TLS.PeerCertificates = []*x509.Certificate{cert}
+		if verified {
+			req.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+		}
+	}
+	var buf bytes.Buffer
+	w := response.NewWriter(&buf)
+	mw(func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusCodeSuccess)
+		w.WriteHeaders(response.GetDefaultHeaders(0))
+	})(w, req)
+	statusLine, _, _ := strings.Cut(buf.String(), "\r\n")
+	return statusLine
+}
+
+func TestClientCertAuthorization(t *testing.T) {
+	uri, _ := url.Parse("spiffe://example.org/ns/billing/sa/api")
+	cert := &x509.Certificate{
+		Subject:	pkix.Name{CommonName: "svc-billing", Organization: []string{"Example"}},
+		DNSNames:	[]string{"billing.internal.example.com"},
+		URIs:		[]*url.URL{uri},
+	}
+	const ok, forbidden = "HTTP/1.1 200 OK", "HTTP/1.1 403 Forbidden"
+
+	// Test: Subject patterns match the common name or the whole subject
+	assert.Equal(t, ok, serveWithCert(AllowSubjects("svc-*"), cert, true))
+	assert.Equal(t, ok, serveWithCert(AllowSubjects("other", "CN=svc-billing,O=Example"), cert, true))
+	assert.Equal(t, forbidden, serveWithCert(AllowSubjects("svc-payments"), cert, true))
+
+	// Test: SAN patterns match DNS names and URIs
+	assert.Equal(t, ok, serveWithCert(AllowSANs("*.internal.example.com"), cert, true))
+	assert.Equal(t, ok, serveWithCert(AllowSANs("spiffe://example.org/ns/billing/*/*"), cert, true))
+	assert.Equal(t, forbidden, serveWithCert(AllowSANs("*.external.example.com"), cert, true))
+	assert.Equal(t, forbidden, serveWithCert(AllowSANs("svc-billing"), cert, true))
+
+	// Test: Missing or unverified certificates are refused
+	assert.Equal(t, forbidden, serveWithCert(AllowSubjects("*"), nil, false))
+	assert.Equal(t, forbidden, serveWithCert(AllowSubjects("*"), cert, false))
+	assert.Equal(t, forbidden, serveWithCert(AllowSANs("*"), cert, false))
+
+	// Test: Bad patterns are caught when the middleware is built
+	assert.Panics(t, func() { AllowSANs("[") })
+}
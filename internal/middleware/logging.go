@@ -0,0 +1,27 @@
+package middleware
+
+import (
+	"log"
+	"time"
+
+	"voylento/httpfromtcp/internal/request"
+	"voylento/httpfromtcp/internal/response"
+	"voylento/httpfromtcp/internal/server"
+)
+
+// Logging logs one line per request with the method, target, status code,
+// body bytes written and how long the handler took.
+func Logging(logger *log.Logger) server.Middleware {
+	return func(next server.Handler) server.Handler {
+		return func(w *response.Writer, req *request.Request) {
+			start := time.Now()
+			next(w, req)
+			logger.Printf("%s %s %d %dB %s",
+				req.RequestLine.Method,
+				req.RequestLine.RequestTarget,
+				w.StatusCode(),
+				w.BytesWritten(),
+				time.Since(start))
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package request
+
+import (
+	"errors"
+	"strings"
+
+	"voylento/httpfromtcp/internal/headers"
+)
+
+var ErrNoCookie = errors.New("named cookie not present")
+
+// Cookie is a cookie sent by the client in a Cookie header (RFC 6265).
+type Cookie struct {
+	Name	string
+	Value	string
+}
+
+// Cookies parses the Cookie headers of the request. Malformed pairs are
+// skipped rather than failing the whole header, as browsers do.
+func (r *Request) Cookies() []*Cookie {
+	var cookies []*Cookie
+	for _, line := range r.Headers.Values("cookie") {
+		for pair := range strings.SplitSeq(line, ";") {
+			name, value, found := strings.Cut(strings.Trim(pair, " \t"), "=")
+			if !found || !headers.ValidateHeaderName(name) {
+				continue
+			}
+			value, ok := parseCookieValue(value)
+			if !ok {
+				continue
+			}
+			cookies = append(cookies, &Cookie{Name: name, Value: value})
+		}
+	}
+	return cookies
+}
+
+// Cookie returns the first cookie with the given name, or ErrNoCookie.
+func (r *Request) Cookie(name string) (*Cookie, error) {
+	for _, c := range r.Cookies() {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return nil, ErrNoCookie
+}
+
+// parseCookieValue strips the optional double quotes around a cookie value
+// and checks it is made of cookie-octets.
+func parseCookieValue(value string) (string, bool) {
+	if len(value) > 1 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+	for i := 0; i < len(value); i++ {
+		if !isCookieOctet(value[i]) {
+			return "", false
+		}
+	}
+	return value, true
+}
+
+func isCookieOctet(b byte) bool {
+	return b == 0x21 || (b >= 0x23 && b <= 0x2B) || (b >= 0x2D && b <= 0x3A) ||
+		(b >= 0x3C && b <= 0x5B) || (b >= 0x5D && b <= 0x7E)
+}
@@ -0,0 +1,44 @@
+package request
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestCookies(t *testing.T) {
+	// Test: Cookie pairs from every Cookie line, quotes stripped
+	reader := &chunkReader{
+		data:			"GET / HTTP/1.1\r\nHost: h\r\nCookie: a=1; b=\"two\";c=\r\nCookie: d=4\r\n\r\n",
+		numBytesPerRead:	3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, []*Cookie{
+		{Name: "a", Value: "1"},
+		{Name: "b", Value: "two"},
+		{Name: "c", Value: ""},
+		{Name: "d", Value: "4"},
+	}, r.Cookies())
+	c, err := r.Cookie("b")
+	require.NoError(t, err)
+	assert.Equal(t, "two", c.Value)
+	_, err = r.Cookie("missing")
+	assert.ErrorIs(t, err, ErrNoCookie)
+
+	// Test: Malformed pairs are skipped
+	reader = &chunkReader{
+		data:			"GET / HTTP/1.1\r\nHost: h\r\nCookie: novalue; bad name=1; e=a\\b; f=ok; =x\r\n\r\n",
+		numBytesPerRead:	3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Equal(t, []*Cookie{{Name: "f", Value: "ok"}}, r.Cookies())
+
+	// Test: No Cookie header
+	reader = &chunkReader{data: "GET / HTTP/1.1\r\nHost: h\r\n\r\n", numBytesPerRead: 3}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	assert.Empty(t, r.Cookies())
+}
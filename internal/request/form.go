@@ -0,0 +1,310 @@
+package request
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"voylento/httpfromtcp/internal/headers"
+)
+
+// defaultMaxMemory is how much of a multipart form FormValue keeps in
+// memory before spilling files to disk.
+const defaultMaxMemory = 32 << 20
+
+var (
+	ErrNotMultipart		= errors.New("request Content-Type is not multipart/form-data")
+	ErrMissingBoundary	= errors.New("no multipart boundary in Content-Type")
+	ErrTooManyFormFields	= errors.New("too many form fields")
+	ErrTooManyFormFiles	= errors.New("too many form files")
+	ErrFormValueTooLarge	= errors.New("multipart form values too large")
+)
+
+// MultipartForm is a parsed multipart/form-data body. Value holds the
+// plain fields and File the file parts, both keyed by form field name.
+type MultipartForm struct {
+	Value	map[string][]string
+	File	map[string][]*FileHeader
+}
+
+// FileHeader describes one uploaded file. Its content is either held in
+// memory or, past the memory budget, in a temporary file.
+type FileHeader struct {
+	Filename	string
+	Header		*headers.Headers
+	Size		int64
+	content		[]byte
+	tmpfile		string
+}
+
+// File is an open uploaded file.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+}
+
+type memoryFile struct {
+	*bytes.Reader
+}
+
+func (memoryFile) Close() error {
+	return nil
+}
+
+// Open opens the uploaded file for reading.
+func (fh *FileHeader) Open() (File, error) {
+	if fh.tmpfile != "" {
+		return os.Open(fh.tmpfile)
+	}
+	return memoryFile{bytes.NewReader(fh.content)}, nil
+}
+
+// RemoveAll deletes any temporary files backing the form.
+func (f *MultipartForm) RemoveAll() error {
+	var errs []error
+	for _, files := range f.File {
+		for _, fh := range files {
+			if fh.tmpfile == "" {
+				continue
+			}
+			if err := os.Remove(fh.tmpfile); err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ParseForm fills Form with the query parameters and, for an
+// application/x-www-form-urlencoded body, PostForm and Form with the body
+// fields. Body fields come before query parameters in Form. It reads the
+// whole body, and does nothing if the form was already parsed.
+func (r *Request) ParseForm() error {
+	if r.Form != nil {
+		return nil
+	}
+	r.Form = url.Values{}
+	r.PostForm = url.Values{}
+
+	query, err := url.ParseQuery(r.rawQuery())
+	if err != nil {
+		return fmt.Errorf("Error: invalid query: %w", err)
+	}
+
+	if mediaType, _ := r.mediaType(); mediaType == "application/x-www-form-urlencoded" {
+		body, err := r.ReadBody()
+		if err != nil {
+			return err
+		}
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return fmt.Errorf("Error: invalid form body: %w", err)
+		}
+		if err := r.limits.checkFormFields(countValues(values)); err != nil {
+			return err
+		}
+		r.PostForm = values
+		for key, vs := range values {
+			r.Form[key] = append(r.Form[key], vs...)
+		}
+	}
+
+	for key, vs := range query {
+		r.Form[key] = append(r.Form[key], vs...)
+	}
+	return nil
+}
+
+// ParseMultipartForm parses a multipart/form-data body (RFC 7578) into
+// MultipartForm, after calling ParseForm. Up to maxMemory bytes of file
+// content are kept in memory; files past that go to temporary files, which
+// the server removes once the handler returns. Plain field values share
+// the same budget and are an error if they exceed it. The body can only be
+// read once, so after a failed parse later calls return the same error.
+func (r *Request) ParseMultipartForm(maxMemory int64) (err error) {
+	if r.MultipartForm != nil {
+		return nil
+	}
+	if r.multipartErr != nil {
+		return r.multipartErr
+	}
+	defer func() { r.multipartErr = err }()
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	mediaType, params := r.mediaType()
+	if mediaType != "multipart/form-data" {
+		return fmt.Errorf("Error: %w", ErrNotMultipart)
+	}
+	boundary := params["boundary"]
+	if boundary == "" {
+		return fmt.Errorf("Error: %w", ErrMissingBoundary)
+	}
+
+	form, err := r.readMultipartForm(multipart.NewReader(r.BodyReader, boundary), maxMemory)
+	if err != nil {
+		return err
+	}
+	r.MultipartForm = form
+	for key, vs := range form.Value {
+		r.Form[key] = append(r.Form[key], vs...)
+		r.PostForm[key] = append(r.PostForm[key], vs...)
+	}
+	return nil
+}
+
+func (r *Request) readMultipartForm(mr *multipart.Reader, maxMemory int64) (_ *MultipartForm, err error) {
+	form := &MultipartForm{
+		Value:	make(map[string][]string),
+		File:	make(map[string][]*FileHeader),
+	}
+	defer func() {
+		if err != nil {
+			form.RemoveAll()
+		}
+	}()
+
+	memoryLeft := maxMemory
+	fields, files := 0, 0
+	for {
+		// raw parts, since RFC 7578 does away with Content-Transfer-Encoding
+		part, err := mr.NextRawPart()
+		if errors.Is(err, io.EOF) {
+			return form, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error: reading multipart form: %w", err)
+		}
+
+		name := part.FormName()
+		if name == "" {
+			part.Close()
+			continue
+		}
+
+		filename := part.FileName()
+		if filename == "" {
+			fields++
+			if err := r.limits.checkFormFields(fields); err != nil {
+				return nil, err
+			}
+			value, err := io.ReadAll(io.LimitReader(part, memoryLeft+1))
+			if err != nil {
+				return nil, fmt.Errorf("Error: reading multipart form: %w", err)
+			}
+			if int64(len(value)) > memoryLeft {
+				return nil, fmt.Errorf("Error: %w", ErrFormValueTooLarge)
+			}
+			memoryLeft -= int64(len(value))
+			form.Value[name] = append(form.Value[name], string(value))
+			continue
+		}
+
+		files++
+		if err := r.limits.checkFormFiles(files); err != nil {
+			return nil, err
+		}
+		fh, err := readFilePart(part, filename, &memoryLeft)
+		if err != nil {
+			return nil, err
+		}
+		form.File[name] = append(form.File[name], fh)
+	}
+}
+
+// readFilePart reads a file part into memory, or into a temporary file
+// once it would take more than the memory that is left.
+func readFilePart(part *multipart.Part, filename string, memoryLeft *int64) (*FileHeader, error) {
+	fh := &FileHeader{
+		Filename:	filename,
+		Header:		mimeHeaderToHeaders(part.Header),
+	}
+
+	content, err := io.ReadAll(io.LimitReader(part, *memoryLeft+1))
+	if err != nil {
+		return nil, fmt.Errorf("Error: reading multipart file: %w", err)
+	}
+	if int64(len(content)) <= *memoryLeft {
+		*memoryLeft -= int64(len(content))
+		fh.content = content
+		fh.Size = int64(len(content))
+		return fh, nil
+	}
+
+	tmp, err := os.CreateTemp("", "multipart-")
+	if err != nil {
+		return nil, err
+	}
+	defer tmp.Close()
+	fh.tmpfile = tmp.Name()
+
+	size, err := io.Copy(tmp, io.MultiReader(bytes.NewReader(content), part))
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("Error: reading multipart file: %w", err)
+	}
+	fh.Size = size
+	return fh, nil
+}
+
+func mimeHeaderToHeaders(mh map[string][]string) *headers.Headers {
+	h := headers.NewHeaders()
+	names := make([]string, 0, len(mh))
+	for name := range mh {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		for _, value := range mh[name] {
+			h.Add(name, value)
+		}
+	}
+	return h
+}
+
+// FormValue returns the first value for key from the body or the query,
+// parsing the form if needed. Parse errors are ignored; call ParseForm or
+// ParseMultipartForm to see them.
+func (r *Request) FormValue(key string) string {
+	if r.Form == nil {
+		r.ParseMultipartForm(defaultMaxMemory)
+	}
+	return r.Form.Get(key)
+}
+
+func (r *Request) mediaType() (string, map[string]string) {
+	contentType, exists := r.Headers.Get("content-type")
+	if !exists {
+		return "", nil
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", nil
+	}
+	return strings.ToLower(mediaType), params
+}
+
+func (r *Request) rawQuery() string {
+	if r.URL == nil {
+		return ""
+	}
+	return r.URL.RawQuery
+}
+
+func countValues(values url.Values) int {
+	count := 0
+	for _, vs := range values {
+		count += len(vs)
+	}
+	return count
+}
@@ -0,0 +1,142 @@
+package request
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func formRequest(t *testing.T, target, contentType, body string) *Request {
+	t.Helper()
+	data := fmt.Sprintf("POST %s HTTP/1.1\r\nHost: h\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n%s",
+		target, contentType, len(body), body)
+	r, err := RequestFromReader(&chunkReader{data: data, numBytesPerRead: 7})
+	require.NoError(t, err)
+	return r
+}
+
+const multipartBody = "--xyz\r\n" +
+	"Content-Disposition: form-data; name=\"title\"\r\n" +
+	"\r\n" +
+	"hello\r\n" +
+	"--xyz\r\n" +
+	"Content-Disposition: form-data; name=\"upload\"; filename=\"notes.txt\"\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"some file contents\r\n" +
+	"--xyz--\r\n"
+
+func TestParseForm(t *testing.T) {
+	// Test: Urlencoded body and query are merged, body values first
+	r := formRequest(t, "/submit?a=query&q=1", "application/x-www-form-urlencoded", "a=body&b=two+words&b=%21")
+	require.NoError(t, r.ParseForm())
+	assert.Equal(t, []string{"body", "query"}, r.Form["a"])
+	assert.Equal(t, []string{"two words", "!"}, r.PostForm["b"])
+	assert.Equal(t, "1", r.Form.Get("q"))
+	assert.Empty(t, r.PostForm.Get("q"))
+	assert.Equal(t, "two words", r.FormValue("b"))
+
+	// Test: Other content types leave the body alone
+	r = formRequest(t, "/submit?a=1", "application/json", `{"a":2}`)
+	require.NoError(t, r.ParseForm())
+	assert.Equal(t, "1", r.Form.Get("a"))
+	assert.Empty(t, r.PostForm)
+	assert.Equal(t, `{"a":2}`, string(r.Body))
+
+	// Test: Too many fields
+	r = formRequest(t, "/", "application/x-www-form-urlencoded", "a=1&b=2&c=3")
+	r.limits.MaxFormFields = 2
+	assert.ErrorIs(t, r.ParseForm(), ErrTooManyFormFields)
+
+	// Test: Malformed body
+	r = formRequest(t, "/", "application/x-www-form-urlencoded", "a=%zz")
+	assert.Error(t, r.ParseForm())
+}
+
+func TestParseMultipartForm(t *testing.T) {
+	// Test: Fields and files kept in memory
+	r := formRequest(t, "/upload?x=1", `multipart/form-data; boundary="xyz"`, multipartBody)
+	require.NoError(t, r.ParseMultipartForm(1024))
+	assert.Equal(t, []string{"hello"}, r.MultipartForm.Value["title"])
+	assert.Equal(t, "hello", r.FormValue("title"))
+	assert.Equal(t, "hello", r.PostForm.Get("title"))
+	assert.Equal(t, "1", r.FormValue("x"))
+	require.Len(t, r.MultipartForm.File["upload"], 1)
+	fh := r.MultipartForm.File["upload"][0]
+	assert.Equal(t, "notes.txt", fh.Filename)
+	assert.Equal(t, int64(18), fh.Size)
+	assert.Equal(t, "text/plain", get(fh.Header, "content-type"))
+	assert.Empty(t, fh.tmpfile)
+	f, err := fh.Open()
+	require.NoError(t, err)
+	content, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "some file contents", string(content))
+	require.NoError(t, f.Close())
+
+	// Test: Files past the memory budget spill to a temporary file
+	r = formRequest(t, "/upload", "multipart/form-data; boundary=xyz", multipartBody)
+	require.NoError(t, r.ParseMultipartForm(10))
+	fh = r.MultipartForm.File["upload"][0]
+	require.NotEmpty(t, fh.tmpfile)
+	assert.Equal(t, int64(18), fh.Size)
+	f, err = fh.Open()
+	require.NoError(t, err)
+	content, err = io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "some file contents", string(content))
+	require.NoError(t, f.Close())
+	require.NoError(t, r.MultipartForm.RemoveAll())
+	_, err = os.Stat(fh.tmpfile)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// Test: Field values past the memory budget are an error
+	r = formRequest(t, "/upload", "multipart/form-data; boundary=xyz", multipartBody)
+	assert.ErrorIs(t, r.ParseMultipartForm(3), ErrFormValueTooLarge)
+
+	// Test: Too many files
+	r = formRequest(t, "/upload", "multipart/form-data; boundary=xyz", multipartBody)
+	r.limits.MaxFormFiles = 0
+	require.NoError(t, r.ParseMultipartForm(1024))
+	r = formRequest(t, "/upload", "multipart/form-data; boundary=xyz",
+		strings.Replace(multipartBody, "--xyz--", "--xyz\r\nContent-Disposition: form-data; name=\"b\"; filename=\"b\"\r\n\r\nb\r\n--xyz--", 1))
+	r.limits.MaxFormFiles = 1
+	assert.ErrorIs(t, r.ParseMultipartForm(1024), ErrTooManyFormFiles)
+
+	// Test: Too many fields
+	r = formRequest(t, "/upload", "multipart/form-data; boundary=xyz", multipartBody)
+	r.limits.MaxFormFields = 0
+	require.NoError(t, r.ParseMultipartForm(1024))
+	r = formRequest(t, "/upload?a=1", "multipart/form-data; boundary=xyz", multipartBody)
+	r.limits.MaxFormFields = 1
+	require.NoError(t, r.ParseMultipartForm(1024))
+	r = formRequest(t, "/upload", "multipart/form-data; boundary=xyz",
+		strings.Replace(multipartBody, "--xyz--", "--xyz\r\nContent-Disposition: form-data; name=\"b\"\r\n\r\nb\r\n--xyz--", 1))
+	r.limits.MaxFormFields = 1
+	assert.ErrorIs(t, r.ParseMultipartForm(1024), ErrTooManyFormFields)
+
+	// Test: Not multipart, or no boundary
+	r = formRequest(t, "/", "application/x-www-form-urlencoded", "a=1")
+	assert.ErrorIs(t, r.ParseMultipartForm(1024), ErrNotMultipart)
+	r = formRequest(t, "/", "multipart/form-data", multipartBody)
+	assert.ErrorIs(t, r.ParseMultipartForm(1024), ErrMissingBoundary)
+
+	// Test: Truncated body
+	r = formRequest(t, "/", "multipart/form-data; boundary=xyz", strings.TrimSuffix(multipartBody, "--xyz--\r\n"))
+	err = r.ParseMultipartForm(1024)
+	assert.Error(t, err)
+
+	// Test: Later calls return the first error rather than reading the
+	// spent body again
+	assert.Equal(t, err, r.ParseMultipartForm(1024))
+	assert.Nil(t, r.MultipartForm)
+	r = formRequest(t, "/upload", "multipart/form-data; boundary=xyz", multipartBody)
+	err = r.ParseMultipartForm(3)
+	assert.ErrorIs(t, err, ErrFormValueTooLarge)
+	assert.Equal(t, err, r.ParseMultipartForm(1024))
+}
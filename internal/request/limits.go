@@ -0,0 +1,76 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Limits caps how much of a request the parser will accept. A zero field
+// means no limit.
+type Limits struct {
+	MaxRequestLineBytes	int
+	MaxHeaderBytes		int
+	MaxHeaderCount		int
+	MaxBodyBytes		int64
+	// MaxFormFields and MaxFormFiles cap the fields and file parts
+	// ParseForm and ParseMultipartForm will accept.
+	MaxFormFields		int
+	MaxFormFiles		int
+}
+
+var DefaultLimits = Limits{
+	MaxRequestLineBytes:	8 * 1024,
+	MaxHeaderBytes:			1 << 20,
+	MaxHeaderCount:			100,
+	MaxBodyBytes:			10 << 20,
+	MaxFormFields:			1000,
+	MaxFormFiles:			100,
+}
+
+var (
+	ErrRequestLineTooLong	= errors.New("request line too long")
+	ErrHeadersTooLarge		= errors.New("request header fields too large")
+	ErrBodyTooLarge			= errors.New("request body too large")
+)
+
+func exceeds(size int64, limit int64) bool {
+	return limit > 0 && size > limit
+}
+
+func (l Limits) checkRequestLine(size int) error {
+	if exceeds(int64(size), int64(l.MaxRequestLineBytes)) {
+		return fmt.Errorf("Error: %w: more than %d bytes", ErrRequestLineTooLong, l.MaxRequestLineBytes)
+	}
+	return nil
+}
+
+func (l Limits) checkHeaders(size int, count int) error {
+	if exceeds(int64(size), int64(l.MaxHeaderBytes)) {
+		return fmt.Errorf("Error: %w: more than %d bytes", ErrHeadersTooLarge, l.MaxHeaderBytes)
+	}
+	if exceeds(int64(count), int64(l.MaxHeaderCount)) {
+		return fmt.Errorf("Error: %w: more than %d fields", ErrHeadersTooLarge, l.MaxHeaderCount)
+	}
+	return nil
+}
+
+func (l Limits) checkBody(size int64) error {
+	if exceeds(size, l.MaxBodyBytes) {
+		return fmt.Errorf("Error: %w: more than %d bytes", ErrBodyTooLarge, l.MaxBodyBytes)
+	}
+	return nil
+}
+
+func (l Limits) checkFormFields(count int) error {
+	if exceeds(int64(count), int64(l.MaxFormFields)) {
+		return fmt.Errorf("Error: %w: more than %d", ErrTooManyFormFields, l.MaxFormFields)
+	}
+	return nil
+}
+
+func (l Limits) checkFormFiles(count int) error {
+	if exceeds(int64(count), int64(l.MaxFormFiles)) {
+		return fmt.Errorf("Error: %w: more than %d", ErrTooManyFormFiles, l.MaxFormFiles)
+	}
+	return nil
+}
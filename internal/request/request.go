@@ -2,9 +2,11 @@ package request
 
 import (
 	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
@@ -14,15 +16,49 @@ import (
 
 type Request struct {
 	RequestLine 	RequestLine
-	Headers 		headers.Headers
+	// URL is the parsed request target. For absolute-form and
+	// authority-form targets it includes the host.
+	URL				*url.URL
+	Headers 		*headers.Headers
 	Body			[]byte
+	// BodyReader streams the body. When the request was read without
+	// StreamBody it reads from the already buffered Body.
+	BodyReader		io.ReadCloser
+	Trailers		*headers.Headers
+	// PathParams holds the values a router extracted from the path.
+	PathParams		map[string]string
+	// Form holds query and body fields, PostForm only the body fields,
+	// and MultipartForm the parsed multipart body. They are filled in by
+	// ParseForm and ParseMultipartForm.
+	Form			url.Values
+	PostForm		url.Values
+	MultipartForm	*MultipartForm
+	// multipartErr is why ParseMultipartForm failed, for later calls
+	multipartErr	error
+	// TLS describes the connection the request arrived on, including the
+	// negotiated version, cipher suite and SNI server name. It is nil for
+	// plain TCP.
+	TLS				*tls.ConnectionState
 	state			requestState
+	limits			Limits
+	headerBytes		int
+	headerCount		int
+	bodyBytes		int64
+	strict			bool
+	allowBareLF		bool
+	conflictingFraming	bool
+	streaming		bool
+	pending			[]byte
+	bodyRemaining	int
+	chunkRemaining	int
 }
 
 type RequestLine struct {
 	HttpVersion		string
 	RequestTarget	string
+	TargetForm		TargetForm
 	Method			string
+	url				*url.URL
 }
 
 type requestState int
@@ -31,62 +67,322 @@ const (
 	requestStateInitialized requestState = iota
 	requestStateParsingHeaders
 	requestStateParsingBody
+	requestStateParsingFixedBody
+	requestStateParsingChunkSize
+	requestStateParsingChunkData
+	requestStateParsingTrailers
 	requestStateDone
 )
 
 var httpMethodRegex = regexp.MustCompile(`^[A-Z]+$`)
 const crlf = "\r\n"
 const bufferSize = 8
+const maxChunkSizeLineBytes = 4096
+
+// Reader reads successive requests from a single connection. Bytes read
+// past the end of one request are kept for the next, so pipelined requests
+// are not lost.
+type Reader struct {
+	// StreamBody stops parsing after the headers. The body is then read
+	// through Request.BodyReader instead of being buffered into Body.
+	StreamBody	bool
+	// Limits bounds the size of each part of a request. NewReader starts
+	// from DefaultLimits.
+	Limits		Limits
+	// Strict rejects anything that different parsers could disagree on,
+	// which is what request smuggling relies on: conflicting or duplicate
+	// framing headers, bare LF line endings, obsolete line folding and
+	// loosely spaced request lines.
+	Strict		bool
+	// AllowBareLF accepts a bare LF as a line ending, which RFC 9112 lets
+	// servers do. It has no effect when Strict is set.
+	AllowBareLF	bool
+
+	reader		io.Reader
+	buf			[]byte
+	readToIndex	int
+	current		*Request
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{
+		reader: reader,
+		buf: make([]byte, bufferSize),
+		Limits: DefaultLimits,
+	}
+}
 
 func RequestFromReader(reader io.Reader) (*Request, error) {
-	buf := make([]byte, bufferSize)
-	readToIndex := 0
+	return NewReader(reader).ReadRequest()
+}
+
+// NewRequest builds a request that did not arrive as HTTP/1.x text, such as
+// one on an HTTP/2 stream. The target is parsed as a request line's would
+// be, and the limits on the request line and headers are checked. The body
+// is read as is, so framing it is up to whoever supplies body.
+func NewRequest(method, target, httpVersion string, h *headers.Headers, body io.ReadCloser, limits Limits) (*Request, error) {
+	if !httpMethodRegex.MatchString(method) {
+		return nil, fmt.Errorf("Error: HTTP method must contain only uppercase letters")
+	}
+	if err := limits.checkRequestLine(len(method) + len(" ") + len(target) + len(" HTTP/") + len(httpVersion)); err != nil {
+		return nil, err
+	}
+	headerBytes := 0
+	for _, f := range h.Raw() {
+		headerBytes += len(f.Name) + len(f.Value) + len(": ") + len(crlf)
+	}
+	if err := limits.checkHeaders(headerBytes, h.Len()); err != nil {
+		return nil, err
+	}
+	targetForm, targetURL, err := parseRequestTarget(method, target)
+	if err != nil {
+		return nil, err
+	}
+	return &Request{
+		RequestLine: RequestLine{
+			HttpVersion: httpVersion,
+			RequestTarget: target,
+			TargetForm: targetForm,
+			Method: method,
+			url: targetURL,
+		},
+		URL: targetURL,
+		Headers: h,
+		BodyReader: body,
+		Trailers: headers.NewHeaders(),
+		state: requestStateDone,
+		limits: limits,
+		streaming: true,
+	}, nil
+}
+
+// ReadRequest parses the next request. It returns io.EOF if the connection
+// was closed cleanly before any bytes of a new request arrived. Any part of
+// a previous streamed body that the caller did not read is discarded first.
+func (rr *Reader) ReadRequest() (*Request, error) {
+	if err := rr.DiscardBody(); err != nil {
+		return nil, err
+	}
+
 	req := &Request{
 		Headers: headers.NewHeaders(),
+		Trailers: headers.NewHeaders(),
 		state: requestStateInitialized,
+		limits: rr.Limits,
+		strict: rr.Strict,
+		allowBareLF: rr.AllowBareLF && !rr.Strict,
+		streaming: rr.StreamBody,
+	}
+
+	stop := requestStateDone
+	if req.streaming {
+		// stop once the body framing is known, so that it is validated
+		// before anyone reads the body
+		stop = requestStateParsingFixedBody
+	}
+	for req.state < stop {
+		if err := rr.advance(req, stop); err != nil {
+			return nil, err
+		}
+	}
+
+	if req.streaming {
+		req.BodyReader = &bodyReader{reader: rr, req: req}
+		rr.current = req
+	} else {
+		req.BodyReader = io.NopCloser(bytes.NewReader(req.Body))
 	}
+	return req, nil
+}
+
+// advance parses whatever is already buffered, and reads more from the
+// connection if that did not move the request forward.
+func (rr *Reader) advance(req *Request, stop requestState) error {
+	prevState := req.state
+	numBytesParsed, err := req.parse(rr.buf[:rr.readToIndex], stop)
+	if err != nil {
+		return err
+	}
+
+	copy(rr.buf, rr.buf[numBytesParsed:rr.readToIndex])
+	rr.readToIndex -= numBytesParsed
 
+	if numBytesParsed > 0 || req.state != prevState || req.state >= stop {
+		return nil
+	}
+
+	if rr.readToIndex >= len(rr.buf) {
+		newBuf := make([]byte, len(rr.buf)*2)
+		copy(newBuf, rr.buf)
+		rr.buf = newBuf
+	}
+
+	numBytesRead, err := rr.reader.Read(rr.buf[rr.readToIndex:])
+	rr.readToIndex += numBytesRead // add count of bytes to total read from io
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			return err
+		}
+		if numBytesRead > 0 {
+			return nil
+		}
+		if req.state == requestStateInitialized && rr.readToIndex == 0 {
+			return io.EOF
+		}
+		if req.state >= requestStateParsingBody {
+			return fmt.Errorf("Error: body truncated: %w", io.ErrUnexpectedEOF)
+		}
+		return fmt.Errorf("Error: EOF before request fully processed")
+	}
+	return nil
+}
+
+// DiscardBody reads and throws away whatever is left of the body of the
+// last streamed request, leaving the connection at the start of the next
+// request.
+func (rr *Reader) DiscardBody() error {
+	req := rr.current
+	if req == nil {
+		return nil
+	}
 	for req.state != requestStateDone {
-		if readToIndex >= len(buf) {
-			newBuf := make([]byte, len(buf)*2)
-			copy(newBuf, buf)
-			buf = newBuf
+		req.pending = req.pending[:0]
+		if err := rr.advance(req, requestStateDone); err != nil {
+			return err
+		}
+	}
+	req.pending = nil
+	rr.current = nil
+	return nil
+}
+
+// Peek blocks until at least one byte of the next request has arrived,
+// without parsing anything. It returns io.EOF if the connection was closed
+// first.
+func (rr *Reader) Peek() error {
+	if err := rr.DiscardBody(); err != nil {
+		return err
+	}
+	for rr.readToIndex == 0 {
+		numBytesRead, err := rr.reader.Read(rr.buf)
+		rr.readToIndex += numBytesRead
+		if err != nil && rr.readToIndex == 0 {
+			return err
 		}
-	
-		numBytesRead, err := reader.Read(buf[readToIndex:])
+	}
+	return nil
+}
+
+// HasPrefix reports whether the unparsed input starts with prefix, reading
+// only as much as it takes to tell. It is how a server spots a client
+// speaking another protocol, such as the HTTP/2 connection preface.
+func (rr *Reader) HasPrefix(prefix []byte) (bool, error) {
+	for {
+		n := min(rr.readToIndex, len(prefix))
+		if !bytes.Equal(rr.buf[:n], prefix[:n]) {
+			return false, nil
+		}
+		if n == len(prefix) {
+			return true, nil
+		}
+		if rr.readToIndex >= len(rr.buf) {
+			newBuf := make([]byte, len(rr.buf)*2)
+			copy(newBuf, rr.buf)
+			rr.buf = newBuf
+		}
+		numBytesRead, err := rr.reader.Read(rr.buf[rr.readToIndex:])
+		rr.readToIndex += numBytesRead
 		if err != nil {
-			if errors.Is(err, io.EOF) {
-				if req.state != requestStateDone {
-					return nil, fmt.Errorf("Error: EOF before request fully processed")
-				}
-				break
+			if errors.Is(err, io.EOF) && numBytesRead > 0 {
+				continue
 			}
-			return nil, err
+			return false, err
 		}
+	}
+}
 
-		readToIndex += numBytesRead // add count of bytes to total read from io
+// Buffered returns a copy of the bytes read from the connection but not yet
+// parsed: the start of a pipelined request or, once the connection has
+// switched protocols, the first bytes of the new protocol.
+func (rr *Reader) Buffered() []byte {
+	return bytes.Clone(rr.buf[:rr.readToIndex])
+}
 
-		numBytesParsed, err := req.parse(buf[:readToIndex])
-		if err != nil {
-			return nil, err
+// bodyReader streams a body straight off the connection, enforcing the
+// Content-Length or chunked framing as it goes.
+type bodyReader struct {
+	reader	*Reader
+	req		*Request
+	err		error
+	closed	bool
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, fmt.Errorf("Error: read on closed body")
+	}
+	for len(b.req.pending) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		if b.req.state == requestStateDone {
+			return 0, io.EOF
 		}
+		b.err = b.reader.advance(b.req, requestStateDone)
+	}
+	n := copy(p, b.req.pending)
+	b.req.pending = b.req.pending[n:]
+	return n, nil
+}
+
+// Close stops the body from being read any further. Unread bytes are
+// discarded by the next call to ReadRequest.
+func (b *bodyReader) Close() error {
+	b.closed = true
+	b.req.pending = nil
+	return nil
+}
 
-		copy(buf, buf[numBytesParsed:])
-		readToIndex -= numBytesParsed
+// ReadBody reads the rest of a streamed body into Body and returns it. For
+// a request that was not streamed it just returns Body.
+func (r *Request) ReadBody() ([]byte, error) {
+	if !r.streaming {
+		return r.Body, nil
+	}
+	body, err := io.ReadAll(r.BodyReader)
+	r.Body = append(r.Body, body...)
+	if err != nil {
+		return r.Body, err
 	}
+	r.streaming = false
+	return r.Body, nil
+}
 
-	return req, nil
+// PathValue returns the named path parameter, or "" if there is none.
+func (r *Request) PathValue(name string) string {
+	return r.PathParams[name]
 }
 
-func (r *Request) parse(data []byte) (int, error) {
+// emit hands decoded body bytes to either the buffered Body or, when
+// streaming, to the BodyReader.
+func (r *Request) emit(p []byte) {
+	if r.streaming {
+		r.pending = append(r.pending, p...)
+		return
+	}
+	r.Body = append(r.Body, p...)
+}
+
+func (r *Request) parse(data []byte, stop requestState) (int, error) {
 	totalBytesParsed := 0
 
-	for r.state != requestStateDone {
+	for r.state < stop {
+		prevState := r.state
 		n, err := r.parseSingle(data[totalBytesParsed:])
 		if err != nil {
 			return 0, err
 		}
-		if n == 0 {
+		if n == 0 && r.state == prevState {
 			return totalBytesParsed, nil
 		}
 		totalBytesParsed += n
@@ -98,79 +394,379 @@ func (r *Request) parse(data []byte) (int, error) {
 func (r *Request) parseSingle(data []byte) (int, error) {
 	switch r.state {
 	case requestStateInitialized:
-		requestLine, n, err := parseRequestLine(data)
+		requestLine, lineLength, n, err := parseRequestLine(data, r.strict, r.allowBareLF)
 		if err != nil {
 			return 0, err
 		}
 		if n == 0 {
-			return 0, nil
+			return 0, r.limits.checkRequestLine(len(data))
+		}
+		if err := r.limits.checkRequestLine(lineLength); err != nil {
+			return 0, err
 		}
 		r.RequestLine = *requestLine
+		r.URL = requestLine.url
 		r.state = requestStateParsingHeaders
 		return n, nil
 	case requestStateParsingHeaders:
-		n, done, err := r.Headers.Parse(data)
+		n, done, err := r.parseHeaderLine(r.Headers, data)
 		if err != nil {
 			return 0, err
 		}
 		if n == 0 {
-			return 0, nil
+			return 0, r.limits.checkHeaders(r.headerBytes+len(data), r.headerCount)
+		}
+		if err := r.countHeaderLine(n, done); err != nil {
+			return 0, err
 		}
 		if done {
+			if err := r.checkHost(); err != nil {
+				return 0, err
+			}
 			r.state = requestStateParsingBody
 		}
 		return n, nil 
 	case requestStateParsingBody:
-		bodyLength, exists := r.Headers.Get("content-length")
-		contentLength, err := strconv.Atoi(bodyLength)
-		if !exists || contentLength < 1 {
+		chunked, err := r.isChunked()
+		if err != nil {
+			return 0, err
+		}
+		if chunked {
+			r.state = requestStateParsingChunkSize
+			return 0, nil
+		}
+		contentLength, err := r.contentLength()
+		if err != nil {
+			return 0, err
+		}
+		if contentLength < 1 {
 			r.state = requestStateDone
 			return 0, nil
 		}
-		body, n, err := parseBody(data, contentLength)
+		if err := r.limits.checkBody(contentLength); err != nil {
+			return 0, err
+		}
+		r.bodyRemaining = int(contentLength)
+		r.state = requestStateParsingFixedBody
+		return 0, nil
+	case requestStateParsingFixedBody:
+		n := min(len(data), r.bodyRemaining)
+		r.emit(data[:n])
+		r.bodyRemaining -= n
+		if r.bodyRemaining == 0 {
+			r.state = requestStateDone
+		}
+		return n, nil
+	case requestStateParsingChunkSize:
+		size, n, err := parseChunkSize(data, r.strict, r.allowBareLF)
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, nil
+		}
+		r.bodyBytes += int64(size)
+		if err := r.limits.checkBody(r.bodyBytes); err != nil {
+			return 0, err
+		}
+		if size == 0 {
+			r.headerBytes = 0
+			r.headerCount = 0
+			r.state = requestStateParsingTrailers
+		} else {
+			r.chunkRemaining = size
+			r.state = requestStateParsingChunkData
+		}
+		return n, nil
+	case requestStateParsingChunkData:
+		if r.chunkRemaining > 0 {
+			n := min(len(data), r.chunkRemaining)
+			r.emit(data[:n])
+			r.chunkRemaining -= n
+			return n, nil
+		}
+		// chunk data is always followed by a line ending
+		line, n, err := headers.NextLine(data, r.allowBareLF)
 		if err != nil {
 			return 0, err
 		}
 		if n == 0 {
+			if len(data) >= len(crlf) {
+				return 0, fmt.Errorf("Error: chunk data not terminated by crlf")
+			}
 			return 0, nil
 		}
-		if n != contentLength {
-			return 0, fmt.Errorf("Error: body length does not match content-length: %d", contentLength)
+		if len(line) != 0 {
+			return 0, fmt.Errorf("Error: chunk data not terminated by crlf")
 		}
-		r.Body = body
-		r.state = requestStateDone
-		return n, nil	
+		r.state = requestStateParsingChunkSize
+		return n, nil
+	case requestStateParsingTrailers:
+		n, done, err := r.parseHeaderLine(r.Trailers, data)
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, r.limits.checkHeaders(r.headerBytes+len(data), r.headerCount)
+		}
+		if err := r.countHeaderLine(n, done); err != nil {
+			return 0, err
+		}
+		if done {
+			r.state = requestStateDone
+		}
+		return n, nil
 	default:
 		return 0, fmt.Errorf("Error: unknown parse state: %d", r.state)
 	}
 }
 
-func parseBody(data []byte, length int) ([]byte, int, error) {
-	if len(data) > length {
-		return nil, 0, fmt.Errorf("Error: body length (%d) greater than content-length (%d)", len(data), length)
+// checkHost enforces that HTTP/1.1 requests carry exactly one Host
+// header. HTTP/1.0 predates Host, so it may be left out there.
+func (r *Request) checkHost() error {
+	hosts := r.Headers.Values("host")
+	if len(hosts) > 1 {
+		return fmt.Errorf("Error: multiple Host headers")
+	}
+	if len(hosts) == 0 && r.RequestLine.HttpVersion == "1.1" {
+		return fmt.Errorf("Error: missing Host header")
+	}
+	return nil
+}
+
+// KeepAlive reports whether the client is willing to send another request
+// on the same connection. HTTP/1.1 connections persist unless the client
+// says close; HTTP/1.0 ones close unless the client asks for keep-alive.
+func (r *Request) KeepAlive() bool {
+	if r.conflictingFraming {
+		return false
 	}
-	if len(data) < length {
-		// need more data
-		return nil, 0, nil
+	if r.RequestLine.HttpVersion == "1.0" {
+		return r.Headers.HasToken("connection", "keep-alive")
+	}
+	return !r.Headers.HasToken("connection", "close")
+}
+
+// ExpectsContinue reports whether the client is waiting for a 100 Continue
+// before sending the body. HTTP/1.0 clients cannot ask for one.
+func (r *Request) ExpectsContinue() bool {
+	return r.RequestLine.HttpVersion != "1.0" && r.Headers.HasToken("expect", "100-continue")
+}
+
+// countHeaderLine adds a parsed header (or trailer) line to the running
+// totals checked against the limits.
+func (r *Request) countHeaderLine(n int, done bool) error {
+	r.headerBytes += n
+	if !done {
+		r.headerCount++
 	}
-	buf := make([]byte, length)
-	copy(buf, data[:length])
-	return buf, length, nil
+	return r.limits.checkHeaders(r.headerBytes, r.headerCount)
 }
 
-func parseRequestLine(data []byte) (*RequestLine, int, error) {
-	idx := bytes.Index(data, []byte(crlf))
-	if idx == -1 {
-		return nil, 0, nil
+func (r *Request) parseHeaderLine(h *headers.Headers, data []byte) (int, bool, error) {
+	if r.strict {
+		return h.ParseStrict(data)
+	}
+	if r.allowBareLF {
+		return h.ParseAllowBareLF(data)
+	}
+	return h.Parse(data)
+}
+
+// isChunked reports whether the body uses the chunked transfer coding. A
+// request Transfer-Encoding that does not end in chunked leaves no way to
+// find the end of the body, so it is an error.
+func (r *Request) isChunked() (bool, error) {
+	values := r.Headers.Values("transfer-encoding")
+	if len(values) == 0 {
+		return false, nil
+	}
+	te := strings.Join(values, ", ")
+
+	_, hasLength := r.Headers.Get("content-length")
+	if hasLength {
+		if r.strict {
+			return false, fmt.Errorf("Error: both Content-Length and Transfer-Encoding present")
+		}
+		// Transfer-Encoding wins, but the connection cannot be trusted
+		// for another request afterwards
+		r.conflictingFraming = true
+	}
+	if r.strict && r.RequestLine.HttpVersion == "1.0" {
+		return false, fmt.Errorf("Error: Transfer-Encoding in an HTTP/1.0 request")
+	}
+
+	codings := strings.Split(te, ",")
+	chunkedCount := 0
+	for _, coding := range codings {
+		coding = strings.TrimSpace(coding)
+		if strings.EqualFold(coding, "chunked") {
+			chunkedCount++
+		}
+		if r.strict && !headers.ValidateHeaderName(coding) {
+			return false, fmt.Errorf("Error: invalid transfer-encoding: %s", te)
+		}
+	}
+	last := strings.TrimSpace(codings[len(codings)-1])
+	if !strings.EqualFold(last, "chunked") {
+		return false, fmt.Errorf("Error: unsupported transfer-encoding: %s", te)
+	}
+	if r.strict && chunkedCount > 1 {
+		return false, fmt.Errorf("Error: chunked applied more than once: %s", te)
+	}
+	return true, nil
+}
+
+// contentLength returns the declared body length, or 0 without a
+// Content-Length header. Lenient parsing accepts a repeated length as long
+// as every copy agrees; strict parsing wants exactly one.
+func (r *Request) contentLength() (int64, error) {
+	values := r.Headers.Values("content-length")
+	if len(values) == 0 {
+		return 0, nil
+	}
+	if r.strict && len(values) > 1 {
+		return 0, fmt.Errorf("Error: duplicate Content-Length headers")
 	}
 
-	requestLineText := string(data[:idx])
+	var lengths []string
+	for _, value := range values {
+		lengths = append(lengths, strings.Split(value, ",")...)
+	}
+	if r.strict && len(lengths) > 1 {
+		return 0, fmt.Errorf("Error: Content-Length lists more than one value: %s", values[0])
+	}
+
+	first := strings.TrimSpace(lengths[0])
+	for _, length := range lengths {
+		length = strings.TrimSpace(length)
+		if !isDigits(length) {
+			return 0, fmt.Errorf("Error: invalid Content-Length: %q", length)
+		}
+		if length != first {
+			return 0, fmt.Errorf("Error: conflicting Content-Length values: %s", strings.Join(values, ", "))
+		}
+	}
+
+	contentLength, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Error: invalid Content-Length: %q", first)
+	}
+	return contentLength, nil
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseChunkSize parses a chunk-size line, discarding any chunk extensions.
+// It returns 0 bytes parsed if the line is not yet complete.
+func parseChunkSize(data []byte, strict, allowBareLF bool) (int, int, error) {
+	lineBytes, n, err := headers.NextLine(data, allowBareLF)
+	if err != nil {
+		return 0, 0, err
+	}
+	if n == 0 {
+		if len(data) > maxChunkSizeLineBytes {
+			return 0, 0, fmt.Errorf("Error: chunk size line too long")
+		}
+		return 0, 0, nil
+	}
+
+	line := string(lineBytes)
+	sizeText, extensions, _ := strings.Cut(line, ";")
+	if !strict {
+		sizeText = strings.TrimRight(sizeText, " \t")
+	}
+	if sizeText == "" {
+		return 0, 0, fmt.Errorf("Error: missing chunk size: %s", line)
+	}
+	size, err := strconv.ParseUint(sizeText, 16, 31)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Error: invalid chunk size: %s", sizeText)
+	}
+	if err := validateChunkExtensions(extensions); err != nil {
+		return 0, 0, err
+	}
+
+	return int(size), n, nil
+}
+
+// validateChunkExtensions checks the ";name[=value]" list that may follow
+// a chunk size. Values are either tokens or quoted strings.
+func validateChunkExtensions(extensions string) error {
+	for extensions != "" {
+		var ext string
+		ext, extensions = cutChunkExtension(extensions)
+		name, value, hasValue := strings.Cut(ext, "=")
+		name = strings.TrimSpace(name)
+		if !headers.ValidateHeaderName(name) {
+			return fmt.Errorf("Error: invalid chunk extension: %s", ext)
+		}
+		if !hasValue {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if isQuotedString(value) {
+			continue
+		}
+		if !headers.ValidateHeaderName(value) {
+			return fmt.Errorf("Error: invalid chunk extension: %s", ext)
+		}
+	}
+	return nil
+}
+
+// cutChunkExtension splits off the first extension, taking care not to
+// split on a ';' inside a quoted string.
+func cutChunkExtension(s string) (string, string) {
+	inQuotes := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && inQuotes:
+			i++
+		case s[i] == '"':
+			inQuotes = !inQuotes
+		case s[i] == ';' && !inQuotes:
+			return s[:i], s[i+1:]
+		}
+	}
+	return s, ""
+}
+
+func isQuotedString(s string) bool {
+	return len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"'
+}
+
+// parseRequestLine parses the request line, returning it along with its
+// length and the number of bytes consumed including the line ending.
+func parseRequestLine(data []byte, strict, allowBareLF bool) (*RequestLine, int, int, error) {
+	line, n, err := headers.NextLine(data, allowBareLF)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if n == 0 {
+		return nil, 0, 0, nil
+	}
+
+	requestLineText := string(line)
+	if strict && len(strings.Split(requestLineText, " ")) != 3 {
+		return nil, 0, 0, fmt.Errorf("request line must be three fields separated by single spaces: %q", requestLineText)
+	}
 	requestLine, err := parseRequestLineFromString(requestLineText)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, 0, err
 	}
 
-	return requestLine, idx + 2, nil
+	return requestLine, len(line), n, nil
 }
 
 func parseRequestLineFromString(str string) (*RequestLine, error) {
@@ -186,18 +782,24 @@ func parseRequestLineFromString(str string) (*RequestLine, error) {
 	}
 
 	requestTarget := fields[1]
+	targetForm, targetURL, err := parseRequestTarget(method, requestTarget)
+	if err != nil {
+		return nil, err
+	}
 
 	httpVersion, found := strings.CutPrefix(fields[2], "HTTP/") 
 	if !found {
 		return nil, fmt.Errorf("Http version invalid format")
 	}
-	if httpVersion != "1.1" {
+	if httpVersion != "1.1" && httpVersion != "1.0" {
 		return nil, fmt.Errorf("unrecognized HTTP-version: %s", httpVersion)
 	}
 
 	return &RequestLine{
 			Method:					method,
 			RequestTarget:	requestTarget,	
+			TargetForm:		targetForm,
 			HttpVersion:		httpVersion,
+			url:				targetURL,
 		}, nil
 }
@@ -3,8 +3,9 @@ package request
 import (
 	"io"
 	//"os"
+	"strings"
 	"testing"
-	// "voylento/httpfromtcp/internal/headers"
+	"voylento/httpfromtcp/internal/headers"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -33,6 +34,12 @@ func (cr *chunkReader) Read(p []byte) (n int, err error) {
 	return n, nil
 }
 
+// get returns the combined value of a header, or "" if it is missing.
+func get(h *headers.Headers, key string) string {
+	value, _ := h.Get(key)
+	return value
+}
+
 func TestRequestLineParse(t *testing.T) {
 	// Test: Good GET Request Line
 	reader := &chunkReader{
@@ -116,9 +123,9 @@ func TestParseRequestWithHeaders(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-	assert.Equal(t, "*/*", r.Headers["accept"])
+	assert.Equal(t, "localhost:42069", get(r.Headers, "host"))
+	assert.Equal(t, "curl/7.81.0", get(r.Headers, "user-agent"))
+	assert.Equal(t, "*/*", get(r.Headers, "accept"))
 
 	// Test: Empty headers
 	reader = &chunkReader{
@@ -128,7 +135,7 @@ func TestParseRequestWithHeaders(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "", r.Headers["user-agent"])
+	assert.Equal(t, "", get(r.Headers, "user-agent"))
 
 
 	// Test: Malformed Headers
@@ -183,3 +190,402 @@ func TestParseRequestBody(t *testing.T) {
 
 	// Test: Body but missing Content-Length (valid)
 }
+
+func TestParseChunkedRequestBody(t *testing.T) {
+	// Test: Simple chunked body
+	reader := &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"6\r\nhello \r\n" +
+			"6\r\nworld!\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "hello world!", string(r.Body))
+	assert.Equal(t, 0, r.Trailers.Len())
+
+	// Test: Chunk extensions and hex sizes
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"A;name=value\r\n0123456789\r\n" +
+			"1;quoted=\"a;b\";flag\r\n!\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 1,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "0123456789!", string(r.Body))
+
+	// Test: Trailers are kept separate from headers
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"Trailer: X-Checksum\r\n" +
+			"\r\n" +
+			"4\r\ndata\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc123\r\n" +
+			"\r\n",
+		numBytesPerRead: 5,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "data", string(r.Body))
+	assert.Equal(t, "abc123", get(r.Trailers, "x-checksum"))
+	_, exists := r.Headers.Get("x-checksum")
+	assert.False(t, exists)
+
+	// Test: Empty chunked body
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 4,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "", string(r.Body))
+
+	// Test: Invalid chunk size
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"zz\r\nhello\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+
+	// Test: Chunk data longer than chunk size
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"3\r\nhello\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+
+	// Test: Missing last chunk
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+
+	// Test: Transfer-Encoding without chunked as the final coding
+	reader = &chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked, gzip\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.Error(t, err)
+}
+
+func TestReadPipelinedRequests(t *testing.T) {
+	// Test: Pipelined requests on one connection are read in order
+	reader := NewReader(&chunkReader{
+		data: "POST /first HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /second HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"\r\n" +
+			"POST /third HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"3\r\nabc\r\n0\r\n\r\n",
+		numBytesPerRead: 64,
+	})
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/first", r.RequestLine.RequestTarget)
+	assert.Equal(t, "hello", string(r.Body))
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+	assert.Empty(t, r.Body)
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/third", r.RequestLine.RequestTarget)
+	assert.Equal(t, "abc", string(r.Body))
+
+	// Test: Clean close between requests reports io.EOF
+	_, err = reader.ReadRequest()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: Close partway through a request is not a clean EOF
+	reader = NewReader(&chunkReader{
+		data: "GET / HTTP/1.1\r\nHost: localhost:42069\r\n\r\nGET /partial HT",
+		numBytesPerRead: 7,
+	})
+	_, err = reader.ReadRequest()
+	require.NoError(t, err)
+	_, err = reader.ReadRequest()
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, io.EOF)
+}
+
+func TestStreamRequestBody(t *testing.T) {
+	// Test: Content-Length body is streamed through BodyReader
+	reader := NewReader(&chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 13\r\n" +
+			"\r\n" +
+			"hello world!\n",
+		numBytesPerRead: 3,
+	})
+	reader.StreamBody = true
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Nil(t, r.Body)
+	body, err := io.ReadAll(r.BodyReader)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!\n", string(body))
+
+	// Test: Chunked body is streamed and trailers are available at EOF
+	reader = NewReader(&chunkReader{
+		data: "POST /upload HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"6\r\nhello \r\n" +
+			"6\r\nworld!\r\n" +
+			"0\r\n" +
+			"X-Checksum: abc123\r\n" +
+			"\r\n",
+		numBytesPerRead: 2,
+	})
+	reader.StreamBody = true
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	body, err = r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "hello world!", string(body))
+	assert.Equal(t, "hello world!", string(r.Body))
+	assert.Equal(t, "abc123", get(r.Trailers, "x-checksum"))
+
+	// Test: Truncated body is reported as an error
+	reader = NewReader(&chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 20\r\n" +
+			"\r\n" +
+			"partial content",
+		numBytesPerRead: 3,
+	})
+	reader.StreamBody = true
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	_, err = io.ReadAll(r.BodyReader)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Test: Unread body is skipped before the next request
+	reader = NewReader(&chunkReader{
+		data: "POST /first HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /second HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"\r\n",
+		numBytesPerRead: 4,
+	})
+	reader.StreamBody = true
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	buf := make([]byte, 2)
+	_, err = r.BodyReader.Read(buf)
+	require.NoError(t, err)
+	require.NoError(t, r.BodyReader.Close())
+	_, err = r.BodyReader.Read(buf)
+	require.Error(t, err)
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+}
+
+func TestRequestLimits(t *testing.T) {
+	limits := Limits{
+		MaxRequestLineBytes: 32,
+		MaxHeaderBytes:      64,
+		MaxHeaderCount:      2,
+		MaxBodyBytes:        8,
+	}
+	newReader := func(data string) *Reader {
+		reader := NewReader(&chunkReader{data: data, numBytesPerRead: 5})
+		reader.Limits = limits
+		return reader
+	}
+
+	// Test: Requests within the limits are accepted
+	r, err := newReader("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 8\r\n\r\n12345678").ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "12345678", string(r.Body))
+
+	// Test: Request line too long, even before the crlf arrives
+	_, err = newReader("GET /" + strings.Repeat("a", 64) + " HTTP/1.1\r\n\r\n").ReadRequest()
+	assert.ErrorIs(t, err, ErrRequestLineTooLong)
+	_, err = newReader("GET /" + strings.Repeat("a", 64)).ReadRequest()
+	assert.ErrorIs(t, err, ErrRequestLineTooLong)
+
+	// Test: Too many header bytes
+	_, err = newReader("GET / HTTP/1.1\r\nX-Big: " + strings.Repeat("a", 64) + "\r\n\r\n").ReadRequest()
+	assert.ErrorIs(t, err, ErrHeadersTooLarge)
+
+	// Test: Too many header fields
+	_, err = newReader("GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n").ReadRequest()
+	assert.ErrorIs(t, err, ErrHeadersTooLarge)
+
+	// Test: Content-Length over the body limit is rejected before the body
+	reader := newReader("POST / HTTP/1.1\r\nHost: h\r\nContent-Length: 9\r\n\r\n")
+	reader.StreamBody = true
+	_, err = reader.ReadRequest()
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: Chunked body over the body limit
+	_, err = newReader("POST / HTTP/1.1\r\nHost: h\r\nTransfer-Encoding: chunked\r\n\r\n5\r\n12345\r\n5\r\n67890\r\n0\r\n\r\n").ReadRequest()
+	assert.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: Zero limits mean no limit
+	reader = NewReader(&chunkReader{
+		data: "GET /" + strings.Repeat("a", 10000) + " HTTP/1.1\r\nHost: h\r\n\r\n",
+		numBytesPerRead: 1024,
+	})
+	reader.Limits = Limits{}
+	_, err = reader.ReadRequest()
+	require.NoError(t, err)
+}
+
+func TestParseRequestTarget(t *testing.T) {
+	parse := func(requestLine string) (*Request, error) {
+		return RequestFromReader(strings.NewReader(requestLine + "\r\nHost: localhost:42069\r\n\r\n"))
+	}
+
+	// Test: Origin-form with a query
+	r, err := parse("GET /search/some%20thing?q=go+lang&tag=a&tag=b HTTP/1.1")
+	require.NoError(t, err)
+	assert.Equal(t, TargetFormOrigin, r.RequestLine.TargetForm)
+	assert.Equal(t, "/search/some thing", r.URL.Path)
+	assert.Equal(t, "/search/some%20thing", r.URL.EscapedPath())
+	assert.Equal(t, "q=go+lang&tag=a&tag=b", r.URL.RawQuery)
+	assert.Equal(t, "go lang", r.Query().Get("q"))
+	assert.Equal(t, []string{"a", "b"}, r.Query()["tag"])
+	assert.Equal(t, "", r.URL.Host)
+
+	// Test: Absolute-form, as sent to a proxy
+	r, err = parse("GET http://example.com:8080/a/b?c=d HTTP/1.1")
+	require.NoError(t, err)
+	assert.Equal(t, TargetFormAbsolute, r.RequestLine.TargetForm)
+	assert.Equal(t, "http", r.URL.Scheme)
+	assert.Equal(t, "example.com:8080", r.URL.Host)
+	assert.Equal(t, "/a/b", r.URL.Path)
+	assert.Equal(t, "d", r.Query().Get("c"))
+
+	// Test: Authority-form with CONNECT
+	r, err = parse("CONNECT example.com:443 HTTP/1.1")
+	require.NoError(t, err)
+	assert.Equal(t, TargetFormAuthority, r.RequestLine.TargetForm)
+	assert.Equal(t, "example.com:443", r.URL.Host)
+	r, err = parse("CONNECT [::1]:8443 HTTP/1.1")
+	require.NoError(t, err)
+	assert.Equal(t, "[::1]:8443", r.URL.Host)
+
+	// Test: Asterisk-form with OPTIONS
+	r, err = parse("OPTIONS * HTTP/1.1")
+	require.NoError(t, err)
+	assert.Equal(t, TargetFormAsterisk, r.RequestLine.TargetForm)
+
+	// Test: Invalid targets
+	for _, requestLine := range []string{
+		"GET * HTTP/1.1",
+		"GET example.com:443 HTTP/1.1",
+		"GET relative/path HTTP/1.1",
+		"GET /bad%zzescape HTTP/1.1",
+		"GET http:/no-host HTTP/1.1",
+		"GET mailto:someone@example.com HTTP/1.1",
+		"CONNECT /path HTTP/1.1",
+		"CONNECT example.com HTTP/1.1",
+		"CONNECT example.com:http HTTP/1.1",
+		"CONNECT :443 HTTP/1.1",
+	} {
+		_, err = parse(requestLine)
+		assert.Error(t, err, requestLine)
+	}
+}
+
+func TestParseHTTP10Request(t *testing.T) {
+	// Test: HTTP/1.0 without a Host header
+	r, err := RequestFromReader(strings.NewReader("GET / HTTP/1.0\r\nUser-Agent: probe\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.RequestLine.HttpVersion)
+	assert.False(t, r.KeepAlive())
+
+	// Test: HTTP/1.0 asking for keep-alive
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n"))
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+
+	// Test: HTTP/1.1 keeps the connection unless told to close
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	assert.True(t, r.KeepAlive())
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+	assert.False(t, r.KeepAlive())
+
+	// Test: HTTP/1.1 requires exactly one Host header
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nUser-Agent: probe\r\n\r\n"))
+	require.Error(t, err)
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n"))
+	require.Error(t, err)
+
+	// Test: Other versions are still rejected
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/0.9\r\n\r\n"))
+	require.Error(t, err)
+	_, err = RequestFromReader(strings.NewReader("GET / HTTP/2.0\r\nHost: localhost\r\n\r\n"))
+	require.Error(t, err)
+}
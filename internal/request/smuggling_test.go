@@ -0,0 +1,133 @@
+package request
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readRequests reads every request in data from one connection, the way
+// the server would, and returns them along with the first error.
+func readRequests(data string, strict bool) ([]*Request, error) {
+	reader := NewReader(&chunkReader{data: data, numBytesPerRead: 7})
+	reader.Strict = strict
+	var reqs []*Request
+	for {
+		r, err := reader.ReadRequest()
+		if err != nil {
+			return reqs, err
+		}
+		reqs = append(reqs, r)
+	}
+}
+
+func TestStrictParsingRejectsSmuggling(t *testing.T) {
+	cases := []struct {
+		name	string
+		data	string
+	}{
+		{"CL.CL conflicting", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\nhello!"},
+		{"CL.CL identical", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello"},
+		{"CL list", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5, 5\r\n\r\nhello"},
+		{"CL.TE", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 6\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nG"},
+		{"TE.CL", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n8\r\nSMUGGLED\r\n0\r\n\r\n"},
+		{"TE.TE chunked twice", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked, chunked\r\n\r\n0\r\n\r\n"},
+		{"TE.TE identity last", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: identity\r\n\r\n0\r\n\r\n"},
+		{"TE misspelled", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: xchunked\r\n\r\n0\r\n\r\n"},
+		{"TE quoted", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: \"chunked\"\r\n\r\n0\r\n\r\n"},
+		{"TE space before colon", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding : chunked\r\n\r\n0\r\n\r\n"},
+		{"TE tab before colon", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding\t: chunked\r\n\r\n0\r\n\r\n"},
+		{"TE obs-fold", "POST / HTTP/1.1\r\nHost: a\r\nX-Padding: x\r\n Transfer-Encoding: chunked\r\n\r\n0\r\n\r\n"},
+		{"TE leading whitespace", "POST / HTTP/1.1\r\n Transfer-Encoding: chunked\r\nHost: a\r\n\r\n0\r\n\r\n"},
+		{"TE in HTTP/1.0", "POST / HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"},
+		{"CL with plus sign", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: +5\r\n\r\nhello"},
+		{"CL negative", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: -1\r\n\r\n"},
+		{"CL hex", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 0x5\r\n\r\nhello"},
+		{"CL trailing garbage", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5a\r\n\r\nhello"},
+		{"CL empty", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: \r\n\r\n"},
+		{"CL overflow", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 99999999999999999999\r\n\r\n"},
+		{"bare LF in headers", "POST / HTTP/1.1\r\nHost: a\nContent-Length: 5\r\n\r\nhello"},
+		{"bare LF ends headers", "GET / HTTP/1.1\r\nHost: a\r\n\n"},
+		{"bare LF request line", "GET / HTTP/1.1\nHost: a\r\n\r\n"},
+		{"bare CR in header", "POST / HTTP/1.1\r\nHost: a\rContent-Length: 5\r\n\r\nhello"},
+		{"NUL in header value", "GET / HTTP/1.1\r\nHost: a\x00b\r\n\r\n"},
+		{"bare LF after chunk data", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\n0\r\n\r\n"},
+		{"bare LF after chunk size", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\nhello\r\n0\r\n\r\n"},
+		{"chunk size whitespace", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5 \r\nhello\r\n0\r\n\r\n"},
+		{"chunk size hex prefix", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n0x5\r\nhello\r\n0\r\n\r\n"},
+		{"chunk size overflow", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\nfffffffffffffffff\r\nhello\r\n0\r\n\r\n"},
+		{"chunk size negative", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n-5\r\nhello\r\n0\r\n\r\n"},
+		{"request line double space", "GET  / HTTP/1.1\r\nHost: a\r\n\r\n"},
+		{"request line tab", "GET\t/ HTTP/1.1\r\nHost: a\r\n\r\n"},
+		{"duplicate Host", "GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			reqs, err := readRequests(c.data, true)
+			require.Error(t, err)
+			assert.Empty(t, reqs)
+		})
+	}
+}
+
+func TestStrictParsingAcceptsValidFraming(t *testing.T) {
+	// Test: Well formed requests still parse, pipelined
+	reqs, err := readRequests(
+		"POST /a HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\n\r\nhello"+
+			"POST /b HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5;ext=1\r\nworld\r\n0\r\nX-Sum: 1\r\n\r\n"+
+			"GET /c HTTP/1.1\r\nHost: a\r\nX-Tabbed:\tvalue\t\r\n\r\n", true)
+	require.Len(t, reqs, 3)
+	require.ErrorContains(t, err, "EOF")
+	assert.Equal(t, "hello", string(reqs[0].Body))
+	assert.Equal(t, "world", string(reqs[1].Body))
+	assert.Equal(t, "value", get(reqs[2].Headers, "x-tabbed"))
+}
+
+func TestLenientParsingFraming(t *testing.T) {
+	// Test: Transfer-Encoding wins over Content-Length, and the connection
+	// is not reused
+	reqs, _ := readRequests("POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 6\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nG", false)
+	require.Len(t, reqs, 1)
+	assert.Empty(t, reqs[0].Body)
+	assert.False(t, reqs[0].KeepAlive())
+
+	// Test: Identical repeated lengths are tolerated
+	reqs, _ = readRequests("POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello", false)
+	require.Len(t, reqs, 1)
+	assert.Equal(t, "hello", string(reqs[0].Body))
+
+	// Test: Conflicting or malformed lengths are never tolerated
+	for _, cl := range []string{"Content-Length: 5\r\nContent-Length: 6", "Content-Length: 5, 6", "Content-Length: +5", "Content-Length: 5a"} {
+		reqs, err := readRequests("POST / HTTP/1.1\r\nHost: a\r\n"+cl+"\r\n\r\nhello!", false)
+		require.Error(t, err, cl)
+		assert.Empty(t, reqs, cl)
+	}
+
+	// Test: A bare LF is rejected unless it is allowed
+	reqs, err := readRequests("POST / HTTP/1.1\nHost: a\nContent-Length: 5\n\nhello", false)
+	require.Error(t, err)
+	assert.Empty(t, reqs)
+
+	// Test: ...and then ends a line instead of hiding inside a value
+	reader := NewReader(strings.NewReader("POST / HTTP/1.1\nHost: a\nContent-Length: 5\n\nhello"))
+	reader.AllowBareLF = true
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "a", get(r.Headers, "host"))
+	assert.Equal(t, "hello", string(r.Body))
+
+	// Test: Strict parsing rejects it even when allowed
+	reader = NewReader(strings.NewReader("GET / HTTP/1.1\nHost: a\n\n"))
+	reader.Strict = true
+	reader.AllowBareLF = true
+	_, err = reader.ReadRequest()
+	require.Error(t, err)
+
+	// Test: A bare CR is rejected even when lenient
+	_, err = readRequests("GET / HTTP/1.1\r\nHost: a\rX: b\r\n\r\n", false)
+	require.Error(t, err)
+	assert.False(t, strings.Contains(err.Error(), "EOF"))
+}
@@ -0,0 +1,92 @@
+package request
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// TargetForm is which of the four request-target forms of RFC 9112
+// section 3.2 a request used.
+type TargetForm int
+
+const (
+	// TargetFormOrigin is an absolute path and optional query, "/a?b".
+	TargetFormOrigin TargetForm = iota
+	// TargetFormAbsolute is a full URI, as sent to proxies.
+	TargetFormAbsolute
+	// TargetFormAuthority is "host:port", used only by CONNECT.
+	TargetFormAuthority
+	// TargetFormAsterisk is "*", used only by server-wide OPTIONS.
+	TargetFormAsterisk
+)
+
+func (f TargetForm) String() string {
+	switch f {
+	case TargetFormOrigin:
+		return "origin-form"
+	case TargetFormAbsolute:
+		return "absolute-form"
+	case TargetFormAuthority:
+		return "authority-form"
+	case TargetFormAsterisk:
+		return "asterisk-form"
+	default:
+		return "unknown-form"
+	}
+}
+
+// parseRequestTarget classifies target and parses it into a URL. Which
+// forms are allowed depends on the method.
+func parseRequestTarget(method, target string) (TargetForm, *url.URL, error) {
+	switch {
+	case method == "CONNECT":
+		u, err := parseAuthorityForm(target)
+		return TargetFormAuthority, u, err
+	case target == "*":
+		if method != "OPTIONS" {
+			return 0, nil, fmt.Errorf("Error: asterisk-form target is only allowed with OPTIONS")
+		}
+		return TargetFormAsterisk, &url.URL{Path: "*"}, nil
+	case strings.HasPrefix(target, "/"):
+		u, err := url.ParseRequestURI(target)
+		if err != nil {
+			return 0, nil, fmt.Errorf("Error: invalid request target: %w", err)
+		}
+		return TargetFormOrigin, u, nil
+	default:
+		u, err := url.ParseRequestURI(target)
+		if err != nil {
+			return 0, nil, fmt.Errorf("Error: invalid request target: %w", err)
+		}
+		if u.Scheme == "" || u.Host == "" || u.Opaque != "" {
+			return 0, nil, fmt.Errorf("Error: invalid absolute-form target: %s", target)
+		}
+		return TargetFormAbsolute, u, nil
+	}
+}
+
+// parseAuthorityForm parses the "host:port" target of a CONNECT request.
+func parseAuthorityForm(target string) (*url.URL, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, fmt.Errorf("Error: invalid authority-form target: %s", target)
+	}
+	if host == "" || strings.ContainsAny(host, "/?#@") {
+		return nil, fmt.Errorf("Error: invalid authority-form target: %s", target)
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return nil, fmt.Errorf("Error: invalid port in authority-form target: %s", target)
+	}
+	return &url.URL{Host: target}, nil
+}
+
+// Query returns the decoded query parameters of the request target.
+func (r *Request) Query() url.Values {
+	if r.URL == nil {
+		return url.Values{}
+	}
+	return r.URL.Query()
+}
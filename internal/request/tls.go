@@ -0,0 +1,53 @@
+package request
+
+import (
+	"crypto/x509"
+)
+
+// VerifiedChain returns the client certificate chain the server verified,
+// leaf first, or nil if the client sent no certificate or it was not
+// verified.
+func (r *Request) VerifiedChain() []*x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0]
+}
+
+// ClientCertificate returns the verified client certificate, or nil.
+func (r *Request) ClientCertificate() *x509.Certificate {
+	chain := r.VerifiedChain()
+	if len(chain) == 0 {
+		return nil
+	}
+	return chain[0]
+}
+
+// ClientSubject returns the subject of the verified client certificate as
+// an RFC 2253 distinguished name, or "" without one.
+func (r *Request) ClientSubject() string {
+	cert := r.ClientCertificate()
+	if cert == nil {
+		return ""
+	}
+	return cert.Subject.String()
+}
+
+// ClientSANs returns the subject alternative names of the verified client
+// certificate: DNS names, email addresses, IP addresses and URIs.
+func (r *Request) ClientSANs() []string {
+	cert := r.ClientCertificate()
+	if cert == nil {
+		return nil
+	}
+	var sans []string
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	return sans
+}
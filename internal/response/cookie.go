@@ -0,0 +1,142 @@
+package response
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"voylento/httpfromtcp/internal/headers"
+)
+
+type SameSite int
+
+const (
+	// SameSiteDefault leaves the attribute out and the browser decides.
+	SameSiteDefault SameSite = iota
+	SameSiteLax
+	SameSiteStrict
+	SameSiteNone
+)
+
+// Cookie is a cookie to send to the client in a Set-Cookie header
+// (RFC 6265). Zero fields leave their attribute out.
+type Cookie struct {
+	Name		string
+	Value		string
+	Path		string
+	Domain		string
+	Expires		time.Time
+	// MaxAge is in seconds. Zero leaves the attribute out and a negative
+	// value sends Max-Age=0, telling the client to delete the cookie now.
+	MaxAge		int
+	Secure		bool
+	HttpOnly	bool
+	SameSite	SameSite
+	// Partitioned keeps the cookie in storage partitioned by top-level
+	// site (CHIPS). It requires Secure.
+	Partitioned	bool
+}
+
+// String serializes the cookie as the value of a Set-Cookie header.
+func (c *Cookie) String() (string, error) {
+	if !headers.ValidateHeaderName(c.Name) {
+		return "", fmt.Errorf("Error: invalid cookie name: %q", c.Name)
+	}
+	value, err := cookieValue(c.Value)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	b.WriteString(c.Name)
+	b.WriteString("=")
+	b.WriteString(value)
+
+	if c.Path != "" {
+		if !validAttributeValue(c.Path) {
+			return "", fmt.Errorf("Error: invalid cookie path: %q", c.Path)
+		}
+		b.WriteString("; Path=" + c.Path)
+	}
+	if c.Domain != "" {
+		domain := strings.TrimPrefix(c.Domain, ".")
+		if domain == "" || !validAttributeValue(domain) || strings.ContainsAny(domain, " \"") {
+			return "", fmt.Errorf("Error: invalid cookie domain: %q", c.Domain)
+		}
+		b.WriteString("; Domain=" + domain)
+	}
+	if !c.Expires.IsZero() {
+		b.WriteString("; Expires=" + c.Expires.UTC().Format(http.TimeFormat))
+	}
+	if c.MaxAge > 0 {
+		b.WriteString("; Max-Age=" + strconv.Itoa(c.MaxAge))
+	} else if c.MaxAge < 0 {
+		b.WriteString("; Max-Age=0")
+	}
+	if c.HttpOnly {
+		b.WriteString("; HttpOnly")
+	}
+	if c.Secure {
+		b.WriteString("; Secure")
+	}
+	switch c.SameSite {
+	case SameSiteLax:
+		b.WriteString("; SameSite=Lax")
+	case SameSiteStrict:
+		b.WriteString("; SameSite=Strict")
+	case SameSiteNone:
+		b.WriteString("; SameSite=None")
+	}
+	if c.Partitioned {
+		if !c.Secure {
+			return "", fmt.Errorf("Error: partitioned cookie %q must be secure", c.Name)
+		}
+		b.WriteString("; Partitioned")
+	}
+	return b.String(), nil
+}
+
+// SetCookie adds a Set-Cookie header for c. Each cookie gets a field line
+// of its own, since Set-Cookie values cannot be combined with commas.
+func SetCookie(h *headers.Headers, c *Cookie) error {
+	value, err := c.String()
+	if err != nil {
+		return err
+	}
+	h.Add("Set-Cookie", value)
+	return nil
+}
+
+// cookieValue checks a cookie value is made of cookie-octets, quoting it
+// if it has a space or comma, which browsers accept inside quotes.
+func cookieValue(value string) (string, error) {
+	quote := false
+	for i := 0; i < len(value); i++ {
+		b := value[i]
+		switch {
+		case b == ' ' || b == ',':
+			quote = true
+		case b == 0x21 || (b >= 0x23 && b <= 0x2B) || (b >= 0x2D && b <= 0x3A) ||
+			(b >= 0x3C && b <= 0x5B) || (b >= 0x5D && b <= 0x7E):
+		default:
+			return "", fmt.Errorf("Error: invalid byte %q in cookie value", b)
+		}
+	}
+	if quote {
+		return `"` + value + `"`, nil
+	}
+	return value, nil
+}
+
+// validAttributeValue reports whether v can go in a cookie attribute: no
+// control characters and no semicolons.
+func validAttributeValue(v string) bool {
+	for i := 0; i < len(v); i++ {
+		if v[i] < 0x20 || v[i] == 0x7F || v[i] == ';' {
+			return false
+		}
+	}
+	return true
+}
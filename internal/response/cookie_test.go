@@ -0,0 +1,87 @@
+package response
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"voylento/httpfromtcp/internal/headers"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCookieString(t *testing.T) {
+	// Test: Bare name and value
+	s, err := (&Cookie{Name: "id", Value: "abc"}).String()
+	require.NoError(t, err)
+	assert.Equal(t, "id=abc", s)
+
+	// Test: Every attribute
+	s, err = (&Cookie{
+		Name:		"session",
+		Value:		"a1b2",
+		Path:		"/app",
+		Domain:		".example.com",
+		Expires:	time.Date(2030, 1, 2, 3, 4, 5, 0, time.FixedZone("X", 3600)),
+		MaxAge:		3600,
+		Secure:		true,
+		HttpOnly:	true,
+		SameSite:	SameSiteStrict,
+		Partitioned:	true,
+	}).String()
+	require.NoError(t, err)
+	assert.Equal(t, "session=a1b2; Path=/app; Domain=example.com; Expires=Wed, 02 Jan 2030 02:04:05 GMT; "+
+		"Max-Age=3600; HttpOnly; Secure; SameSite=Strict; Partitioned", s)
+
+	// Test: Negative MaxAge deletes the cookie, SameSite values
+	s, err = (&Cookie{Name: "id", MaxAge: -1, SameSite: SameSiteLax}).String()
+	require.NoError(t, err)
+	assert.Equal(t, "id=; Max-Age=0; SameSite=Lax", s)
+	s, err = (&Cookie{Name: "id", Value: "x", Secure: true, SameSite: SameSiteNone}).String()
+	require.NoError(t, err)
+	assert.Equal(t, "id=x; Secure; SameSite=None", s)
+
+	// Test: Values with spaces or commas are quoted
+	s, err = (&Cookie{Name: "id", Value: "a b,c"}).String()
+	require.NoError(t, err)
+	assert.Equal(t, `id="a b,c"`, s)
+
+	// Test: Invalid cookies
+	for _, c := range []*Cookie{
+		{Name: "", Value: "x"},
+		{Name: "a b", Value: "x"},
+		{Name: "id", Value: "a;b"},
+		{Name: "id", Value: `a"b`},
+		{Name: "id", Value: "a\r\nb"},
+		{Name: "id", Path: "/a;b"},
+		{Name: "id", Domain: "."},
+		{Name: "id", Domain: "exa mple.com"},
+		{Name: "id", Partitioned: true},
+	} {
+		_, err := c.String()
+		assert.Error(t, err, "%+v", c)
+	}
+}
+
+func TestSetCookie(t *testing.T) {
+	// Test: Each cookie goes out as its own Set-Cookie line
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	h := headers.NewHeaders()
+	require.NoError(t, SetCookie(h, &Cookie{Name: "a", Value: "1", Expires: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)}))
+	require.NoError(t, SetCookie(h, &Cookie{Name: "b", Value: "2", HttpOnly: true}))
+	h.Set("content-length", "0")
+	require.NoError(t, w.WriteStatusLine(StatusCodeSuccess))
+	require.NoError(t, w.WriteHeaders(h))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Set-Cookie: a=1; Expires=Tue, 01 Jan 2030 00:00:00 GMT\r\n"+
+		"Set-Cookie: b=2; HttpOnly\r\n"+
+		"Content-Length: 0\r\n"+
+		"\r\n", buf.String())
+
+	// Test: An invalid cookie adds nothing
+	h = headers.NewHeaders()
+	assert.Error(t, SetCookie(h, &Cookie{Name: "a;"}))
+	assert.Equal(t, 0, h.Len())
+}
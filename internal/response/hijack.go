@@ -0,0 +1,57 @@
+package response
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+var (
+	ErrHijacked			= errors.New("connection has been hijacked")
+	ErrNotHijackable	= errors.New("connection cannot be hijacked")
+)
+
+// EnableHijack lets the handler take the connection over with Hijack.
+// buffered returns the bytes the server has already read from conn past
+// the request.
+func (w *Writer) EnableHijack(conn net.Conn, buffered func() []byte) {
+	w.conn = conn
+	w.buffered = buffered
+}
+
+// Hijack hands the connection over to the caller, who becomes responsible
+// for closing it. The server neither writes nor reads anything more on it.
+// The returned reader yields any bytes the server had already read past
+// the request before reading from the connection. A response started
+// before hijacking must have been sent in full, so a handler switching
+// protocols can write the 101 status line and headers through the Writer
+// first.
+func (w *Writer) Hijack() (net.Conn, *bufio.Reader, error) {
+	if w.hijacked {
+		return nil, nil, ErrHijacked
+	}
+	if w.conn == nil {
+		return nil, nil, ErrNotHijackable
+	}
+	if w.pendingHeaders != nil {
+		return nil, nil, fmt.Errorf("Error: %w: part of the response is still buffered", ErrNotHijackable)
+	}
+	w.hijacked = true
+	w.State = WriteStateDone
+	w.conn.SetDeadline(time.Time{})
+
+	var r io.Reader = w.conn
+	if buffered := w.buffered(); len(buffered) > 0 {
+		r = io.MultiReader(bytes.NewReader(buffered), w.conn)
+	}
+	return w.conn, bufio.NewReader(r), nil
+}
+
+// Hijacked reports whether the handler took the connection over.
+func (w *Writer) Hijacked() bool {
+	return w.hijacked
+}
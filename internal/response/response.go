@@ -1,15 +1,37 @@
 package response
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
 
 	"voylento/httpfromtcp/internal/headers"
 )
 
 const crlf = "\r\n"
 
+// maxBufferedBody is how much of a response body the writer holds back
+// while it still hopes to send a Content-Length. Past it the response
+// switches to chunked encoding.
+const maxBufferedBody = 4 << 10
+
+var (
+	// ErrBodyTooLong is returned for a write that would take the body past
+	// its declared Content-Length. Nothing of the write is sent.
+	ErrBodyTooLong	= errors.New("body longer than the declared Content-Length")
+	// ErrBodyTooShort is returned by Finish when the handler wrote less than
+	// the declared Content-Length. The connection cannot be reused.
+	ErrBodyTooShort	= errors.New("body shorter than the declared Content-Length")
+	// ErrBodyNotAllowed is returned for a body written to a response whose
+	// status cannot have one: 1xx, 204 and 304.
+	ErrBodyNotAllowed	= errors.New("response status does not allow a body")
+)
+
 type WriteState int
 const (
 	WriteStateStatusLine WriteState = iota
@@ -22,15 +44,68 @@ const (
 type Writer struct {
 	Writer 	io.Writer
 	State	WriteState
+	statusCode	StatusCode
+	bytesWritten	int64
+	chunked		bool
+	closeAfter	bool
+	// unchunked is set when chunked writes are sent as a raw body because
+	// the client speaks HTTP/1.0
+	unchunked	bool
+	httpVersion	string
+	requestKeepAlive	bool
+	// pendingHeaders holds headers that declared no framing, so the body
+	// can be buffered until its length is known or it grows too large
+	pendingHeaders	*headers.Headers
+	buf				[]byte
+	// contentLength is the declared length of the body, or -1
+	contentLength	int64
+	// head is set when answering a HEAD request, whose response has the
+	// headers of a GET but no body
+	head			bool
+	// conn and buffered are set by EnableHijack
+	conn			net.Conn
+	buffered		func() []byte
+	hijacked		bool
+	// stream is set by NewStreamWriter, and trailers are what the handler
+	// wrote for it to send on Close
+	stream			StreamWriter
+	streamClosed	bool
+	trailers		[]headers.Field
 }
 
 func NewWriter(w io.Writer) *Writer {
 	return &Writer{
 		State: WriteStateStatusLine,
 		Writer: w,
+		httpVersion: "1.1",
+		requestKeepAlive: true,
+		contentLength: -1,
 	}
 }
 
+// SetRequestProto tells the writer the HTTP version of the request it is
+// answering, and whether the client is willing to keep the connection
+// open. It must be called before the status line is written.
+func (w *Writer) SetRequestProto(httpVersion string, keepAlive bool) {
+	w.httpVersion = httpVersion
+	w.requestKeepAlive = keepAlive
+}
+
+// SetRequestMethod tells the writer the method of the request it is
+// answering. For HEAD, everything the handler writes to the body is
+// dropped, but still counted, so the headers match those of a GET.
+func (w *Writer) SetRequestMethod(method string) {
+	w.head = method == "HEAD"
+}
+
+// body is where the body goes: the connection, or nowhere for HEAD.
+func (w *Writer) body() io.Writer {
+	if w.head {
+		return io.Discard
+	}
+	return w.Writer
+}
+
 func writeStateToString(state WriteState) string {
 	switch state{
 	case WriteStateStatusLine:
@@ -49,59 +124,443 @@ func writeStateToString(state WriteState) string {
 }
 
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+	return w.WriteStatusLineWithReason(statusCode, StatusText(statusCode))
+}
+
+// WriteStatusLineWithReason writes a status line with a custom reason
+// phrase in place of the standard one.
+func (w *Writer) WriteStatusLineWithReason(statusCode StatusCode, reasonPhrase string) error {
+	if w.hijacked {
+		return ErrHijacked
+	}
 	if w.State != WriteStateStatusLine {
-		return fmt.Errorf("Error: attempting to write status line when state is %x", writeStateToString(w.State))
+		return fmt.Errorf("Error: attempting to write status line when state is %s", writeStateToString(w.State))
+	}
+	if err := validateStatusLine(statusCode, reasonPhrase); err != nil {
+		return err
 	}
 	defer func() {w.State = WriteStateHeaders}()
-	_, err := w.Writer.Write(getStatusLine(statusCode))
+	w.statusCode = statusCode
+	if w.stream != nil {
+		// a stream has no status line, the status goes with the headers
+		return nil
+	}
+	_, err := w.Writer.Write(getStatusLine(w.httpVersion, statusCode, reasonPhrase))
+	return err
+}
+
+// WriteInformational sends an interim 1xx response, such as 100 Continue
+// or 103 Early Hints, ahead of the final one. It leaves the writer ready
+// for the final status line. h may be nil.
+func (w *Writer) WriteInformational(statusCode StatusCode, h *headers.Headers) error {
+	if w.State != WriteStateStatusLine {
+		return fmt.Errorf("Error: attempting to write informational response when state is %s", writeStateToString(w.State))
+	}
+	if statusCode < 100 || statusCode > 199 {
+		return fmt.Errorf("Error: not an informational status code: %d", statusCode)
+	}
+	if w.httpVersion == "1.0" {
+		// HTTP/1.0 clients do not expect interim responses
+		return nil
+	}
+	if w.stream != nil {
+		return w.writeStreamHeaders(statusCode, h)
+	}
+	if _, err := w.Writer.Write(getStatusLine(w.httpVersion, statusCode, StatusText(statusCode))); err != nil {
+		return err
+	}
+	if h != nil {
+		for _, f := range h.Raw() {
+			canonicalName := http.CanonicalHeaderKey(f.Name)
+			if _, err := fmt.Fprintf(w.Writer, "%s: %s%s", canonicalName, f.Value, crlf); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := fmt.Fprintf(w.Writer, crlf)
 	return err
 }
 
-func (w *Writer) WriteHeaders(h headers.Headers) error {
+// WriteHeaders writes the response headers. Headers with neither a
+// Content-Length nor a Transfer-Encoding are held back, and the writer
+// frames the body itself: see Write.
+func (w *Writer) WriteHeaders(h *headers.Headers) error {
 	if w.State != WriteStateHeaders {
 		return fmt.Errorf("Error: attempting to write headers when state is %s", writeStateToString(w.State)) 
 	}
+	if w.hasBody() && !hasFraming(h) {
+		w.pendingHeaders = headers.NewHeaders()
+		for _, f := range h.Raw() {
+			w.pendingHeaders.Add(f.Name, f.Value)
+		}
+		w.State = WriteStateBody
+		return nil
+	}
+	return w.writeHeaders(h)
+}
+
+func (w *Writer) writeHeaders(h *headers.Headers) error {
+	contentLength, err := declaredLength(h)
+	if err != nil {
+		return err
+	}
+	w.contentLength = contentLength
 	defer func() {w.State = WriteStateBody}()
-	for k, v := range h {
-		canonicalName := http.CanonicalHeaderKey(k)
-		_, err := fmt.Fprintf(w.Writer, "%s: %s%s", canonicalName, v, crlf)
+	if w.stream != nil {
+		// the stream frames the body, so a chunked one is sent as is
+		w.unchunked = h.HasToken("transfer-encoding", "chunked")
+		return w.writeStreamHeaders(w.statusCode, h)
+	}
+	for _, f := range w.prepareHeaders(h) {
+		canonicalName := http.CanonicalHeaderKey(f.Name)
+		_, err := fmt.Fprintf(w.Writer, "%s: %s%s", canonicalName, f.Value, crlf)
 		if err != nil {
 			return err
 		}
 	}
-	_, err := fmt.Fprintf(w.Writer, crlf)
+	_, err = fmt.Fprintf(w.Writer, crlf)
 	return err
 }
 
-func (w *Writer) WriteBody(p []byte) (int, error) {
+// declaredLength returns the Content-Length in h, or -1 if there is none
+// or the body is chunked.
+func declaredLength(h *headers.Headers) (int64, error) {
+	value, exists := h.Get("content-length")
+	if !exists || h.HasToken("transfer-encoding", "chunked") {
+		return -1, nil
+	}
+	if value == "" || strings.Trim(value, "0123456789") != "" {
+		return 0, fmt.Errorf("Error: invalid Content-Length: %q", value)
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Error: invalid Content-Length: %q", value)
+	}
+	return n, nil
+}
+
+// prepareHeaders records how the body of the response is delimited, so the
+// server knows whether the connection can carry another response. It
+// returns the fields to send, adjusted for the client's HTTP version.
+func (w *Writer) prepareHeaders(h *headers.Headers) []headers.Field {
+	fields := h.Raw()
+	w.chunked = h.HasToken("transfer-encoding", "chunked")
+	w.closeAfter = h.HasToken("connection", "close") || !w.requestKeepAlive
+	if w.chunked && w.httpVersion == "1.0" {
+		// HTTP/1.0 has no chunked coding, so the body goes out as is and
+		// closing the connection marks its end
+		fields = withoutFields(fields, "transfer-encoding", "trailer")
+		w.chunked = false
+		w.unchunked = true
+	}
+	if _, exists := h.Get("content-length"); !exists && !w.chunked && w.hasBody() && !w.head {
+		// without a length or chunked coding the client reads until close
+		w.closeAfter = true
+	}
+
+	if _, exists := h.Get("connection"); !exists {
+		if w.closeAfter {
+			fields = append(fields, headers.Field{Name: "Connection", Value: "close"})
+		} else if w.httpVersion == "1.0" {
+			fields = append(fields, headers.Field{Name: "Connection", Value: "keep-alive"})
+		}
+	}
+	return fields
+}
+
+func hasFraming(h *headers.Headers) bool {
+	_, hasLength := h.Get("content-length")
+	_, hasEncoding := h.Get("transfer-encoding")
+	return hasLength || hasEncoding
+}
+
+func withoutFields(fields []headers.Field, names ...string) []headers.Field {
+	var kept []headers.Field
+	for _, f := range fields {
+		if !slices.ContainsFunc(names, func(name string) bool { return strings.EqualFold(name, f.Name) }) {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+func (w *Writer) hasBody() bool {
+	code := w.statusCode
+	return !(code >= 100 && code < 200) && code != 204 && code != 304
+}
+
+// KeepAlive reports whether the connection can be reused once the handler
+// is done with this response.
+func (w *Writer) KeepAlive() bool {
+	if w.State == WriteStateStatusLine || w.State == WriteStateHeaders {
+		return false
+	}
+	if w.closeAfter || w.pendingHeaders != nil {
+		return false
+	}
+	if w.chunked && w.State != WriteStateDone {
+		return false
+	}
+	return true
+}
+
+// StatusCode returns the status code written so far, or 0 if the status
+// line has not been written.
+func (w *Writer) StatusCode() StatusCode {
+	return w.statusCode
+}
+
+// BytesWritten returns the number of body bytes written so far, not
+// counting chunked framing.
+func (w *Writer) BytesWritten() int64 {
+	return w.bytesWritten
+}
+
+// Write writes p as part of the response body, so a Writer can be handed
+// to anything that takes an io.Writer. It sends a 200 status line and
+// headers first if the handler has not. When the headers declared no
+// framing, the body is buffered and sent with a Content-Length once the
+// handler is done, unless it outgrows the buffer or is flushed, in which
+// case it goes out chunked. A chunked response is chunked by Write too.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.hijacked {
+		return 0, ErrHijacked
+	}
+	if err := w.writeImplicitHeaders(); err != nil {
+		return 0, err
+	}
 	if w.State != WriteStateBody {
 		return 0, fmt.Errorf("Error: attempting to write body when state is %s", writeStateToString(w.State))
 	}
-	defer func() {w.State = WriteStateTrailers}()
-	return w.Writer.Write(p)
+	if err := w.checkBodyAllowed(p); err != nil {
+		return 0, err
+	}
+	if w.pendingHeaders != nil {
+		if len(w.buf)+len(p) <= maxBufferedBody {
+			w.buf = append(w.buf, p...)
+			w.bytesWritten += int64(len(p))
+			return len(p), nil
+		}
+		if err := w.startChunked(p); err != nil {
+			return 0, err
+		}
+	}
+	return w.writeBody(p)
+}
+
+// checkBodyAllowed refuses body bytes for a status that has no body, since
+// the client would read them as the start of the next response.
+func (w *Writer) checkBodyAllowed(p []byte) error {
+	if len(p) > 0 && !w.hasBody() {
+		return fmt.Errorf("Error: %w: writing %d bytes to a %d response", ErrBodyNotAllowed, len(p), w.statusCode)
+	}
+	return nil
+}
+
+// WriteBody writes part of the response body. It may be called any number
+// of times, and behaves like Write.
+func (w *Writer) WriteBody(p []byte) (int, error) {
+	return w.Write(p)
+}
+
+// Flush sends everything written so far. A response whose length is not
+// known yet switches to chunked encoding.
+func (w *Writer) Flush() error {
+	if err := w.writeImplicitHeaders(); err != nil {
+		return err
+	}
+	if w.pendingHeaders != nil {
+		if err := w.startChunked(nil); err != nil {
+			return err
+		}
+	}
+	if f, ok := w.Writer.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Finish completes the response once the handler is done with it. A
+// buffered body is sent with its Content-Length, and a chunked body gets
+// its final chunk. The server calls it after the handler returns.
+func (w *Writer) Finish() error {
+	switch w.State {
+	case WriteStateStatusLine:
+		return nil
+	case WriteStateDone:
+		// the handler ended the body itself
+		if err := w.checkShortBody(); err != nil {
+			return err
+		}
+		return w.closeStream()
+	case WriteStateHeaders:
+		if err := w.WriteHeaders(headers.NewHeaders()); err != nil {
+			return err
+		}
+	}
+
+	if w.pendingHeaders != nil {
+		h := w.pendingHeaders
+		w.pendingHeaders = nil
+		setContentType(h, w.buf)
+		h.Set("Content-Length", strconv.Itoa(len(w.buf)))
+		if err := w.writeHeaders(h); err != nil {
+			return err
+		}
+		_, err := w.body().Write(w.buf)
+		w.buf = nil
+		if err != nil {
+			return err
+		}
+	}
+	if w.State == WriteStateBody && (w.chunked || w.unchunked) {
+		if _, err := w.WriteChunkedBodyDone(); err != nil {
+			return err
+		}
+	}
+	if w.State == WriteStateTrailers {
+		if err := w.FinalizeChunkedResponse(); err != nil {
+			return err
+		}
+	}
+	w.State = WriteStateDone
+	if err := w.checkShortBody(); err != nil {
+		return err
+	}
+	return w.closeStream()
+}
+
+// checkShortBody reports a body that ended before its declared length.
+func (w *Writer) checkShortBody() error {
+	if w.contentLength >= 0 && w.bytesWritten < w.contentLength && w.hasBody() && !w.head {
+		// the client is still waiting for the rest of the body, and only
+		// closing the connection tells it none is coming
+		w.closeAfter = true
+		return fmt.Errorf("Error: %w: wrote %d of %d bytes", ErrBodyTooShort, w.bytesWritten, w.contentLength)
+	}
+	return nil
+}
+
+// writeImplicitHeaders sends a 200 status line and empty headers for a
+// handler that starts writing the body without them.
+func (w *Writer) writeImplicitHeaders() error {
+	if w.State == WriteStateStatusLine {
+		if err := w.WriteStatusLine(StatusCodeSuccess); err != nil {
+			return err
+		}
+	}
+	if w.State == WriteStateHeaders {
+		return w.WriteHeaders(headers.NewHeaders())
+	}
+	return nil
+}
+
+// startChunked gives up on buffering: the held back headers go out with
+// chunked encoding, followed by the buffered body. next is the write that
+// did not fit, used to guess the content type if nothing was buffered.
+func (w *Writer) startChunked(next []byte) error {
+	h := w.pendingHeaders
+	w.pendingHeaders = nil
+	setContentType(h, append(w.buf, next...))
+	h.Set("Transfer-Encoding", "chunked")
+	if err := w.writeHeaders(h); err != nil {
+		return err
+	}
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	// the buffered bytes were already counted when they were written
+	if !w.chunked {
+		_, err := w.body().Write(buf)
+		return err
+	}
+	_, err := w.writeChunk(buf)
+	return err
+}
+
+// setContentType fills in a missing Content-Type by sniffing the body.
+func setContentType(h *headers.Headers, body []byte) {
+	if _, exists := h.Get("content-type"); exists || len(body) == 0 {
+		return
+	}
+	h.Set("Content-Type", http.DetectContentType(body))
+}
+
+func (w *Writer) writeBody(p []byte) (int, error) {
+	if w.contentLength >= 0 && w.bytesWritten+int64(len(p)) > w.contentLength {
+		return 0, fmt.Errorf("Error: %w: writing %d bytes after %d of %d", ErrBodyTooLong, len(p), w.bytesWritten, w.contentLength)
+	}
+	var n int
+	var err error
+	if w.chunked {
+		n, err = w.writeChunk(p)
+	} else {
+		n, err = w.body().Write(p)
+	}
+	w.bytesWritten += int64(n)
+	return n, err
+}
+
+// writeChunk writes p as a single chunk and returns how much of p was
+// written. Empty writes send nothing, since an empty chunk ends the body.
+func (w *Writer) writeChunk(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if _, err := fmt.Fprintf(w.body(), "%X\r\n", len(p)); err != nil {
+		return 0, err
+	}
+	n, err := w.body().Write(p)
+	if err != nil {
+		return n, err
+	}
+	_, err = w.body().Write([]byte(crlf))
+	return n, err
 }
 
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 	if w.State != WriteStateBody {
 		return 0, fmt.Errorf("Error: attempting to write body when state is %s", writeStateToString(w.State))
 	}
+	if err := w.checkBodyAllowed(p); err != nil {
+		return 0, err
+	}
+
+	if w.pendingHeaders != nil {
+		if err := w.startChunked(p); err != nil {
+			return 0, err
+		}
+	}
+	if !w.chunked {
+		// the headers did not ask for chunked coding, so the body goes out
+		// as is, held to its Content-Length if it declared one
+		return w.writeBody(p)
+	}
+	if len(p) == 0 {
+		// an empty chunk would end the body; that is left to
+		// WriteChunkedBodyDone and Finish
+		return 0, nil
+	}
 
 	chunkSize := len(p)
 	nTotal := 0
 
-	n, err := fmt.Fprintf(w.Writer, "%X\r\n", chunkSize)
+	n, err := fmt.Fprintf(w.body(), "%X\r\n", chunkSize)
 	if err != nil {
 		return nTotal, err
 	}
 	nTotal += n
 
-	n, err = w.Writer.Write(p)
+	n, err = w.body().Write(p)
+	w.bytesWritten += int64(n)
 	if err != nil {
 		return nTotal, err
 	}
 	nTotal += n
 
-	n, err = fmt.Fprintf(w.Writer, "\r\n")
+	n, err = fmt.Fprintf(w.body(), "\r\n")
 	if err != nil {
 		return nTotal, err
 	}
@@ -110,14 +569,26 @@ func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
 }
 
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
+	if w.pendingHeaders != nil {
+		if err := w.startChunked(nil); err != nil {
+			return 0, err
+		}
+	}
 	defer func() {w.State = WriteStateTrailers}()
-	return w.Writer.Write([]byte("0\r\n"))
+	if !w.chunked {
+		return 0, nil
+	}
+	return w.body().Write([]byte("0\r\n"))
 }
 
 func (w *Writer) FinalizeChunkedResponse() error {
+	if w.State == WriteStateTrailers && !w.chunked {
+		w.State = WriteStateDone
+		return nil
+	}
 	if w.State == WriteStateTrailers {
 		// No trailers were written, so write the final crlf
-		_, err := w.Writer.Write([]byte(crlf))
+		_, err := w.body().Write([]byte(crlf))
 		if err != nil {
 			return err
 		}
@@ -126,20 +597,58 @@ func (w *Writer) FinalizeChunkedResponse() error {
 	return nil
 }
 
-func (w *Writer) WriteTrailers(h headers.Headers) error {
+// WriteTrailers ends a chunked body with trailer fields. If the body is
+// still being written it is ended first, switching to chunked encoding if
+// the writer had not yet picked the framing.
+func (w *Writer) WriteTrailers(h *headers.Headers) error {
+	if w.State == WriteStateBody && (w.pendingHeaders != nil || w.chunked || w.unchunked) {
+		if _, err := w.WriteChunkedBodyDone(); err != nil {
+			return err
+		}
+	}
 	if w.State != WriteStateTrailers {
 		return fmt.Errorf("Error: attempting to write trailers when state is %s", writeStateToString(w.State))
 	}
 	defer func() { w.State = WriteStateDone }()
-	for k, v := range h {
-		canonicalName := http.CanonicalHeaderKey(k)
-		fmt.Printf("Writing trailer: %s: %s%s", canonicalName, v, crlf)
-		_, err := fmt.Fprintf(w.Writer, "%s: %s%s", canonicalName, v, crlf)
+	if w.stream != nil {
+		w.trailers = nil
+		for _, f := range h.Raw() {
+			w.trailers = append(w.trailers, headers.Field{Name: strings.ToLower(f.Name), Value: f.Value})
+		}
+		return w.closeStream()
+	}
+	if !w.chunked {
+		// there is nowhere to put trailers without chunked coding
+		return nil
+	}
+	for _, f := range h.Raw() {
+		canonicalName := http.CanonicalHeaderKey(f.Name)
+		_, err := fmt.Fprintf(w.body(), "%s: %s%s", canonicalName, f.Value, crlf)
 		if err != nil {
 			return err
 		}
 	}
 
-	_, err := fmt.Fprintf(w.Writer, crlf)
+	_, err := fmt.Fprintf(w.body(), crlf)
+	return err
+}
+
+// WriteStatus writes a complete plain-text response whose body is the
+// status code and its text, with any extra headers from h.
+func WriteStatus(w *Writer, statusCode StatusCode, h *headers.Headers) error {
+	body := []byte(fmt.Sprintf("%d %s\n", statusCode, StatusText(statusCode)))
+	fields := GetDefaultHeaders(len(body))
+	if h != nil {
+		for _, f := range h.Raw() {
+			fields.Set(f.Name, f.Value)
+		}
+	}
+	if err := w.WriteStatusLine(statusCode); err != nil {
+		return err
+	}
+	if err := w.WriteHeaders(fields); err != nil {
+		return err
+	}
+	_, err := w.WriteBody(body)
 	return err
 }
@@ -0,0 +1,393 @@
+package response
+
+import (
+	"bytes"
+	"testing"
+
+	"voylento/httpfromtcp/internal/headers"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteHeaders(t *testing.T) {
+	// Test: Headers are written in the order they were added
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	h := headers.NewHeaders()
+	h.Add("content-type", "text/plain")
+	h.Add("set-cookie", "a=1")
+	h.Add("x-request-id", "42")
+	h.Add("set-cookie", "b=2")
+	h.Add("content-length", "0")
+	require.NoError(t, w.WriteStatusLine(StatusCodeSuccess))
+	require.NoError(t, w.WriteHeaders(h))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"Set-Cookie: a=1\r\n"+
+		"X-Request-Id: 42\r\n"+
+		"Set-Cookie: b=2\r\n"+
+		"Content-Length: 0\r\n"+
+		"\r\n", buf.String())
+}
+
+func TestWriteHTTP10Response(t *testing.T) {
+	// Test: HTTP/1.0 status line, and keep-alive spelled out when asked for
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetRequestProto("1.0", true)
+	require.NoError(t, w.WriteStatusLine(StatusCodeSuccess))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(2)))
+	_, err := w.WriteBody([]byte("hi"))
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.0 200 OK\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"Content-Length: 2\r\n"+
+		"Connection: keep-alive\r\n"+
+		"\r\n"+
+		"hi", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Chunked responses fall back to a close-delimited body
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetRequestProto("1.0", true)
+	h := GetDefaultHeadersForChunkEncoding()
+	h.Set("Trailer", "X-Sum")
+	require.NoError(t, w.WriteStatusLine(StatusCodeSuccess))
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBody([]byte("hello "))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte("world"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Sum", "abc")
+	require.NoError(t, w.WriteTrailers(trailers))
+	require.NoError(t, w.FinalizeChunkedResponse())
+	assert.Equal(t, "HTTP/1.0 200 OK\r\n"+
+		"Content-Type: application/json\r\n"+
+		"Connection: close\r\n"+
+		"\r\n"+
+		"hello world", buf.String())
+	assert.False(t, w.KeepAlive())
+
+	// Test: HTTP/1.1 client asking to close is told the connection closes
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetRequestProto("1.1", false)
+	require.NoError(t, w.WriteStatusLine(StatusCodeNoContent))
+	require.NoError(t, w.WriteHeaders(headers.NewHeaders()))
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\nConnection: close\r\n\r\n", buf.String())
+	assert.False(t, w.KeepAlive())
+}
+
+func TestWriterFramesBody(t *testing.T) {
+	// Test: Small bodies are buffered and sent with a Content-Length
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	_, err := w.Write([]byte("<html>"))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("</html>"))
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", buf.String())
+	assert.False(t, w.KeepAlive())
+	assert.Equal(t, int64(13), w.BytesWritten())
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Content-Type: text/html; charset=utf-8\r\n"+
+		"Content-Length: 13\r\n"+
+		"\r\n"+
+		"<html></html>", buf.String())
+	assert.True(t, w.KeepAlive())
+	assert.Equal(t, WriteStateDone, w.State)
+
+	// Test: Bodies past the buffer switch to chunked encoding
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusCodeSuccess))
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/plain")
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.Write(bytes.Repeat([]byte("a"), maxBufferedBody))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("bc"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"Transfer-Encoding: chunked\r\n"+
+		"\r\n"+
+		"1000\r\n"+string(bytes.Repeat([]byte("a"), maxBufferedBody))+"\r\n"+
+		"2\r\nbc\r\n"+
+		"0\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+	assert.Equal(t, int64(maxBufferedBody+2), w.BytesWritten())
+
+	// Test: An empty chunked write sends nothing, rather than the chunk
+	// that ends the body
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusCodeSuccess))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeadersForChunkEncoding()))
+	buf.Reset()
+	n, err := w.WriteChunkedBody(nil)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Empty(t, buf.String())
+	_, err = w.WriteChunkedBody([]byte("more"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "4\r\nmore\r\n0\r\n\r\n", buf.String())
+
+	// Test: Flush switches to chunked encoding, and trailers can follow
+	buf.Reset()
+	w = NewWriter(&buf)
+	_, err = w.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	_, err = w.Write([]byte(" world"))
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Sum", "abc")
+	require.NoError(t, w.WriteTrailers(trailers))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"Transfer-Encoding: chunked\r\n"+
+		"\r\n"+
+		"5\r\nhello\r\n"+
+		"6\r\n world\r\n"+
+		"0\r\nX-Sum: abc\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Declared chunked encoding is applied by Write
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusCodeSuccess))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeadersForChunkEncoding()))
+	_, err = w.Write([]byte("{}"))
+	require.NoError(t, err)
+	_, err = w.Write(nil)
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Transfer-Encoding: chunked\r\n"+
+		"Content-Type: application/json\r\n"+
+		"\r\n"+
+		"2\r\n{}\r\n"+
+		"0\r\n\r\n", buf.String())
+
+	// Test: Declared Content-Length bodies can take several writes
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusCodeSuccess))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(4)))
+	_, err = w.WriteBody([]byte("ab"))
+	require.NoError(t, err)
+	_, err = w.WriteBody([]byte("cd"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"Content-Length: 4\r\n"+
+		"\r\n"+
+		"abcd", buf.String())
+
+	// Test: HTTP/1.0 bodies past the buffer are delimited by closing
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetRequestProto("1.0", true)
+	_, err = w.Write(bytes.Repeat([]byte("a"), maxBufferedBody+1))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.0 200 OK\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"Connection: close\r\n"+
+		"\r\n"+
+		string(bytes.Repeat([]byte("a"), maxBufferedBody+1)), buf.String())
+	assert.False(t, w.KeepAlive())
+
+	// Test: A status line alone is finished with an empty body
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusCodeAccepted))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 202 Accepted\r\nContent-Length: 0\r\n\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+}
+
+func TestWriterEnforcesContentLength(t *testing.T) {
+	// Test: Writes past the declared length are refused whole
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusCodeSuccess))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	_, err := w.Write([]byte("abc"))
+	require.NoError(t, err)
+	n, err := w.Write([]byte("def"))
+	assert.ErrorIs(t, err, ErrBodyTooLong)
+	assert.Equal(t, 0, n)
+	_, err = w.Write([]byte("de"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"Content-Length: 5\r\n"+
+		"\r\n"+
+		"abcde", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: A short body is reported and the connection is not reused
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusCodeSuccess))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	_, err = w.Write([]byte("abc"))
+	require.NoError(t, err)
+	assert.ErrorIs(t, w.Finish(), ErrBodyTooShort)
+	assert.False(t, w.KeepAlive())
+
+	// Test: Responses that never have a body are not short
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusCodeNotModified))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	require.NoError(t, w.Finish())
+	assert.True(t, w.KeepAlive())
+
+	// Test: Body bytes for a status without a body are refused, even with a
+	// declared length, so they cannot run into the next response
+	for _, statusCode := range []StatusCode{StatusCodeNoContent, StatusCodeNotModified} {
+		buf.Reset()
+		w = NewWriter(&buf)
+		require.NoError(t, w.WriteStatusLine(statusCode))
+		h := headers.NewHeaders()
+		if statusCode == StatusCodeNotModified {
+			h.Set("Content-Length", "5")
+		}
+		require.NoError(t, w.WriteHeaders(h))
+		sent := buf.String()
+		_, err = w.Write([]byte("oops"))
+		assert.ErrorIs(t, err, ErrBodyNotAllowed)
+		_, err = w.WriteChunkedBody([]byte("oops"))
+		assert.ErrorIs(t, err, ErrBodyNotAllowed)
+		_, err = w.Write(nil)
+		assert.NoError(t, err)
+		require.NoError(t, w.Finish())
+		assert.Equal(t, sent, buf.String())
+		assert.True(t, w.KeepAlive())
+	}
+
+	// Test: Chunked writes to a body with a declared length are sent as is,
+	// and held to the length
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusCodeSuccess))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+	_, err = w.WriteChunkedBody([]byte("abc"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBody([]byte("def"))
+	assert.ErrorIs(t, err, ErrBodyTooLong)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.FinalizeChunkedResponse())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"Content-Length: 5\r\n"+
+		"\r\n"+
+		"abc", buf.String())
+	assert.ErrorIs(t, w.Finish(), ErrBodyTooShort)
+
+	// Test: Invalid Content-Length values are refused before anything is sent
+	for _, value := range []string{"", "-1", "1.5", "5, 5", "0x10", "99999999999999999999"} {
+		buf.Reset()
+		w = NewWriter(&buf)
+		require.NoError(t, w.WriteStatusLine(StatusCodeSuccess))
+		h := headers.NewHeaders()
+		h.Set("Content-Length", value)
+		assert.Error(t, w.WriteHeaders(h), value)
+		assert.Equal(t, "HTTP/1.1 200 OK\r\n", buf.String())
+		assert.Equal(t, WriteStateHeaders, w.State)
+	}
+}
+
+func TestWriterHeadResponse(t *testing.T) {
+	// Test: The buffered body is measured but not sent
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetRequestMethod("HEAD")
+	_, err := w.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"Content-Length: 5\r\n"+
+		"\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+	assert.Equal(t, int64(5), w.BytesWritten())
+
+	// Test: A declared length is kept, whether or not the body is written
+	for _, body := range []string{"abcde", ""} {
+		buf.Reset()
+		w = NewWriter(&buf)
+		w.SetRequestMethod("HEAD")
+		require.NoError(t, w.WriteStatusLine(StatusCodeSuccess))
+		require.NoError(t, w.WriteHeaders(GetDefaultHeaders(5)))
+		_, err = w.WriteBody([]byte(body))
+		require.NoError(t, err)
+		require.NoError(t, w.Finish())
+		assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+			"Content-Type: text/plain\r\n"+
+			"Content-Length: 5\r\n"+
+			"\r\n", buf.String())
+		assert.True(t, w.KeepAlive())
+	}
+
+	// Test: Chunks, the last chunk and trailers are all dropped
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetRequestMethod("HEAD")
+	require.NoError(t, w.WriteStatusLine(StatusCodeSuccess))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeadersForChunkEncoding()))
+	_, err = w.WriteChunkedBody([]byte("{}"))
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Sum", "abc")
+	require.NoError(t, w.WriteTrailers(trailers))
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Transfer-Encoding: chunked\r\n"+
+		"Content-Type: application/json\r\n"+
+		"\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+
+	// Test: HTTP/1.0 bodies too big to buffer need no close for HEAD
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.SetRequestProto("1.0", true)
+	w.SetRequestMethod("HEAD")
+	_, err = w.Write(bytes.Repeat([]byte("a"), maxBufferedBody+1))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.0 200 OK\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"Connection: keep-alive\r\n"+
+		"\r\n", buf.String())
+	assert.True(t, w.KeepAlive())
+}
+
+func TestWriteStatus(t *testing.T) {
+	// Test: A plain-text response naming the status, with extra headers
+	var buf bytes.Buffer
+	h := headers.NewHeaders()
+	h.Set("Allow", "GET, HEAD")
+	require.NoError(t, WriteStatus(NewWriter(&buf), StatusCodeMethodNotAllowed, h))
+	assert.Equal(t, "HTTP/1.1 405 Method Not Allowed\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"Content-Length: 23\r\n"+
+		"Allow: GET, HEAD\r\n"+
+		"\r\n"+
+		"405 Method Not Allowed\n", buf.String())
+}
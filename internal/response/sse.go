@@ -0,0 +1,233 @@
+package response
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"voylento/httpfromtcp/internal/headers"
+	"voylento/httpfromtcp/internal/request"
+)
+
+// ErrStreamClosed is returned for events sent after the SSEWriter was
+// closed.
+var ErrStreamClosed = errors.New("event stream closed")
+
+// Event is one Server-Sent Events record. Empty fields are left out, and
+// Data may span several lines.
+type Event struct {
+	// Event is the event type; the client dispatches "message" without it
+	Event	string
+	// ID becomes the client's last event ID, sent back in Last-Event-ID
+	// when it reconnects
+	ID		string
+	Data	string
+	// Retry tells the client how long to wait before reconnecting
+	Retry	time.Duration
+}
+
+// SSEWriter streams Server-Sent Events (text/event-stream) as the body of
+// a response. Each event is flushed as soon as it is sent. A failed write
+// means the client has gone away: the stream is then done, and every later
+// send returns the same error.
+//
+// The server only notices that a client has gone when a write to it fails,
+// so a stream that may go quiet needs a Heartbeat for Done to ever close.
+//
+// Send, Comment and the heartbeat may be used from different goroutines,
+// but nothing else may write to the response. Close must be called before
+// the handler returns. A server write timeout covers the whole stream, so
+// long-lived streams need it off or generous.
+type SSEWriter struct {
+	w				*Writer
+	lastEventID		string
+	mu				sync.Mutex
+	err				error
+	done			chan struct{}
+	stopHeartbeat	chan struct{}
+	heartbeatDone	chan struct{}
+}
+
+// NewSSEWriter starts an event stream in answer to req. It sends a 200
+// with Content-Type text/event-stream unless the handler already wrote a
+// status line, in which case it must not have written the headers yet.
+// A HEAD request gets only the headers: the stream is done straight away
+// and every send returns ErrStreamClosed.
+func NewSSEWriter(w *Writer, req *request.Request) (*SSEWriter, error) {
+	if w.State == WriteStateStatusLine {
+		if err := w.WriteStatusLine(StatusCodeSuccess); err != nil {
+			return nil, err
+		}
+	}
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+	s := &SSEWriter{
+		w: w,
+		done: make(chan struct{}),
+	}
+	s.lastEventID, _ = req.Headers.Get("last-event-id")
+	// send the headers now, so the client knows the stream is open before
+	// the first event
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	// a HEAD response drops the body, so writes would never fail and the
+	// stream would never end
+	if req.RequestLine.Method == "HEAD" {
+		s.fail(ErrStreamClosed)
+	}
+	return s, nil
+}
+
+// LastEventID returns the ID of the last event a reconnecting client saw,
+// from its Last-Event-ID header, or "" for a new stream.
+func (s *SSEWriter) LastEventID() string {
+	return s.lastEventID
+}
+
+// Done is closed once the stream can no longer be written to, because the
+// client went away or Close was called.
+func (s *SSEWriter) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the stream is done, or nil while it is not.
+func (s *SSEWriter) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Send writes ev to the stream and flushes it.
+func (s *SSEWriter) Send(ev Event) error {
+	if strings.ContainsAny(ev.Event, "\r\n") {
+		return fmt.Errorf("Error: event type %q contains a line break", ev.Event)
+	}
+	// a NUL in the ID makes clients ignore it
+	if strings.ContainsAny(ev.ID, "\r\n\x00") {
+		return fmt.Errorf("Error: event ID %q contains a line break or NUL", ev.ID)
+	}
+	if ev.Retry < 0 {
+		return fmt.Errorf("Error: negative retry %v", ev.Retry)
+	}
+	var b strings.Builder
+	if ev.Event != "" {
+		b.WriteString("event: " + ev.Event + "\n")
+	}
+	if ev.ID != "" {
+		b.WriteString("id: " + ev.ID + "\n")
+	}
+	if ev.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(ev.Retry.Milliseconds(), 10) + "\n")
+	}
+	// a record without data only updates the ID or retry, and is not
+	// dispatched as an event
+	if ev.Data != "" || ev.Event != "" {
+		// CRLF and CR end lines too, and would otherwise end the field
+		data := strings.ReplaceAll(ev.Data, "\r\n", "\n")
+		data = strings.ReplaceAll(data, "\r", "\n")
+		for _, line := range strings.Split(data, "\n") {
+			b.WriteString("data: " + line + "\n")
+		}
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+// Comment writes a comment line, which clients ignore. It keeps idle
+// connections from being closed by proxies, and finds out whether the
+// client is still there.
+func (s *SSEWriter) Comment(text string) error {
+	var b strings.Builder
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r", ""), "\n") {
+		b.WriteString(":" + line + "\n")
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+// Heartbeat sends an empty comment every interval until the stream is done
+// or closed. Calling it again changes the interval.
+func (s *SSEWriter) Heartbeat(interval time.Duration) {
+	s.stop()
+	stop, finished := make(chan struct{}), make(chan struct{})
+	s.mu.Lock()
+	s.stopHeartbeat, s.heartbeatDone = stop, finished
+	s.mu.Unlock()
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if s.Comment("") != nil {
+					return
+				}
+			case <-stop:
+				return
+			case <-s.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the heartbeat and ends the stream. The response itself is
+// completed by the server once the handler returns.
+func (s *SSEWriter) Close() error {
+	s.stop()
+	s.fail(ErrStreamClosed)
+	return nil
+}
+
+// stop ends the heartbeat goroutine, if any, and waits for it.
+func (s *SSEWriter) stop() {
+	s.mu.Lock()
+	stop, finished := s.stopHeartbeat, s.heartbeatDone
+	s.stopHeartbeat, s.heartbeatDone = nil, nil
+	s.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-finished
+	}
+}
+
+func (s *SSEWriter) write(record string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if _, err := s.w.Write([]byte(record)); err != nil {
+		s.failLocked(err)
+		return err
+	}
+	if err := s.w.Flush(); err != nil {
+		s.failLocked(err)
+		return err
+	}
+	return nil
+}
+
+func (s *SSEWriter) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failLocked(err)
+}
+
+// failLocked records why the stream is done. The caller holds mu.
+func (s *SSEWriter) failLocked(err error) {
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	close(s.done)
+}
@@ -0,0 +1,207 @@
+package response
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"voylento/httpfromtcp/internal/headers"
+	"voylento/httpfromtcp/internal/request"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// syncBuffer is a bytes.Buffer that heartbeats can write to while the
+// test reads it.
+type syncBuffer struct {
+	mu	sync.Mutex
+	buf	bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// failingWriter accepts limit bytes, then fails like a closed connection.
+type failingWriter struct {
+	limit	int
+}
+
+func (fw *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > fw.limit {
+		return 0, io.ErrClosedPipe
+	}
+	fw.limit -= len(p)
+	return len(p), nil
+}
+
+// chunk frames s as a single chunk of a chunked body.
+func chunk(s string) string {
+	return fmt.Sprintf("%X\r\n%s\r\n", len(s), s)
+}
+
+func newEventRequest(t *testing.T, lastEventID string) *request.Request {
+	t.Helper()
+	return newEventRequestWithMethod(t, "GET", lastEventID)
+}
+
+func newEventRequestWithMethod(t *testing.T, method, lastEventID string) *request.Request {
+	t.Helper()
+	h := headers.NewHeaders()
+	h.Set("Host", "localhost")
+	if lastEventID != "" {
+		h.Set("Last-Event-ID", lastEventID)
+	}
+	req, err := request.NewRequest(method, "/events", "1.1", h, io.NopCloser(strings.NewReader("")), request.DefaultLimits)
+	require.NoError(t, err)
+	return req
+}
+
+func TestSSEWriter(t *testing.T) {
+	// Test: The stream opens with chunked text/event-stream headers
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	sse, err := NewSSEWriter(w, newEventRequest(t, ""))
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Content-Type: text/event-stream\r\n"+
+		"Cache-Control: no-cache\r\n"+
+		"Transfer-Encoding: chunked\r\n"+
+		"\r\n", buf.String())
+	assert.Empty(t, sse.LastEventID())
+
+	// Test: Each event is one chunk, its fields in order and data split
+	// into lines
+	buf.Reset()
+	require.NoError(t, sse.Send(Event{Event: "update", ID: "7", Data: "line one\r\nline two\nline three", Retry: 3 * time.Second}))
+	record := "event: update\nid: 7\nretry: 3000\n" +
+		"data: line one\ndata: line two\ndata: line three\n\n"
+	assert.Equal(t, chunk(record), buf.String())
+
+	// Test: Unset fields are left out
+	buf.Reset()
+	require.NoError(t, sse.Send(Event{Data: "hello"}))
+	assert.Equal(t, chunk("data: hello\n\n"), buf.String())
+
+	// Test: A record with only an ID sends no data
+	buf.Reset()
+	require.NoError(t, sse.Send(Event{ID: "8"}))
+	assert.Equal(t, chunk("id: 8\n\n"), buf.String())
+
+	// Test: Comments, one line each
+	buf.Reset()
+	require.NoError(t, sse.Comment("a\nb"))
+	assert.Equal(t, chunk(":a\n:b\n\n"), buf.String())
+
+	// Test: Fields that would break the framing are rejected
+	buf.Reset()
+	assert.Error(t, sse.Send(Event{Event: "a\nb", Data: "x"}))
+	assert.Error(t, sse.Send(Event{ID: "1\x00", Data: "x"}))
+	assert.Error(t, sse.Send(Event{Retry: -time.Second}))
+	assert.Empty(t, buf.String())
+
+	// Test: Close ends the stream, and the server's Finish ends the body
+	require.NoError(t, sse.Close())
+	<-sse.Done()
+	assert.ErrorIs(t, sse.Send(Event{Data: "late"}), ErrStreamClosed)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "0\r\n\r\n", buf.String())
+}
+
+func TestSSEWriterLastEventID(t *testing.T) {
+	// Test: A reconnecting client's Last-Event-ID is exposed
+	sse, err := NewSSEWriter(NewWriter(io.Discard), newEventRequest(t, "42"))
+	require.NoError(t, err)
+	defer sse.Close()
+	assert.Equal(t, "42", sse.LastEventID())
+}
+
+func TestSSEWriterHead(t *testing.T) {
+	// Test: A HEAD request gets the headers, and a stream that is already
+	// done
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetRequestMethod("HEAD")
+	sse, err := NewSSEWriter(w, newEventRequestWithMethod(t, "HEAD", ""))
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Content-Type: text/event-stream\r\n"+
+		"Cache-Control: no-cache\r\n"+
+		"Transfer-Encoding: chunked\r\n"+
+		"\r\n", buf.String())
+	select {
+	case <-sse.Done():
+	default:
+		assert.Fail(t, "HEAD stream is not done")
+	}
+	assert.ErrorIs(t, sse.Send(Event{Data: "hello"}), ErrStreamClosed)
+	assert.ErrorIs(t, sse.Comment(""), ErrStreamClosed)
+	assert.ErrorIs(t, sse.Err(), ErrStreamClosed)
+
+	// Test: ...and a heartbeat does not keep it going
+	sse.Heartbeat(time.Millisecond)
+	require.NoError(t, sse.Close())
+	require.NoError(t, w.Finish())
+	assert.NotContains(t, buf.String(), "0\r\n")
+}
+
+func TestSSEWriterHeartbeat(t *testing.T) {
+	// Test: Heartbeats are empty comments sent until Close
+	var buf syncBuffer
+	w := NewWriter(&buf)
+	sse, err := NewSSEWriter(w, newEventRequest(t, ""))
+	require.NoError(t, err)
+	sse.Heartbeat(5 * time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return strings.Count(buf.String(), chunk(":\n\n")) >= 2
+	}, time.Second, time.Millisecond)
+	require.NoError(t, sse.Close())
+	sent := buf.String()
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, sent, buf.String())
+}
+
+func TestSSEWriterDisconnect(t *testing.T) {
+	// Test: A failed write marks the stream done, and later sends return
+	// the same error
+	w := NewWriter(&failingWriter{limit: 200})
+	sse, err := NewSSEWriter(w, newEventRequest(t, ""))
+	require.NoError(t, err)
+	defer sse.Close()
+	select {
+	case <-sse.Done():
+		require.FailNow(t, "stream done before any write failed")
+	default:
+	}
+	err = sse.Send(Event{Data: strings.Repeat("x", 200)})
+	require.Error(t, err)
+	<-sse.Done()
+	assert.True(t, errors.Is(sse.Err(), io.ErrClosedPipe))
+	assert.ErrorIs(t, sse.Send(Event{Data: "again"}), io.ErrClosedPipe)
+
+	// Test: A heartbeat notices the client is gone without any events
+	w = NewWriter(&failingWriter{limit: 200})
+	sse, err = NewSSEWriter(w, newEventRequest(t, ""))
+	require.NoError(t, err)
+	defer sse.Close()
+	sse.Heartbeat(time.Millisecond)
+	select {
+	case <-sse.Done():
+	case <-time.After(time.Second):
+		assert.Fail(t, "heartbeat did not notice the failed writes")
+	}
+}
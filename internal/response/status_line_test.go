@@ -0,0 +1,46 @@
+package response
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusLine(t *testing.T) {
+	// Test: Registered codes get their standard reason phrase
+	assert.Equal(t, "OK", StatusText(StatusCodeSuccess))
+	assert.Equal(t, "Moved Permanently", StatusText(StatusCodeMovedPermanently))
+	assert.Equal(t, "Not Found", StatusText(StatusCodeNotFound))
+	assert.Equal(t, "Network Authentication Required", StatusText(StatusCodeNetworkAuthenticationRequired))
+
+	// Test: Unregistered codes have no reason phrase
+	assert.Equal(t, "", StatusText(StatusCode(599)))
+
+	// Test: Status line with the standard reason phrase
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusCodeNotFound))
+	assert.Equal(t, "HTTP/1.1 404 Not Found\r\n", buf.String())
+
+	// Test: Status line for an unregistered code
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusCode(599)))
+	assert.Equal(t, "HTTP/1.1 599 \r\n", buf.String())
+
+	// Test: Status line with a custom reason phrase
+	buf.Reset()
+	w = NewWriter(&buf)
+	require.NoError(t, w.WriteStatusLineWithReason(StatusCodeSuccess, "Everything Is Fine"))
+	assert.Equal(t, "HTTP/1.1 200 Everything Is Fine\r\n", buf.String())
+
+	// Test: Reason phrases cannot break the status line
+	w = NewWriter(&buf)
+	require.Error(t, w.WriteStatusLineWithReason(StatusCodeSuccess, "OK\r\nX-Injected: 1"))
+
+	// Test: Status codes must be three digits
+	w = NewWriter(&buf)
+	require.Error(t, w.WriteStatusLine(StatusCode(42)))
+}
@@ -0,0 +1,56 @@
+package response
+
+import (
+	"strings"
+
+	"voylento/httpfromtcp/internal/headers"
+)
+
+// StreamWriter carries a response over a protocol with its own framing,
+// such as an HTTP/2 stream, in place of HTTP/1.x text on a connection.
+type StreamWriter interface {
+	// WriteHeaders sends a response header block. Informational (1xx)
+	// blocks go out straight away; the final one may be held back until
+	// the first Write or Close, so it can end the stream by itself.
+	WriteHeaders(statusCode StatusCode, fields []headers.Field) error
+	// Write sends part of the body.
+	Write(p []byte) (int, error)
+	// Close ends the response, sending trailers if there are any.
+	Close(trailers []headers.Field) error
+}
+
+// connectionSpecificHeaders only mean something to a single HTTP/1.x
+// connection, and have no place on a stream.
+var connectionSpecificHeaders = []string{"connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade"}
+
+// NewStreamWriter returns a Writer that sends the response through sw. The
+// handler uses it exactly as it would a Writer on a connection: the body
+// is framed by sw, so chunked encoding is dropped, and trailers are handed
+// to sw when the response is finished.
+func NewStreamWriter(sw StreamWriter) *Writer {
+	w := NewWriter(sw)
+	w.httpVersion = "2.0"
+	w.stream = sw
+	return w
+}
+
+// writeStreamHeaders sends the headers of a stream response, in lower
+// case and without connection-specific fields.
+func (w *Writer) writeStreamHeaders(statusCode StatusCode, h *headers.Headers) error {
+	var fields []headers.Field
+	if h != nil {
+		for _, f := range withoutFields(h.Raw(), connectionSpecificHeaders...) {
+			fields = append(fields, headers.Field{Name: strings.ToLower(f.Name), Value: f.Value})
+		}
+	}
+	return w.stream.WriteHeaders(statusCode, fields)
+}
+
+// closeStream ends a stream response once.
+func (w *Writer) closeStream() error {
+	if w.stream == nil || w.streamClosed {
+		return nil
+	}
+	w.streamClosed = true
+	return w.stream.Close(w.trailers)
+}
@@ -0,0 +1,225 @@
+package router
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"voylento/httpfromtcp/internal/headers"
+	"voylento/httpfromtcp/internal/request"
+	"voylento/httpfromtcp/internal/response"
+	"voylento/httpfromtcp/internal/server"
+)
+
+// Router dispatches requests to handlers by method and path pattern.
+//
+// A pattern is a path made of segments separated by "/". A segment is
+// either literal text, a parameter "{name}" matching exactly one segment,
+// or, as the last segment only, a wildcard "{name...}" matching the rest of
+// the path. A bare "*" is a wildcard named "*". Literal segments win over
+// parameters, and parameters win over wildcards.
+type Router struct {
+	// NotFound answers requests whose path matches no route. A plain 404
+	// is sent when it is nil.
+	NotFound	server.Handler
+	routes		[]*route
+}
+
+type segmentKind int
+
+const (
+	segmentLiteral segmentKind = iota
+	segmentParam
+	segmentWildcard
+)
+
+type segment struct {
+	kind	segmentKind
+	value	string
+}
+
+type route struct {
+	method		string
+	pattern		string
+	segments	[]segment
+	handler		server.Handler
+}
+
+func New() *Router {
+	return &Router{}
+}
+
+// Handle registers handler for requests with the given method and a path
+// matching pattern. It panics if the pattern is malformed or already
+// registered for the method, since that is a programming error.
+func (rt *Router) Handle(method, pattern string, handler server.Handler) {
+	segments, err := parsePattern(pattern)
+	if err != nil {
+		panic(err)
+	}
+	for _, existing := range rt.routes {
+		if existing.method == method && existing.pattern == pattern {
+			panic(fmt.Sprintf("router: %s %s registered twice", method, pattern))
+		}
+	}
+	rt.routes = append(rt.routes, &route{
+		method:		method,
+		pattern:	pattern,
+		segments:	segments,
+		handler:	handler,
+	})
+}
+
+// Handler returns the router as a server.Handler.
+func (rt *Router) Handler() server.Handler {
+	return rt.dispatch
+}
+
+func (rt *Router) dispatch(w *response.Writer, req *request.Request) {
+	// match on the escaped path so an encoded "/" stays inside its segment
+	pathSegments := splitPath(req.URL.EscapedPath())
+
+	var best *route
+	var bestParams map[string]string
+	var allowed []string
+	for _, rte := range rt.routes {
+		params, ok := rte.match(pathSegments)
+		if !ok {
+			continue
+		}
+		allowed = append(allowed, rte.method)
+		if !rte.allows(req.RequestLine.Method) {
+			continue
+		}
+		if best == nil || rte.moreSpecificThan(best) {
+			best = rte
+			bestParams = params
+		}
+	}
+
+	if best != nil {
+		req.PathParams = bestParams
+		best.handler(w, req)
+		return
+	}
+	if len(allowed) > 0 {
+		writeMethodNotAllowed(w, allowed)
+		return
+	}
+	if rt.NotFound != nil {
+		rt.NotFound(w, req)
+		return
+	}
+	response.WriteStatus(w, response.StatusCodeNotFound, nil)
+}
+
+// allows reports whether the route serves method. GET routes also serve
+// HEAD.
+func (rte *route) allows(method string) bool {
+	return rte.method == method || (method == "HEAD" && rte.method == "GET")
+}
+
+func (rte *route) match(pathSegments []string) (map[string]string, bool) {
+	params := make(map[string]string)
+	for i, seg := range rte.segments {
+		if seg.kind == segmentWildcard {
+			// like ServeMux, the wildcard needs the "/" before it, so
+			// "/files" does not match "/files/{path...}". The root path has
+			// that slash but no segments.
+			if i > 0 && i >= len(pathSegments) {
+				return nil, false
+			}
+			rest, err := url.PathUnescape(strings.Join(pathSegments[i:], "/"))
+			if err != nil {
+				return nil, false
+			}
+			params[seg.value] = rest
+			return params, true
+		}
+		if i >= len(pathSegments) {
+			return nil, false
+		}
+		switch seg.kind {
+		case segmentLiteral:
+			// literals are written unescaped, so "/users/%6De" is "/users/me"
+			value, err := url.PathUnescape(pathSegments[i])
+			if err != nil || value != seg.value {
+				return nil, false
+			}
+		case segmentParam:
+			value, err := url.PathUnescape(pathSegments[i])
+			if err != nil || value == "" {
+				return nil, false
+			}
+			params[seg.value] = value
+		}
+	}
+	if len(pathSegments) != len(rte.segments) {
+		return nil, false
+	}
+	return params, true
+}
+
+// moreSpecificThan compares two routes matching the same path segment by
+// segment, preferring literals over parameters over wildcards.
+func (rte *route) moreSpecificThan(other *route) bool {
+	for i := 0; i < len(rte.segments) && i < len(other.segments); i++ {
+		if rte.segments[i].kind != other.segments[i].kind {
+			return rte.segments[i].kind < other.segments[i].kind
+		}
+	}
+	return len(rte.segments) > len(other.segments)
+}
+
+func parsePattern(pattern string) ([]segment, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("router: pattern must start with /: %q", pattern)
+	}
+	var segments []segment
+	parts := splitPath(pattern)
+	for i, part := range parts {
+		last := i == len(parts)-1
+		switch {
+		case part == "*" || (strings.HasPrefix(part, "{") && strings.HasSuffix(part, "...}")):
+			if !last {
+				return nil, fmt.Errorf("router: wildcard must be the last segment: %q", pattern)
+			}
+			name := strings.TrimSuffix(strings.TrimPrefix(part, "{"), "...}")
+			segments = append(segments, segment{kind: segmentWildcard, value: name})
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			name := part[1 : len(part)-1]
+			if name == "" {
+				return nil, fmt.Errorf("router: empty parameter name: %q", pattern)
+			}
+			segments = append(segments, segment{kind: segmentParam, value: name})
+		case strings.ContainsAny(part, "{}"):
+			return nil, fmt.Errorf("router: malformed segment %q in %q", part, pattern)
+		default:
+			segments = append(segments, segment{kind: segmentLiteral, value: part})
+		}
+	}
+	return segments, nil
+}
+
+// splitPath splits a path into its segments. The root path has none, and a
+// trailing slash leaves an empty last segment so "/a/" and "/a" differ.
+func splitPath(path string) []string {
+	path = strings.TrimPrefix(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+func writeMethodNotAllowed(w *response.Writer, allowed []string) {
+	if slices.Contains(allowed, "GET") {
+		allowed = append(allowed, "HEAD")
+	}
+	slices.Sort(allowed)
+	allowed = slices.Compact(allowed)
+
+	h := headers.NewHeaders()
+	h.Set("Allow", strings.Join(allowed, ", "))
+	response.WriteStatus(w, response.StatusCodeMethodNotAllowed, h)
+}
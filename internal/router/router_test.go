@@ -0,0 +1,123 @@
+package router
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"voylento/httpfromtcp/internal/request"
+	"voylento/httpfromtcp/internal/response"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serve runs a request line through the router and returns the raw
+// response along with the name of the handler that answered, if any.
+func serve(t *testing.T, rt *Router, method, target string) (string, *request.Request) {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	rt.Handler()(response.NewWriter(&buf), req)
+	return buf.String(), req
+}
+
+func named(name string) func(w *response.Writer, req *request.Request) {
+	return func(w *response.Writer, req *request.Request) {
+		body := []byte(name)
+		w.WriteStatusLine(response.StatusCodeSuccess)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	rt := New()
+	rt.Handle("GET", "/", named("root"))
+	rt.Handle("GET", "/users", named("list"))
+	rt.Handle("POST", "/users", named("create"))
+	rt.Handle("GET", "/users/me", named("me"))
+	rt.Handle("GET", "/users/{id}", named("user"))
+	rt.Handle("DELETE", "/users/{id}", named("delete"))
+	rt.Handle("GET", "/users/{id}/posts/{post}", named("post"))
+	rt.Handle("GET", "/files/{path...}", named("files"))
+	rt.Handle("GET", "/static/*", named("static"))
+	rt.Handle("GET", "/café", named("café"))
+
+	// Test: Literal routes
+	resp, _ := serve(t, rt, "GET", "/")
+	assert.True(t, strings.HasSuffix(resp, "root"))
+	resp, _ = serve(t, rt, "POST", "/users")
+	assert.True(t, strings.HasSuffix(resp, "create"))
+
+	// Test: Query strings are not part of the path
+	resp, _ = serve(t, rt, "GET", "/users?limit=10")
+	assert.True(t, strings.HasSuffix(resp, "list"))
+
+	// Test: Parameters are extracted and decoded
+	resp, req := serve(t, rt, "GET", "/users/ada%20l")
+	assert.True(t, strings.HasSuffix(resp, "user"))
+	assert.Equal(t, "ada l", req.PathValue("id"))
+	resp, req = serve(t, rt, "GET", "/users/7/posts/99")
+	assert.True(t, strings.HasSuffix(resp, "post"))
+	assert.Equal(t, "7", req.PathValue("id"))
+	assert.Equal(t, "99", req.PathValue("post"))
+
+	// Test: Literal segments beat parameters
+	resp, _ = serve(t, rt, "GET", "/users/me")
+	assert.True(t, strings.HasSuffix(resp, "me"))
+
+	// Test: Percent-encoded paths match literal segments
+	resp, _ = serve(t, rt, "GET", "/users/%6De")
+	assert.True(t, strings.HasSuffix(resp, "me"))
+	resp, _ = serve(t, rt, "GET", "/caf%C3%A9")
+	assert.True(t, strings.HasSuffix(resp, "café"))
+
+	// Test: Wildcards take the rest of the path
+	resp, req = serve(t, rt, "GET", "/files/a/b/c.txt")
+	assert.True(t, strings.HasSuffix(resp, "files"))
+	assert.Equal(t, "a/b/c.txt", req.PathValue("path"))
+	resp, req = serve(t, rt, "GET", "/static/css/site.css")
+	assert.True(t, strings.HasSuffix(resp, "static"))
+	assert.Equal(t, "css/site.css", req.PathValue("*"))
+
+	// Test: A wildcard needs the "/" before it, but may match nothing
+	resp, _ = serve(t, rt, "GET", "/files")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 404 Not Found\r\n"))
+	resp, req = serve(t, rt, "GET", "/files/")
+	assert.True(t, strings.HasSuffix(resp, "files"))
+	assert.Equal(t, "", req.PathValue("path"))
+
+	// Test: GET routes also answer HEAD
+	resp, _ = serve(t, rt, "HEAD", "/users/me")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 200 OK\r\n"))
+
+	// Test: Unknown paths get 404
+	resp, _ = serve(t, rt, "GET", "/nope")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 404 Not Found\r\n"))
+	resp, _ = serve(t, rt, "GET", "/users/7/posts")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 404 Not Found\r\n"))
+
+	// Test: Known paths with the wrong method get 405 and Allow
+	resp, _ = serve(t, rt, "PUT", "/users/7")
+	assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 405 Method Not Allowed\r\n"))
+	assert.Contains(t, resp, "Allow: DELETE, GET, HEAD\r\n")
+	resp, _ = serve(t, rt, "PATCH", "/users")
+	assert.Contains(t, resp, "Allow: GET, HEAD, POST\r\n")
+
+	// Test: Custom not found handler
+	rt.NotFound = named("custom")
+	resp, _ = serve(t, rt, "GET", "/nope")
+	assert.True(t, strings.HasSuffix(resp, "custom"))
+}
+
+func TestRouterPatterns(t *testing.T) {
+	rt := New()
+	assert.Panics(t, func() { rt.Handle("GET", "users", named("x")) })
+	assert.Panics(t, func() { rt.Handle("GET", "/files/{path...}/more", named("x")) })
+	assert.Panics(t, func() { rt.Handle("GET", "/users/{}", named("x")) })
+	assert.Panics(t, func() { rt.Handle("GET", "/users/{id", named("x")) })
+	rt.Handle("GET", "/users/{id}", named("x"))
+	assert.Panics(t, func() { rt.Handle("GET", "/users/{id}", named("x")) })
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"io"
+	"strings"
+
+	"voylento/httpfromtcp/internal/request"
+	"voylento/httpfromtcp/internal/response"
+)
+
+// expectContinueReader sends 100 Continue the first time the handler reads
+// the body of a request that asked for it. A handler that answers without
+// reading the body never sends it, and the client never sends the body.
+type expectContinueReader struct {
+	body	io.ReadCloser
+	w		*response.Writer
+	sent	bool
+	err		error
+}
+
+func (e *expectContinueReader) Read(p []byte) (int, error) {
+	if !e.sent {
+		e.sent = true
+		// once a final response has started it is too late to ask for
+		// the body
+		if e.w.State == response.WriteStateStatusLine {
+			e.err = e.w.WriteInformational(response.StatusCodeContinue, nil)
+		}
+	}
+	if e.err != nil {
+		return 0, e.err
+	}
+	return e.body.Read(p)
+}
+
+func (e *expectContinueReader) Close() error {
+	return e.body.Close()
+}
+
+// checkExpect validates the Expect header. Only 100-continue is understood;
+// anything else has to be refused with 417.
+func checkExpect(req *request.Request) bool {
+	values := req.Headers.Values("expect")
+	if len(values) == 0 || req.RequestLine.HttpVersion == "1.0" {
+		return true
+	}
+	for _, value := range values {
+		for _, expectation := range strings.Split(value, ",") {
+			if !strings.EqualFold(strings.TrimSpace(expectation), "100-continue") {
+				return false
+			}
+		}
+	}
+	return true
+}
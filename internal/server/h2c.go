@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"voylento/httpfromtcp/internal/headers"
+	"voylento/httpfromtcp/internal/http2"
+	"voylento/httpfromtcp/internal/request"
+	"voylento/httpfromtcp/internal/response"
+)
+
+// WithH2C lets clients speak cleartext HTTP/2, either from the start of a
+// connection or by upgrading an HTTP/1.1 request with "Upgrade: h2c". It
+// is off by default, and has no effect on TLS connections.
+func WithH2C(enabled bool) Option {
+	return func(s *Server) {
+		s.h2c = enabled
+	}
+}
+
+// http2Server returns the settings HTTP/2 connections are served with.
+// conn is tracked as idle whenever it has no open streams, so Shutdown
+// can close it.
+func (s *Server) http2Server(conn net.Conn) *http2.Server {
+	idleTimeout := s.idleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = s.readTimeout
+	}
+	return &http2.Server{
+		Handler: s.serveStream,
+		BadRequest: writeParseError,
+		Limits: s.limits,
+		IdleTimeout: idleTimeout,
+		ConnState: func(idle bool) {
+			if idle {
+				s.setConnState(conn, connStateIdle)
+			} else {
+				s.setConnState(conn, connStateActive)
+			}
+		},
+		Draining: s.closed.Load,
+	}
+}
+
+// serveStream runs the handler for a request on an HTTP/2 stream, and
+// reports an error if the response could not be completed.
+func (s *Server) serveStream(w *response.Writer, req *request.Request) error {
+	if !checkExpect(req) {
+		writeError(w, response.StatusCodeExpectationFailed, response.StatusText(response.StatusCodeExpectationFailed))
+		return w.Finish()
+	}
+	if req.ExpectsContinue() {
+		req.BodyReader = &expectContinueReader{body: req.BodyReader, w: w}
+	}
+	ok, answered := s.runHandler(w, req)
+	if req.MultipartForm != nil {
+		req.MultipartForm.RemoveAll()
+	}
+	// a stream, unlike a connection, survives the handler failing, as long
+	// as the response it got is whole
+	if !ok && !answered {
+		return fmt.Errorf("Error: handler for %s %s failed", req.RequestLine.Method, req.RequestLine.RequestTarget)
+	}
+	return w.Finish()
+}
+
+// isH2CUpgrade reports whether req asks to switch to HTTP/2, which takes
+// the h2c token in Upgrade, both Upgrade and HTTP2-Settings listed in
+// Connection, and exactly one HTTP2-Settings header.
+func isH2CUpgrade(req *request.Request) bool {
+	return req.RequestLine.HttpVersion == "1.1" &&
+		req.Headers.HasToken("upgrade", "h2c") &&
+		req.Headers.HasToken("connection", "upgrade") &&
+		req.Headers.HasToken("connection", "http2-settings") &&
+		len(req.Headers.Values("http2-settings")) == 1
+}
+
+// upgradeH2C switches the connection to HTTP/2 and serves req as its first
+// stream. The body is read before the 101 goes out, since once it has the
+// connection only carries HTTP/2 frames.
+func (s *Server) upgradeH2C(conn net.Conn, reader *request.Reader, req *request.Request) {
+	value, _ := req.Headers.Get("http2-settings")
+	settings, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil {
+		writeError(response.NewWriter(conn), response.StatusCodeBadRequest, "Error: invalid HTTP2-Settings header")
+		return
+	}
+	body, err := req.ReadBody()
+	if err != nil {
+		log.Printf("Error reading body of h2c upgrade from %s: %v", conn.RemoteAddr(), err)
+		writeParseError(response.NewWriter(conn), err)
+		return
+	}
+
+	w := response.NewWriter(conn)
+	h := headers.NewHeaders()
+	h.Set("Connection", "Upgrade")
+	h.Set("Upgrade", "h2c")
+	if err := w.WriteStatusLine(response.StatusCodeSwitchingProtocols); err != nil {
+		return
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return
+	}
+	for _, name := range []string{"upgrade", "connection", "http2-settings"} {
+		req.Headers.Remove(name)
+	}
+	req.RequestLine.HttpVersion = "2.0"
+	req.BodyReader = io.NopCloser(bytes.NewReader(body))
+	s.serveHTTP2(conn, reader.Buffered(), settings, req)
+}
+
+// serveHTTP2 hands the connection over to HTTP/2 until it is done. upgraded
+// is the request that asked for the upgrade, or nil when the client sent
+// the preface straight away.
+func (s *Server) serveHTTP2(conn net.Conn, buffered []byte, settings []byte, upgraded *request.Request) {
+	// HTTP/2 has its own idle timeout, and no single request to time
+	conn.SetDeadline(time.Time{})
+	h2 := s.http2Server(conn)
+	var err error
+	if upgraded != nil {
+		err = h2.ServeUpgrade(conn, buffered, settings, upgraded)
+	} else {
+		err = h2.ServeConn(conn, buffered)
+	}
+	if err != nil {
+		log.Printf("Error serving HTTP/2 to %s: %v", conn.RemoteAddr(), err)
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"voylento/httpfromtcp/internal/http2"
+	"voylento/httpfromtcp/internal/http2/hpack"
+	"voylento/httpfromtcp/internal/request"
+	"voylento/httpfromtcp/internal/response"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func echoBodyHandler(w *response.Writer, req *request.Request) {
+	body, err := req.ReadBody()
+	if err != nil {
+		return
+	}
+	body = append([]byte(req.RequestLine.RequestTarget+" "), body...)
+	w.WriteStatusLine(response.StatusCodeSuccess)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+// readH2Frame reads one raw HTTP/2 frame.
+func readH2Frame(t *testing.T, r io.Reader) (byte, byte, uint32, []byte) {
+	t.Helper()
+	var hdr [9]byte
+	_, err := io.ReadFull(r, hdr[:])
+	require.NoError(t, err)
+	length := uint32(hdr[0])<<16 | uint32(hdr[1])<<8 | uint32(hdr[2])
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	require.NoError(t, err)
+	return hdr[3], hdr[4], binary.BigEndian.Uint32(hdr[5:]) & 0x7fffffff, payload
+}
+
+func TestH2CPriorKnowledge(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget != "/nothing" {
+			echoBodyHandler(w, req)
+		}
+	}
+	s, err := Serve(0, handler, WithH2C(true))
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: protocols}}
+	defer client.CloseIdleConnections()
+	url := "http://" + s.Addr().String()
+
+	// Test: A client that starts with the preface is served over HTTP/2
+	resp, err := client.Get(url + "/hello")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/2.0", resp.Proto)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "/hello ", string(body))
+
+	// Test: Request bodies reach the handler, on the same connection
+	resp, err = client.Post(url+"/upload", "text/plain", strings.NewReader("some data"))
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/2.0", resp.Proto)
+	assert.Equal(t, "/upload some data", string(body))
+
+	// Test: A handler that writes nothing gets the server's 500
+	resp, err = client.Get(url + "/nothing")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 500, resp.StatusCode)
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	conn := startServer(t, echoBodyHandler, WithH2C(true))
+	r := bufio.NewReader(conn)
+	// an empty HTTP2-Settings payload leaves every setting at its default
+	_, err := io.WriteString(conn, "POST /upgrade HTTP/1.1\r\nHost: localhost\r\n"+
+		"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: \r\n"+
+		"Content-Length: 4\r\n\r\nbody")
+	require.NoError(t, err)
+
+	// Test: The server switches protocols
+	statusLine, err := r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", statusLine)
+	h, err := readHeaders(r)
+	require.NoError(t, err)
+	assert.True(t, h.HasToken("upgrade", "h2c"))
+
+	// Test: The upgrade request is answered on stream 1 over HTTP/2
+	_, err = io.WriteString(conn, http2.ClientPreface+"\x00\x00\x00\x04\x00\x00\x00\x00\x00")
+	require.NoError(t, err)
+	dec := hpack.NewDecoder(hpack.DefaultTableSize)
+	var status, body string
+	for {
+		typ, flags, streamID, payload := readH2Frame(t, r)
+		if typ == byte(http2.FrameHeaders) {
+			assert.Equal(t, uint32(1), streamID)
+			fields, err := dec.Decode(payload)
+			require.NoError(t, err)
+			status = fields[0].Value
+		}
+		if typ == byte(http2.FrameData) {
+			assert.Equal(t, uint32(1), streamID)
+			body += string(payload)
+		}
+		if streamID == 1 && flags&byte(http2.FlagEndStream) != 0 {
+			break
+		}
+	}
+	assert.Equal(t, "200", status)
+	assert.Equal(t, "/upgrade body", body)
+}
+
+func TestH2CDisabled(t *testing.T) {
+	conn := startServer(t, okHandler)
+	r := bufio.NewReader(conn)
+
+	// Test: Without WithH2C, an upgrade request is served as HTTP/1.1
+	_, err := io.WriteString(conn, "GET /plain HTTP/1.1\r\nHost: localhost\r\n"+
+		"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: \r\n\r\n")
+	require.NoError(t, err)
+	statusLine, body := readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", statusLine)
+	assert.Equal(t, "/plain", body)
+
+	// Test: ...and the preface is rejected as a malformed request
+	conn, err = net.Dial("tcp", conn.RemoteAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, http2.ClientPreface)
+	require.NoError(t, err)
+	statusLine, err = bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.NotContains(t, statusLine, " 200 ")
+}
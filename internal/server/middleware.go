@@ -0,0 +1,21 @@
+package server
+
+// Middleware wraps a Handler to add behavior around it, such as logging or
+// authentication.
+type Middleware func(Handler) Handler
+
+// Chain composes middleware into one. The first middleware is the
+// outermost, so it sees the request first and the response last.
+func Chain(middleware ...Middleware) Middleware {
+	return func(h Handler) Handler {
+		for i := len(middleware) - 1; i >= 0; i-- {
+			h = middleware[i](h)
+		}
+		return h
+	}
+}
+
+// Wrap applies middleware to h, outermost first.
+func Wrap(h Handler, middleware ...Middleware) Handler {
+	return Chain(middleware...)(h)
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"voylento/httpfromtcp/internal/request"
+	"voylento/httpfromtcp/internal/response"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiddleware(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(w *response.Writer, req *request.Request) {
+				calls = append(calls, name+" in")
+				next(w, req)
+				calls = append(calls, name+" out")
+			}
+		}
+	}
+
+	var status response.StatusCode
+	var written int64
+	observe := func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			next(w, req)
+			status = w.StatusCode()
+			written = w.BytesWritten()
+		}
+	}
+
+	handler := func(w *response.Writer, req *request.Request) {
+		calls = append(calls, "handler")
+		body := []byte("not here")
+		w.WriteStatusLine(response.StatusCodeNotFound)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}
+
+	req, err := request.RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+
+	// Test: Middleware runs outermost first and can observe the response
+	h := Wrap(handler, trace("a"), Chain(trace("b"), observe))
+	var buf bytes.Buffer
+	h(response.NewWriter(&buf), req)
+	assert.Equal(t, []string{"a in", "b in", "handler", "b out", "a out"}, calls)
+	assert.Equal(t, response.StatusCodeNotFound, status)
+	assert.Equal(t, int64(8), written)
+
+	// Test: An empty chain leaves the handler as is
+	calls = nil
+	Wrap(handler)(response.NewWriter(&buf), req)
+	assert.Equal(t, []string{"handler"}, calls)
+}
@@ -1,11 +1,19 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"runtime/debug"
+	"sync"
 	"sync/atomic"
+	"time"
 
+	"voylento/httpfromtcp/internal/http2"
 	"voylento/httpfromtcp/internal/response"
 	"voylento/httpfromtcp/internal/request"
 )
@@ -16,19 +24,125 @@ type Server struct {
 	listener net.Listener
 	handler	Handler
 	closed	atomic.Bool
+	limits	request.Limits
+	strict	bool
+	bareLF	bool
+
+	mu		sync.Mutex
+	conns	map[net.Conn]connState
+
+	readHeaderTimeout	time.Duration
+	readTimeout			time.Duration
+	writeTimeout		time.Duration
+	idleTimeout			time.Duration
+
+	tlsConfig	*tls.Config
+	certFile	string
+	keyFile		string
+	clientCAs	*x509.CertPool
+	clientAuth	ClientAuth
+
+	h2c			bool
+}
+
+// connState is what a tracked connection is doing, so Shutdown knows which
+// connections it can close straight away.
+type connState int
+
+const (
+	connStateIdle connState = iota
+	connStateActive
+)
+
+// shutdownPollInterval is how often Shutdown checks whether the remaining
+// connections have finished.
+const shutdownPollInterval = 10 * time.Millisecond
+
+// Option configures a Server started by Serve.
+type Option func(*Server)
+
+// WithLimits sets the size limits applied to every request.
+func WithLimits(limits request.Limits) Option {
+	return func(s *Server) {
+		s.limits = limits
+	}
+}
+
+// WithStrictParsing turns the request parser's defenses against request
+// smuggling on or off. They are on by default.
+func WithStrictParsing(strict bool) Option {
+	return func(s *Server) {
+		s.strict = strict
+	}
+}
+
+// WithBareLF lets a server with strict parsing turned off accept a bare LF
+// as a line ending. Strict parsing always rejects it.
+func WithBareLF(allow bool) Option {
+	return func(s *Server) {
+		s.bareLF = allow
+	}
+}
+
+// WithReadHeaderTimeout limits how long a client has to send the request
+// line and headers once a request has started. It falls back to the read
+// timeout when zero.
+func WithReadHeaderTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.readHeaderTimeout = d
+	}
+}
+
+// WithReadTimeout limits how long a client has to send a whole request,
+// body included.
+func WithReadTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.readTimeout = d
+	}
+}
+
+// WithWriteTimeout limits how long writing a response may take, counted
+// from the end of reading the request headers.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.writeTimeout = d
+	}
+}
+
+// WithIdleTimeout limits how long a keep-alive connection may sit waiting
+// for its next request. It falls back to the read timeout when zero. It
+// also covers a new connection's first request when there is no header or
+// read timeout.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.idleTimeout = d
+	}
 }
 
-func Serve(port int, handler Handler) (*Server, error) {
+func Serve(port int, handler Handler, opts ...Option) (*Server, error) {
+	s := &Server{
+		handler:  handler,
+		limits:   request.DefaultLimits,
+		strict:   true,
+		conns:    make(map[net.Conn]connState),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	tlsConfig, err := s.buildTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	// Listen on the tcp port provided
 	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return nil, err
 	}
-
-	s := &Server{
-		listener: l,
-		handler:  handler,
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
 	}
+	s.listener = l
 	go s.listen()
 	return s, nil	
 }
@@ -47,6 +161,12 @@ func (s *Server) listen() {
 	}
 }
 
+// Addr returns the address the server is listening on, which is how to
+// find the port when Serve was given port 0.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
 func (s *Server) Close() error {
 	s.closed.Store(true)
 	if s.listener != nil {
@@ -55,18 +175,268 @@ func (s *Server) Close() error {
 	return nil
 }
 
+// Shutdown stops accepting connections and closes idle ones, then waits
+// for in-flight requests to finish. If ctx ends first, the remaining
+// connections are closed and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.Close()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.closeAllConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeIdleConns closes every idle connection and reports whether there
+// are no connections left.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, state := range s.conns {
+		if state == connStateIdle {
+			conn.Close()
+			delete(s.conns, conn)
+		}
+	}
+	return len(s.conns) == 0
+}
+
+func (s *Server) closeAllConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+		delete(s.conns, conn)
+	}
+}
+
+func (s *Server) setConnState(conn net.Conn, state connState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[conn] = state
+}
+
+func (s *Server) forgetConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
 func (s *Server) handle(conn net.Conn) {
-	defer conn.Close()
-	w := response.NewWriter(conn)
-	req, err := request.RequestFromReader(conn)
-	if err != nil {
-		w.WriteStatusLine(response.StatusCodeBadRequest)
-		var b []byte
-		body := fmt.Appendf(b, "Error parsing request: %v", err)
-		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
-		w.WriteBody(body)
-		return
+	hijacked := false
+	defer func() {
+		if !hijacked {
+			conn.Close()
+		}
+	}()
+	defer s.forgetConn(conn)
+	var tlsState *tls.ConnectionState
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn.SetDeadline(deadline(time.Now(), s.headerTimeout()))
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("TLS handshake error from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		conn.SetDeadline(time.Time{})
+		state := tlsConn.ConnectionState()
+		tlsState = &state
 	}
+
+	reader := request.NewReader(conn)
+	reader.StreamBody = true
+	reader.Limits = s.limits
+	reader.Strict = s.strict
+	reader.AllowBareLF = s.bareLF
+	for first := true; ; first = false {
+		// wait for the first byte of the next request; a client that opens
+		// a connection and sends nothing gets the header timeout, or the
+		// idle timeout when there is none
+		idleTimeout := s.idleTimeout
+		if (first && s.headerTimeout() > 0) || idleTimeout == 0 {
+			idleTimeout = s.headerTimeout()
+		}
+		conn.SetReadDeadline(deadline(time.Now(), idleTimeout))
+		s.setConnState(conn, connStateIdle)
+		if s.closed.Load() {
+			return
+		}
+		if err := reader.Peek(); err != nil {
+			if isTimeout(err) {
+				log.Printf("Closing idle connection from %s", conn.RemoteAddr())
+			}
+			return
+		}
+		if first && s.h2c && tlsState == nil {
+			isPreface, err := reader.HasPrefix([]byte(http2.ClientPreface))
+			if err != nil {
+				return
+			}
+			if isPreface {
+				s.serveHTTP2(conn, reader.Buffered(), nil, nil)
+				return
+			}
+		}
+		s.setConnState(conn, connStateActive)
+
+		start := time.Now()
+		conn.SetReadDeadline(deadline(start, s.headerTimeout()))
+		req, err := reader.ReadRequest()
+		if err != nil {
+			if isTimeout(err) {
+				// the error names the server's socket, which is no business
+				// of the client's
+				log.Printf("Timed out reading request from %s: %v", conn.RemoteAddr(), err)
+				writeError(response.NewWriter(conn), response.StatusCodeRequestTimeout, response.StatusText(response.StatusCodeRequestTimeout))
+				return
+			}
+			log.Printf("Error parsing request from %s: %v", conn.RemoteAddr(), err)
+			writeParseError(response.NewWriter(conn), err)
+			return
+		}
+		req.TLS = tlsState
+		if s.h2c && tlsState == nil && isH2CUpgrade(req) {
+			s.upgradeH2C(conn, reader, req)
+			return
+		}
+		conn.SetReadDeadline(deadline(start, s.readTimeout))
+		conn.SetWriteDeadline(deadline(time.Now(), s.writeTimeout))
+
+		w := response.NewWriter(conn)
+		w.SetRequestProto(req.RequestLine.HttpVersion, req.KeepAlive())
+		w.SetRequestMethod(req.RequestLine.Method)
+		w.EnableHijack(conn, reader.Buffered)
+		if !checkExpect(req) {
+			writeError(w, response.StatusCodeExpectationFailed, response.StatusText(response.StatusCodeExpectationFailed))
+			return
+		}
+		var expect *expectContinueReader
+		if req.ExpectsContinue() {
+			expect = &expectContinueReader{body: req.BodyReader, w: w}
+			req.BodyReader = expect
+		}
+
+		ok, _ := s.runHandler(w, req)
+		if req.MultipartForm != nil {
+			req.MultipartForm.RemoveAll()
+		}
+		if w.Hijacked() {
+			// the connection belongs to the handler now, unless it panicked
+			// and is in no position to clean up after itself
+			hijacked = ok
+			return
+		}
+		if !ok {
+			return
+		}
+		if err := w.Finish(); err != nil {
+			log.Printf("Error finishing response to %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		if !w.KeepAlive() || s.closed.Load() {
+			return
+		}
+		if expect != nil && !expect.sent {
+			// the handler answered without asking for the body, so there
+			// is no telling whether the client will send it anyway
+			return
+		}
+		// the handler may not have read the whole body, and the next
+		// request starts right after it
+		if err := reader.DiscardBody(); err != nil {
+			if isTimeout(err) {
+				log.Printf("Timed out reading request body from %s", conn.RemoteAddr())
+			} else {
+				log.Printf("Error discarding request body: %v", err)
+			}
+			return
+		}
+		conn.SetWriteDeadline(time.Time{})
+	}
+}
+
+// runHandler calls the handler, recovering from panics. It makes sure a
+// response was sent, answering with a 500 if the handler sent nothing,
+// and reports false if the connection has to be closed because the
+// response could not be completed. answered is set when the 500 came from
+// the server, in which case the response itself is whole.
+func (s *Server) runHandler(w *response.Writer, req *request.Request) (ok bool, answered bool) {
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+		log.Printf("Panic serving %s %s: %v\n%s", req.RequestLine.Method, req.RequestLine.RequestTarget, p, debug.Stack())
+		if w.State == response.WriteStateStatusLine {
+			writeError(w, response.StatusCodeInternalServerError, response.StatusText(response.StatusCodeInternalServerError))
+			answered = true
+		}
+		// whatever the handler left behind, the connection is in an
+		// unknown state
+		ok = false
+	}()
+
 	s.handler(w, req)
+	if w.State == response.WriteStateStatusLine {
+		log.Printf("Handler for %s %s returned without writing a response", req.RequestLine.Method, req.RequestLine.RequestTarget)
+		writeError(w, response.StatusCodeInternalServerError, response.StatusText(response.StatusCodeInternalServerError))
+		return false, true
+	}
+	return true, false
+}
+
+func (s *Server) headerTimeout() time.Duration {
+	if s.readHeaderTimeout > 0 {
+		return s.readHeaderTimeout
+	}
+	return s.readTimeout
+}
+
+// deadline returns the deadline d after start, or the zero time (no
+// deadline) when d is zero.
+func deadline(start time.Time, d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return start.Add(d)
 }
 
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// writeParseError answers a request that could not be parsed, or that the
+// limits refused. An HTTP/1.x connection is closed afterwards, since there
+// is no telling where the next request would start.
+func writeParseError(w *response.Writer, err error) {
+	statusCode := response.StatusCodeBadRequest
+	switch {
+	case errors.Is(err, request.ErrRequestLineTooLong):
+		statusCode = response.StatusCodeURITooLong
+	case errors.Is(err, request.ErrHeadersTooLarge):
+		statusCode = response.StatusCodeRequestHeaderFieldsTooLarge
+	case errors.Is(err, request.ErrBodyTooLarge):
+		statusCode = response.StatusCodeContentTooLarge
+	}
+	writeError(w, statusCode, fmt.Sprintf("Error parsing request: %v", err))
+}
+
+// writeError sends a plain text error response. The connection is always
+// closed afterwards.
+func writeError(w *response.Writer, statusCode response.StatusCode, message string) {
+	w.WriteStatusLine(statusCode)
+	body := []byte(message)
+	h := response.GetDefaultHeaders(len(body))
+	h.Set("connection", "close")
+	w.WriteHeaders(h)
+	w.WriteBody(body)
+}
@@ -0,0 +1,468 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"voylento/httpfromtcp/internal/headers"
+	"voylento/httpfromtcp/internal/request"
+	"voylento/httpfromtcp/internal/response"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startServer serves handler on a free port and returns a connection
+// to it.
+func startServer(t *testing.T, handler Handler, opts ...Option) net.Conn {
+	t.Helper()
+	s, err := Serve(0, handler, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readResponse reads one Content-Length framed response and returns its
+// status line and body.
+func readResponse(t *testing.T, r *bufio.Reader) (string, string) {
+	t.Helper()
+	statusLine, err := r.ReadString('\n')
+	require.NoError(t, err)
+	h, err := readHeaders(r)
+	require.NoError(t, err)
+	length := 0
+	if value, ok := h.Get("content-length"); ok {
+		length, err = strconv.Atoi(value)
+		require.NoError(t, err)
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	require.NoError(t, err)
+	return statusLine, string(body)
+}
+
+func readHeaders(r *bufio.Reader) (*headers.Headers, error) {
+	h := headers.NewHeaders()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		_, done, err := h.Parse([]byte(line))
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			return h, nil
+		}
+	}
+}
+
+func okHandler(w *response.Writer, req *request.Request) {
+	body := []byte(req.RequestLine.RequestTarget)
+	w.WriteStatusLine(response.StatusCodeSuccess)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	conn := startServer(t, okHandler)
+	_, err := io.WriteString(conn, "GET /one HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"POST /two HTTP/1.1\r\nHost: localhost\r\nContent-Length: 3\r\n\r\nabc"+
+		"GET /three HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	require.NoError(t, err)
+
+	r := bufio.NewReader(conn)
+	for _, target := range []string{"/one", "/two", "/three"} {
+		statusLine, body := readResponse(t, r)
+		assert.Equal(t, "HTTP/1.1 200 OK\r\n", statusLine)
+		assert.Equal(t, target, body)
+	}
+	_, err = r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestTimeouts(t *testing.T) {
+	// Test: A client that never finishes its headers gets 408, without
+	// the server's socket addresses in the body
+	conn := startServer(t, okHandler, WithReadHeaderTimeout(50*time.Millisecond))
+	_, err := io.WriteString(conn, "GET /slow HTTP/1.1\r\nHost: local")
+	require.NoError(t, err)
+	r := bufio.NewReader(conn)
+	statusLine, body := readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 408 Request Timeout\r\n", statusLine)
+	assert.Equal(t, "Request Timeout", strings.TrimSpace(body))
+	_, err = r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: An idle keep-alive connection is closed after the idle
+	// timeout, not the longer header timeout
+	conn = startServer(t, okHandler, WithReadHeaderTimeout(5*time.Second), WithIdleTimeout(50*time.Millisecond))
+	_, err = io.WriteString(conn, "GET /one HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	r = bufio.NewReader(conn)
+	statusLine, _ = readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", statusLine)
+	start := time.Now()
+	_, err = r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// Test: With only an idle timeout, a client that connects and sends
+	// nothing is closed after it
+	conn = startServer(t, okHandler, WithIdleTimeout(50*time.Millisecond))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	start = time.Now()
+	_, err = bufio.NewReader(conn).ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// Test: A body that stops arriving fails the handler's read with a
+	// timeout
+	readErr := make(chan error, 1)
+	handler := func(w *response.Writer, req *request.Request) {
+		_, err := req.ReadBody()
+		readErr <- err
+		okHandler(w, req)
+	}
+	conn = startServer(t, handler, WithReadTimeout(50*time.Millisecond))
+	_, err = io.WriteString(conn, "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\nabc")
+	require.NoError(t, err)
+	select {
+	case err := <-readErr:
+		assert.True(t, isTimeout(err), "%v", err)
+	case <-time.After(2 * time.Second):
+		assert.Fail(t, "body read did not time out")
+	}
+
+	// Test: A client that stops reading fails the handler's writes with a
+	// timeout
+	writeErr := make(chan error, 1)
+	handler = func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusCodeSuccess)
+		w.WriteHeaders(response.GetDefaultHeadersForChunkEncoding())
+		chunk := make([]byte, 64<<10)
+		for {
+			if _, err := w.WriteChunkedBody(chunk); err != nil {
+				writeErr <- err
+				return
+			}
+		}
+	}
+	conn = startServer(t, handler, WithWriteTimeout(50*time.Millisecond))
+	_, err = io.WriteString(conn, "GET /big HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	select {
+	case err := <-writeErr:
+		assert.True(t, isTimeout(err), "%v", err)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "response write did not time out")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	handler := func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+		okHandler(w, req)
+	}
+	newServer := func() (*Server, net.Conn) {
+		s, err := Serve(0, handler)
+		require.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return s, conn
+	}
+
+	// Test: An in-flight response is finished before Shutdown returns, and
+	// its connection is closed after it
+	s, conn := newServer()
+	_, err := io.WriteString(conn, "GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	<-started
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- s.Shutdown(context.Background()) }()
+	select {
+	case <-shutdownErr:
+		require.FailNow(t, "Shutdown returned with a request in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	r := bufio.NewReader(conn)
+	statusLine, body := readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", statusLine)
+	assert.Equal(t, "/slow", body)
+	_, err = r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+	assert.NoError(t, <-shutdownErr)
+
+	// Test: Idle keep-alive connections are closed straight away
+	s, conn = newServer()
+	_, err = io.WriteString(conn, "GET /one HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	r = bufio.NewReader(conn)
+	readResponse(t, r)
+	require.NoError(t, s.Shutdown(context.Background()))
+	_, err = r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: No new connections are accepted after Shutdown
+	_, err = net.Dial("tcp", s.Addr().String())
+	assert.Error(t, err)
+
+	// Test: When the context ends first, the remaining connections are
+	// closed and its error returned
+	release = make(chan struct{})
+	defer close(release)
+	s, conn = newServer()
+	_, err = io.WriteString(conn, "GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+	_, err = bufio.NewReader(conn).ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestHandlerPanics(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) {
+		switch req.RequestLine.RequestTarget {
+		case "/panic":
+			panic("boom")
+		case "/partial":
+			w.WriteStatusLine(response.StatusCodeSuccess)
+			w.WriteHeaders(response.GetDefaultHeaders(100))
+			w.WriteBody([]byte("cut short"))
+			panic("boom")
+		case "/nothing":
+			return
+		}
+		okHandler(w, req)
+	}
+
+	// Test: A panic before writing anything becomes a 500
+	conn := startServer(t, handler)
+	_, err := io.WriteString(conn, "GET /panic HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	r := bufio.NewReader(conn)
+	statusLine, _ := readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 500 Internal Server Error\r\n", statusLine)
+	_, err = r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: A handler that writes nothing gets a 500 sent for it
+	conn = startServer(t, handler)
+	_, err = io.WriteString(conn, "GET /nothing HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	statusLine, _ = readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 500 Internal Server Error\r\n", statusLine)
+
+	// Test: A panic partway through a response aborts the connection
+	conn = startServer(t, handler)
+	_, err = io.WriteString(conn, "GET /partial HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	raw, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Contains(t, string(raw), "HTTP/1.1 200 OK\r\n")
+	assert.True(t, len(raw) > 0 && string(raw[len(raw)-9:]) == "cut short")
+}
+
+func TestHTTP10Requests(t *testing.T) {
+	// Test: HTTP/1.0 closes after one response by default
+	conn := startServer(t, okHandler)
+	_, err := io.WriteString(conn, "GET /old HTTP/1.0\r\n\r\n")
+	require.NoError(t, err)
+	r := bufio.NewReader(conn)
+	statusLine, body := readResponse(t, r)
+	assert.Equal(t, "HTTP/1.0 200 OK\r\n", statusLine)
+	assert.Equal(t, "/old", body)
+	_, err = r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: HTTP/1.0 with keep-alive can send a second request
+	conn = startServer(t, okHandler)
+	_, err = io.WriteString(conn, "GET /one HTTP/1.0\r\nConnection: keep-alive\r\n\r\n"+
+		"GET /two HTTP/1.0\r\n\r\n")
+	require.NoError(t, err)
+	r = bufio.NewReader(conn)
+	_, body = readResponse(t, r)
+	assert.Equal(t, "/one", body)
+	_, body = readResponse(t, r)
+	assert.Equal(t, "/two", body)
+	_, err = r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestExpectContinue(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/reject" {
+			body := []byte("no thanks")
+			w.WriteStatusLine(response.StatusCodeUnauthorized)
+			w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+			w.WriteBody(body)
+			return
+		}
+		// the handler runs off the test goroutine, so it can't stop the test
+		body, err := req.ReadBody()
+		if !assert.NoError(t, err) {
+			return
+		}
+		w.WriteStatusLine(response.StatusCodeSuccess)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}
+	opts := []Option{WithLimits(request.Limits{MaxBodyBytes: 10})}
+
+	// Test: 100 Continue is sent once the handler reads the body
+	conn := startServer(t, handler, opts...)
+	_, err := io.WriteString(conn, "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n")
+	require.NoError(t, err)
+	r := bufio.NewReader(conn)
+	statusLine, body := readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n", statusLine)
+	assert.Equal(t, "", body)
+	_, err = io.WriteString(conn, "hello")
+	require.NoError(t, err)
+	statusLine, body = readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", statusLine)
+	assert.Equal(t, "hello", body)
+
+	// Test: A handler can answer before the body is sent
+	conn = startServer(t, handler, opts...)
+	_, err = io.WriteString(conn, "POST /reject HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n")
+	require.NoError(t, err)
+	r = bufio.NewReader(conn)
+	statusLine, body = readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 401 Unauthorized\r\n", statusLine)
+	assert.Equal(t, "no thanks", body)
+	_, err = r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	// Test: A body over the limit is refused without 100 Continue
+	conn = startServer(t, handler, opts...)
+	_, err = io.WriteString(conn, "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 500\r\nExpect: 100-continue\r\n\r\n")
+	require.NoError(t, err)
+	statusLine, _ = readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 413 Content Too Large\r\n", statusLine)
+
+	// Test: Unknown expectations get 417
+	conn = startServer(t, handler, opts...)
+	_, err = io.WriteString(conn, "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\nExpect: 200-ok\r\n\r\n")
+	require.NoError(t, err)
+	statusLine, _ = readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 417 Expectation Failed\r\n", statusLine)
+}
+
+func TestHandlerWritesWithoutFraming(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) {
+		fmt.Fprintf(w, "hello %s", req.RequestLine.RequestTarget)
+	}
+
+	// Test: Bodies written through io.Writer get a Content-Length and the
+	// connection stays open
+	conn := startServer(t, handler)
+	_, err := io.WriteString(conn, "GET /one HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"GET /two HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	r := bufio.NewReader(conn)
+	for _, target := range []string{"/one", "/two"} {
+		statusLine, body := readResponse(t, r)
+		assert.Equal(t, "HTTP/1.1 200 OK\r\n", statusLine)
+		assert.Equal(t, "hello "+target, body)
+	}
+}
+
+func TestShortResponseBody(t *testing.T) {
+	handler := func(w *response.Writer, req *request.Request) {
+		w.WriteStatusLine(response.StatusCodeSuccess)
+		w.WriteHeaders(response.GetDefaultHeaders(10))
+		w.WriteBody([]byte("short"))
+	}
+
+	// Test: The connection is closed when the body falls short of its
+	// Content-Length, even though the client wants to keep it
+	conn := startServer(t, handler)
+	_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	raw, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"Content-Length: 10\r\n"+
+		"\r\n"+
+		"short", string(raw))
+}
+
+func TestHeadRequests(t *testing.T) {
+	// Test: A GET handler answers HEAD with the same headers and no body,
+	// and the connection can carry the next request
+	conn := startServer(t, okHandler)
+	_, err := io.WriteString(conn, "HEAD /one HTTP/1.1\r\nHost: localhost\r\n\r\n"+
+		"GET /two HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	r := bufio.NewReader(conn)
+	statusLine, err := r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", statusLine)
+	h, err := readHeaders(r)
+	require.NoError(t, err)
+	contentLength, _ := h.Get("content-length")
+	assert.Equal(t, "4", contentLength)
+
+	statusLine, body := readResponse(t, r)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", statusLine)
+	assert.Equal(t, "/two", body)
+}
+
+func TestHijack(t *testing.T) {
+	result := make(chan string, 1)
+	handler := func(w *response.Writer, req *request.Request) {
+		conn, r, err := w.Hijack()
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		_, err = w.Write([]byte("too late"))
+		assert.ErrorIs(t, err, response.ErrHijacked)
+		go func() {
+			defer conn.Close()
+			// the server had already read past the request
+			line, _ := r.ReadString('\n')
+			io.WriteString(conn, "raw: "+line)
+			result <- line
+		}()
+	}
+
+	// Test: The handler gets the connection and the bytes read past the
+	// request, and the server leaves both alone
+	conn := startServer(t, handler)
+	_, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\nhello\n")
+	require.NoError(t, err)
+	raw, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "raw: hello\n", string(raw))
+	assert.Equal(t, "hello\n", <-result)
+
+	// Test: Writers that were not set up for it cannot be hijacked
+	w := response.NewWriter(io.Discard)
+	_, _, err = w.Hijack()
+	assert.ErrorIs(t, err, response.ErrNotHijackable)
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// WithTLSConfig makes the server speak TLS using config, which must supply
+// a certificate unless the server was started with ServeTLS.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(s *Server) {
+		s.tlsConfig = config
+	}
+}
+
+// ClientAuth is how the server treats client certificates.
+type ClientAuth int
+
+const (
+	// ClientAuthNone does not ask for a client certificate.
+	ClientAuthNone ClientAuth = iota
+	// ClientAuthRequest asks for a certificate, but accepts clients
+	// without one and does not verify it. Unverified certificates are not
+	// reported as the request's client certificate.
+	ClientAuthRequest
+	// ClientAuthRequire refuses clients without a certificate signed by
+	// one of the client CAs.
+	ClientAuthRequire
+	// ClientAuthVerifyIfGiven accepts clients without a certificate, but
+	// verifies any certificate that is sent.
+	ClientAuthVerifyIfGiven
+)
+
+// WithClientCAs sets the certificate authorities client certificates are
+// verified against.
+func WithClientCAs(pool *x509.CertPool) Option {
+	return func(s *Server) {
+		s.clientCAs = pool
+	}
+}
+
+// WithClientAuth sets whether the server asks for client certificates and
+// how it verifies them. The verifying modes need WithClientCAs.
+func WithClientAuth(mode ClientAuth) Option {
+	return func(s *Server) {
+		s.clientAuth = mode
+	}
+}
+
+// withCertificateFiles makes the server load its certificate from files,
+// reloading them when they change.
+func withCertificateFiles(certFile, keyFile string) Option {
+	return func(s *Server) {
+		s.certFile = certFile
+		s.keyFile = keyFile
+	}
+}
+
+// ServeTLS is Serve over TLS, with the certificate and key read from PEM
+// files. Replacing the files swaps the certificate for new connections
+// without a restart. Any config given with WithTLSConfig is used for the
+// other TLS settings.
+func ServeTLS(port int, handler Handler, certFile, keyFile string, opts ...Option) (*Server, error) {
+	return Serve(port, handler, append(opts, withCertificateFiles(certFile, keyFile))...)
+}
+
+// buildTLSConfig returns the TLS configuration the server listens with, or
+// nil for plain TCP.
+func (s *Server) buildTLSConfig() (*tls.Config, error) {
+	if s.tlsConfig == nil && s.certFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{}
+	if s.tlsConfig != nil {
+		config = s.tlsConfig.Clone()
+	}
+	if s.certFile != "" {
+		reloader, err := newCertReloader(s.certFile, s.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = nil
+		config.GetCertificate = reloader.GetCertificate
+	}
+	if len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil {
+		return nil, fmt.Errorf("Error: TLS config has no certificate")
+	}
+	if err := s.configureClientAuth(config); err != nil {
+		return nil, err
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"http/1.1"}
+	}
+	return config, nil
+}
+
+func (s *Server) configureClientAuth(config *tls.Config) error {
+	if s.clientCAs != nil {
+		config.ClientCAs = s.clientCAs
+	}
+	switch s.clientAuth {
+	case ClientAuthNone:
+		return nil
+	case ClientAuthRequest:
+		config.ClientAuth = tls.RequestClientCert
+		return nil
+	case ClientAuthRequire:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	case ClientAuthVerifyIfGiven:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return fmt.Errorf("Error: unknown client auth mode: %d", s.clientAuth)
+	}
+	if config.ClientCAs == nil {
+		return fmt.Errorf("Error: verifying client certificates needs client CAs")
+	}
+	return nil
+}
+
+// certReloader serves a certificate loaded from files, loading it again
+// when either file's modification time changes. If the new files cannot
+// be loaded, say because only one of them has been replaced so far, the
+// old certificate is kept and the load is retried on the next handshake.
+type certReloader struct {
+	certFile	string
+	keyFile		string
+
+	mu			sync.Mutex
+	cert		*tls.Certificate
+	certModTime	time.Time
+	keyModTime	time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	certModTime, keyModTime, err := r.modTimes()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(certModTime, keyModTime); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	certModTime, keyModTime, err := r.modTimes()
+	if err != nil {
+		log.Printf("Error checking certificate files: %v", err)
+		return r.cert, nil
+	}
+	if !certModTime.Equal(r.certModTime) || !keyModTime.Equal(r.keyModTime) {
+		if err := r.load(certModTime, keyModTime); err != nil {
+			log.Printf("Error reloading certificate, keeping the old one: %v", err)
+		} else {
+			log.Printf("Reloaded certificate from %s", r.certFile)
+		}
+	}
+	return r.cert, nil
+}
+
+func (r *certReloader) load(certModTime, keyModTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("Error: loading certificate: %w", err)
+	}
+	r.cert = &cert
+	r.certModTime = certModTime
+	r.keyModTime = keyModTime
+	return nil
+}
+
+func (r *certReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
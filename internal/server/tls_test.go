@@ -0,0 +1,306 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"voylento/httpfromtcp/internal/request"
+	"voylento/httpfromtcp/internal/response"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCert is a certificate generated for a test, with its key.
+type testCert struct {
+	cert	*x509.Certificate
+	key		*ecdsa.PrivateKey
+	certPEM	[]byte
+	keyPEM	[]byte
+}
+
+// newTestCert signs template with parent, or self-signs it if parent is
+// nil.
+func newTestCert(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerCert := key, template
+	if parent != nil {
+		signer, signerCert = parent.key, parent.cert
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signer)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return &testCert{
+		cert:		cert,
+		key:		key,
+		certPEM:	pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func serverCertTemplate(commonName string) *x509.Certificate {
+	return &x509.Certificate{
+		Subject:		pkix.Name{CommonName: commonName},
+		DNSNames:		[]string{"localhost"},
+		IPAddresses:	[]net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:		x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:	[]x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	require.NoError(t, err)
+	return cert
+}
+
+func (c *testCert) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(c.cert)
+	return pool
+}
+
+// writeCertFiles writes c to files in dir, stamped with modTime.
+func writeCertFiles(t *testing.T, dir string, c *testCert, modTime time.Time) (string, string) {
+	t.Helper()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, c.certPEM, 0o600))
+	require.NoError(t, os.WriteFile(keyFile, c.keyPEM, 0o600))
+	require.NoError(t, os.Chtimes(certFile, modTime, modTime))
+	require.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+	return certFile, keyFile
+}
+
+func tlsInfoHandler(w *response.Writer, req *request.Request) {
+	if req.TLS == nil {
+		fmt.Fprint(w, "plain")
+		return
+	}
+	fmt.Fprintf(w, "%s %s %s", tls.VersionName(req.TLS.Version), tls.CipherSuiteName(req.TLS.CipherSuite), req.TLS.ServerName)
+}
+
+// tlsGet sends a GET over a new TLS connection and returns the connection
+// state the client saw with the response body.
+func tlsGet(t *testing.T, addr string, config *tls.Config) (tls.ConnectionState, string) {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, config)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	statusLine, body := readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", statusLine)
+	return conn.ConnectionState(), body
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	first := newTestCert(t, serverCertTemplate("first"), nil)
+	certFile, keyFile := writeCertFiles(t, dir, first, time.Now().Add(-time.Minute))
+	s, err := ServeTLS(0, tlsInfoHandler, certFile, keyFile)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	addr := s.Addr().String()
+
+	// Test: The negotiated version, cipher suite and SNI reach the handler
+	state, body := tlsGet(t, addr, &tls.Config{RootCAs: first.pool(), ServerName: "localhost"})
+	assert.Equal(t, fmt.Sprintf("%s %s localhost", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite)), body)
+	assert.Equal(t, "first", state.PeerCertificates[0].Subject.CommonName)
+
+	// Test: Old TLS versions are refused
+	_, err = tls.Dial("tcp", addr, &tls.Config{RootCAs: first.pool(), ServerName: "localhost", MaxVersion: tls.VersionTLS11})
+	assert.Error(t, err)
+
+	// Test: Replaced certificate files are picked up without a restart
+	second := newTestCert(t, serverCertTemplate("second"), nil)
+	writeCertFiles(t, dir, second, time.Now())
+	state, _ = tlsGet(t, addr, &tls.Config{RootCAs: second.pool(), ServerName: "localhost"})
+	assert.Equal(t, "second", state.PeerCertificates[0].Subject.CommonName)
+
+	// Test: Files that do not load leave the current certificate in place
+	require.NoError(t, os.WriteFile(certFile, []byte("not a certificate"), 0o600))
+	require.NoError(t, os.Chtimes(certFile, time.Now().Add(time.Minute), time.Now().Add(time.Minute)))
+	state, _ = tlsGet(t, addr, &tls.Config{RootCAs: second.pool(), ServerName: "localhost"})
+	assert.Equal(t, "second", state.PeerCertificates[0].Subject.CommonName)
+
+	// Test: A plain TCP client gets nowhere
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	raw, _ := io.ReadAll(conn)
+	assert.NotContains(t, string(raw), "HTTP/1.1")
+
+	// Test: Missing certificate files fail at startup
+	_, err = ServeTLS(0, tlsInfoHandler, filepath.Join(dir, "missing.pem"), keyFile)
+	assert.Error(t, err)
+}
+
+func TestServeWithTLSConfig(t *testing.T) {
+	cert := newTestCert(t, serverCertTemplate("config"), nil)
+
+	// Test: A tls.Config with a certificate serves TLS
+	s, err := Serve(0, tlsInfoHandler, WithTLSConfig(&tls.Config{
+		Certificates:	[]tls.Certificate{cert.tlsCertificate(t)},
+		MinVersion:		tls.VersionTLS13,
+	}))
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	state, body := tlsGet(t, s.Addr().String(), &tls.Config{RootCAs: cert.pool(), ServerName: "localhost"})
+	assert.Equal(t, uint16(tls.VersionTLS13), state.Version)
+	assert.Contains(t, body, "TLS 1.3")
+
+	// Test: Plain connections have no TLS state
+	conn := startServer(t, tlsInfoHandler)
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	require.NoError(t, err)
+	_, body = readResponse(t, bufio.NewReader(conn))
+	assert.Equal(t, "plain", body)
+
+	// Test: A config without a certificate is refused
+	_, err = Serve(0, tlsInfoHandler, WithTLSConfig(&tls.Config{}))
+	assert.Error(t, err)
+}
+
+func caCertTemplate(commonName string) *x509.Certificate {
+	return &x509.Certificate{
+		Subject:				pkix.Name{CommonName: commonName},
+		IsCA:					true,
+		BasicConstraintsValid:	true,
+		KeyUsage:				x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+}
+
+func clientCertTemplate(commonName string, uris ...string) *x509.Certificate {
+	template := &x509.Certificate{
+		Subject:		pkix.Name{CommonName: commonName, Organization: []string{"Example"}},
+		DNSNames:		[]string{commonName + ".internal.example.com"},
+		KeyUsage:		x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:	[]x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, raw := range uris {
+		uri, _ := url.Parse(raw)
+		template.URIs = append(template.URIs, uri)
+	}
+	return template
+}
+
+func clientCertHandler(w *response.Writer, req *request.Request) {
+	fmt.Fprintf(w, "subject=%q sans=%v peers=%d", req.ClientSubject(), req.ClientSANs(), len(req.TLS.PeerCertificates))
+}
+
+// tlsRoundTrip sends a GET over a new TLS connection and returns the
+// response body, or the error that stopped it.
+func tlsRoundTrip(addr string, config *tls.Config) (string, error) {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"); err != nil {
+		return "", err
+	}
+	raw, err := io.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+	_, body, found := strings.Cut(string(raw), "\r\n\r\n")
+	if !found {
+		return "", fmt.Errorf("no response")
+	}
+	return body, nil
+}
+
+func TestClientAuth(t *testing.T) {
+	serverCert := newTestCert(t, serverCertTemplate("server"), nil)
+	ca := newTestCert(t, caCertTemplate("client ca"), nil)
+	client := newTestCert(t, clientCertTemplate("svc-a", "spiffe://example.org/ns/a"), ca)
+	rogue := newTestCert(t, clientCertTemplate("svc-a"), nil)
+
+	serve := func(mode ClientAuth) string {
+		s, err := Serve(0, clientCertHandler,
+			WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{serverCert.tlsCertificate(t)}}),
+			WithClientCAs(ca.pool()),
+			WithClientAuth(mode),
+		)
+		require.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+		return s.Addr().String()
+	}
+	config := func(cert *testCert) *tls.Config {
+		config := &tls.Config{RootCAs: serverCert.pool(), ServerName: "localhost"}
+		if cert != nil {
+			// send it whatever CAs the server says it accepts
+			tlsCert := cert.tlsCertificate(t)
+			config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &tlsCert, nil
+			}
+		}
+		return config
+	}
+	const verified = `subject="CN=svc-a,O=Example" sans=[svc-a.internal.example.com spiffe://example.org/ns/a] peers=1`
+
+	// Test: Required certificates must be sent and verify
+	addr := serve(ClientAuthRequire)
+	body, err := tlsRoundTrip(addr, config(client))
+	require.NoError(t, err)
+	assert.Equal(t, verified, body)
+	_, err = tlsRoundTrip(addr, config(nil))
+	assert.Error(t, err)
+	_, err = tlsRoundTrip(addr, config(rogue))
+	assert.Error(t, err)
+
+	// Test: Verify-if-given lets clients without a certificate through
+	addr = serve(ClientAuthVerifyIfGiven)
+	body, err = tlsRoundTrip(addr, config(nil))
+	require.NoError(t, err)
+	assert.Equal(t, `subject="" sans=[] peers=0`, body)
+	body, err = tlsRoundTrip(addr, config(client))
+	require.NoError(t, err)
+	assert.Equal(t, verified, body)
+	_, err = tlsRoundTrip(addr, config(rogue))
+	assert.Error(t, err)
+
+	// Test: Requested certificates are passed on but not trusted
+	addr = serve(ClientAuthRequest)
+	body, err = tlsRoundTrip(addr, config(rogue))
+	require.NoError(t, err)
+	assert.Equal(t, `subject="" sans=[] peers=1`, body)
+
+	// Test: Verifying modes need client CAs
+	_, err = Serve(0, clientCertHandler,
+		WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{serverCert.tlsCertificate(t)}}),
+		WithClientAuth(ClientAuthRequire),
+	)
+	assert.Error(t, err)
+}
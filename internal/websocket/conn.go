@@ -0,0 +1,373 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type MessageType int
+
+const (
+	TextMessage		MessageType = MessageType(opText)
+	BinaryMessage	MessageType = MessageType(opBinary)
+)
+
+// CloseCode is the status code carried by a close frame (RFC 6455
+// section 7.4).
+type CloseCode int
+
+const (
+	CloseNormal				CloseCode = 1000
+	CloseGoingAway			CloseCode = 1001
+	CloseProtocolError		CloseCode = 1002
+	CloseUnsupportedData	CloseCode = 1003
+	// CloseNoStatus is reported for a close frame without a status code.
+	// It is never sent.
+	CloseNoStatus			CloseCode = 1005
+	CloseInvalidPayload		CloseCode = 1007
+	ClosePolicyViolation	CloseCode = 1008
+	CloseMessageTooBig		CloseCode = 1009
+	CloseMandatoryExtension	CloseCode = 1010
+	CloseInternalError		CloseCode = 1011
+)
+
+// validOnWire reports whether code may appear in a close frame.
+func (code CloseCode) validOnWire() bool {
+	switch {
+	case code >= 1000 && code <= 1003:
+		return true
+	case code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// DefaultMaxMessageSize is the message size limit when none is set.
+const DefaultMaxMessageSize = 1 << 20
+
+// closeTimeout is how long to wait for the peer to answer a close frame
+// before dropping the connection.
+const closeTimeout = 5 * time.Second
+
+var (
+	ErrProtocol			= errors.New("websocket protocol error")
+	ErrMessageTooLarge	= errors.New("websocket message too large")
+	ErrInvalidUTF8		= errors.New("websocket text is not valid UTF-8")
+	ErrCloseSent		= errors.New("websocket close frame already sent")
+)
+
+// CloseError is returned by ReadMessage once the peer has closed the
+// connection with a close frame.
+type CloseError struct {
+	Code	CloseCode
+	Reason	string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+// Conn is a WebSocket connection. One goroutine may read messages while
+// others write; writes are serialized frame by frame. Pings are answered
+// and close frames echoed while reading.
+type Conn struct {
+	conn			net.Conn
+	br				*bufio.Reader
+	server			bool
+	maxMessageSize	int64
+	subprotocol		string
+
+	readErr			error
+
+	writeMu			sync.Mutex
+	closeSent		bool
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, server bool, maxMessageSize int64) *Conn {
+	if maxMessageSize == 0 {
+		maxMessageSize = DefaultMaxMessageSize
+	}
+	return &Conn{
+		conn:			conn,
+		br:				br,
+		server:			server,
+		maxMessageSize:	maxMessageSize,
+	}
+}
+
+// Subprotocol returns the subprotocol agreed in the handshake, if any.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// SetReadDeadline sets the deadline for reading the next message.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for writing frames.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// ReadMessage reads the next data message, reassembling fragments. Pings
+// that arrive meanwhile are answered with pongs, and pongs are dropped.
+// When the peer closes the connection the close frame is echoed, the
+// connection is closed and a *CloseError is returned. A peer that breaks
+// the protocol is sent a close frame saying why before the connection is
+// closed. Once ReadMessage has returned an error it keeps returning it.
+func (c *Conn) ReadMessage() (MessageType, []byte, error) {
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+
+	var messageType MessageType
+	message := []byte{}
+	fragmented := false
+	for {
+		h, err := readFrameHeader(c.br)
+		if err != nil {
+			if errors.Is(err, ErrProtocol) {
+				return 0, nil, c.fail(CloseProtocolError, err)
+			}
+			return 0, nil, c.lost(err)
+		}
+		if err := c.checkFrame(h, fragmented); err != nil {
+			return 0, nil, c.fail(CloseProtocolError, err)
+		}
+		if !h.opcode.isControl() && int64(len(message))+h.length > c.maxMessageSize {
+			return 0, nil, c.fail(CloseMessageTooBig, fmt.Errorf("Error: %w: more than %d bytes", ErrMessageTooLarge, c.maxMessageSize))
+		}
+
+		payload := make([]byte, h.length)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return 0, nil, c.lost(err)
+		}
+		if h.masked {
+			maskBytes(h.mask, payload)
+		}
+
+		switch h.opcode {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil && !errors.Is(err, ErrCloseSent) {
+				return 0, nil, c.lost(err)
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			return 0, nil, c.handleClose(payload)
+		case opText, opBinary:
+			messageType = MessageType(h.opcode)
+		}
+
+		message = append(message, payload...)
+		if !h.fin {
+			fragmented = true
+			continue
+		}
+		if messageType == TextMessage && !utf8.Valid(message) {
+			return 0, nil, c.fail(CloseInvalidPayload, fmt.Errorf("Error: %w", ErrInvalidUTF8))
+		}
+		return messageType, message, nil
+	}
+}
+
+// checkFrame validates a frame header against the protocol and the state
+// of fragmented message reassembly.
+func (c *Conn) checkFrame(h frameHeader, fragmented bool) error {
+	if h.rsv != 0 {
+		return fmt.Errorf("Error: %w: reserved bits set without an extension", ErrProtocol)
+	}
+	if !h.opcode.isKnown() {
+		return fmt.Errorf("Error: %w: unknown opcode %#x", ErrProtocol, byte(h.opcode))
+	}
+	if h.masked != c.server {
+		if c.server {
+			return fmt.Errorf("Error: %w: client frame not masked", ErrProtocol)
+		}
+		return fmt.Errorf("Error: %w: server frame masked", ErrProtocol)
+	}
+	if h.opcode.isControl() {
+		if !h.fin {
+			return fmt.Errorf("Error: %w: fragmented control frame", ErrProtocol)
+		}
+		if h.length > maxControlPayload {
+			return fmt.Errorf("Error: %w: control frame payload of %d bytes", ErrProtocol, h.length)
+		}
+		return nil
+	}
+	if h.opcode == opContinuation && !fragmented {
+		return fmt.Errorf("Error: %w: continuation frame without a message to continue", ErrProtocol)
+	}
+	if h.opcode != opContinuation && fragmented {
+		return fmt.Errorf("Error: %w: new message inside a fragmented message", ErrProtocol)
+	}
+	return nil
+}
+
+// handleClose answers a close frame from the peer and closes the
+// connection.
+func (c *Conn) handleClose(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatus}
+	switch {
+	case len(payload) == 1:
+		return c.fail(CloseProtocolError, fmt.Errorf("Error: %w: one byte close payload", ErrProtocol))
+	case len(payload) >= 2:
+		closeErr.Code = CloseCode(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+		if !closeErr.Code.validOnWire() {
+			return c.fail(CloseProtocolError, fmt.Errorf("Error: %w: invalid close code %d", ErrProtocol, closeErr.Code))
+		}
+		if !utf8.ValidString(closeErr.Reason) {
+			return c.fail(CloseInvalidPayload, fmt.Errorf("Error: %w: in close reason", ErrInvalidUTF8))
+		}
+	}
+
+	// echo the status code, unless this already is the reply to ours
+	var reply []byte
+	if closeErr.Code != CloseNoStatus {
+		reply = closePayload(closeErr.Code, "")
+	}
+	c.writeFrame(opClose, reply)
+	c.conn.Close()
+	c.readErr = closeErr
+	return closeErr
+}
+
+// fail sends a close frame with code and closes the connection because
+// the peer broke the protocol.
+func (c *Conn) fail(code CloseCode, err error) error {
+	c.writeFrame(opClose, closePayload(code, ""))
+	c.conn.Close()
+	c.readErr = err
+	return err
+}
+
+// lost records that the connection failed underneath the protocol.
+func (c *Conn) lost(err error) error {
+	c.conn.Close()
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	c.readErr = fmt.Errorf("Error: websocket connection lost: %w", err)
+	return c.readErr
+}
+
+// WriteMessage sends data as a single frame message.
+func (c *Conn) WriteMessage(messageType MessageType, data []byte) error {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return fmt.Errorf("Error: unknown message type %d", messageType)
+	}
+	return c.writeFrame(opcode(messageType), data)
+}
+
+// NextWriter returns a writer for a message sent in fragments: each Write
+// sends one frame and Close ends the message. No other message may be
+// written until it is closed, though control frames may go in between.
+func (c *Conn) NextWriter(messageType MessageType) (io.WriteCloser, error) {
+	if messageType != TextMessage && messageType != BinaryMessage {
+		return nil, fmt.Errorf("Error: unknown message type %d", messageType)
+	}
+	return &messageWriter{c: c, opcode: opcode(messageType)}, nil
+}
+
+type messageWriter struct {
+	c		*Conn
+	opcode	opcode
+	closed	bool
+}
+
+func (mw *messageWriter) Write(p []byte) (int, error) {
+	if mw.closed {
+		return 0, fmt.Errorf("Error: write to closed message writer")
+	}
+	if err := mw.c.writeFragment(false, mw.opcode, p); err != nil {
+		return 0, err
+	}
+	mw.opcode = opContinuation
+	return len(p), nil
+}
+
+func (mw *messageWriter) Close() error {
+	if mw.closed {
+		return nil
+	}
+	mw.closed = true
+	return mw.c.writeFragment(true, mw.opcode, nil)
+}
+
+// Ping sends a ping frame. The peer's pong is dropped by ReadMessage.
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > maxControlPayload {
+		return fmt.Errorf("Error: ping payload of %d bytes", len(data))
+	}
+	return c.writeFrame(opPing, data)
+}
+
+// WriteClose starts the close handshake. The peer's answer arrives through
+// ReadMessage as a *CloseError, after which the connection is closed; if
+// the peer does not answer in time, ReadMessage fails instead.
+func (c *Conn) WriteClose(code CloseCode, reason string) error {
+	if !code.validOnWire() {
+		return fmt.Errorf("Error: invalid close code %d", code)
+	}
+	if len(reason) > maxControlPayload-2 {
+		return fmt.Errorf("Error: close reason of %d bytes", len(reason))
+	}
+	if err := c.writeFrame(opClose, closePayload(code, reason)); err != nil {
+		return err
+	}
+	return c.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+}
+
+// Close closes the underlying connection without a close handshake.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+func closePayload(code CloseCode, reason string) []byte {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return append(payload, reason...)
+}
+
+func (c *Conn) writeFrame(op opcode, payload []byte) error {
+	return c.writeFragment(true, op, payload)
+}
+
+// writeFragment sends one frame, masked when writing as a client.
+func (c *Conn) writeFragment(fin bool, op opcode, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+
+	h := frameHeader{fin: fin, opcode: op, length: int64(len(payload)), masked: !c.server}
+	if h.masked {
+		if _, err := rand.Read(h.mask[:]); err != nil {
+			return err
+		}
+	}
+	frame := appendFrameHeader(make([]byte, 0, 14+len(payload)), h)
+	start := len(frame)
+	frame = append(frame, payload...)
+	if h.masked {
+		maskBytes(h.mask, frame[start:])
+	}
+	if op == opClose {
+		c.closeSent = true
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
@@ -0,0 +1,118 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+type opcode byte
+
+const (
+	opContinuation	opcode = 0x0
+	opText			opcode = 0x1
+	opBinary		opcode = 0x2
+	opClose			opcode = 0x8
+	opPing			opcode = 0x9
+	opPong			opcode = 0xA
+)
+
+func (op opcode) isControl() bool {
+	return op&0x8 != 0
+}
+
+func (op opcode) isKnown() bool {
+	switch op {
+	case opContinuation, opText, opBinary, opClose, opPing, opPong:
+		return true
+	}
+	return false
+}
+
+// maxControlPayload is the most a control frame may carry.
+const maxControlPayload = 125
+
+// frameHeader is the fixed part of a frame (RFC 6455 section 5.2).
+type frameHeader struct {
+	fin		bool
+	// rsv holds the three reserved bits, which must be zero since no
+	// extensions are negotiated
+	rsv		byte
+	opcode	opcode
+	masked	bool
+	mask	[4]byte
+	length	int64
+}
+
+func readFrameHeader(r *bufio.Reader) (frameHeader, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return frameHeader{}, err
+	}
+	h := frameHeader{
+		fin:	b[0]&0x80 != 0,
+		rsv:	b[0] & 0x70,
+		opcode:	opcode(b[0] & 0x0F),
+		masked:	b[1]&0x80 != 0,
+		length:	int64(b[1] & 0x7F),
+	}
+
+	switch h.length {
+	case 126:
+		if _, err := io.ReadFull(r, b[:2]); err != nil {
+			return frameHeader{}, err
+		}
+		h.length = int64(binary.BigEndian.Uint16(b[:2]))
+	case 127:
+		if _, err := io.ReadFull(r, b[:8]); err != nil {
+			return frameHeader{}, err
+		}
+		length := binary.BigEndian.Uint64(b[:8])
+		if length>>63 != 0 {
+			return frameHeader{}, fmt.Errorf("Error: %w: frame length has its most significant bit set", ErrProtocol)
+		}
+		h.length = int64(length)
+	}
+
+	if h.masked {
+		if _, err := io.ReadFull(r, h.mask[:]); err != nil {
+			return frameHeader{}, err
+		}
+	}
+	return h, nil
+}
+
+// appendFrameHeader appends the encoded header to buf.
+func appendFrameHeader(buf []byte, h frameHeader) []byte {
+	b0 := byte(h.opcode) | h.rsv
+	if h.fin {
+		b0 |= 0x80
+	}
+	var b1 byte
+	if h.masked {
+		b1 = 0x80
+	}
+	switch {
+	case h.length <= 125:
+		buf = append(buf, b0, b1|byte(h.length))
+	case h.length <= 0xFFFF:
+		buf = append(buf, b0, b1|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(h.length))
+	default:
+		buf = append(buf, b0, b1|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(h.length))
+	}
+	if h.masked {
+		buf = append(buf, h.mask[:]...)
+	}
+	return buf
+}
+
+// maskBytes applies the masking key to a payload in place. Masking and
+// unmasking are the same operation.
+func maskBytes(mask [4]byte, p []byte) {
+	for i := range p {
+		p[i] ^= mask[i&3]
+	}
+}
@@ -0,0 +1,133 @@
+// Package websocket implements the server side of the WebSocket protocol
+// (RFC 6455) on top of a hijacked connection.
+package websocket
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"voylento/httpfromtcp/internal/headers"
+	"voylento/httpfromtcp/internal/request"
+	"voylento/httpfromtcp/internal/response"
+)
+
+// acceptGUID is appended to the client's key to compute
+// Sec-WebSocket-Accept.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var ErrBadHandshake = errors.New("bad websocket handshake")
+
+// Upgrader switches requests over to the WebSocket protocol.
+type Upgrader struct {
+	// MaxMessageSize caps the size of a received message, fragments
+	// included. Zero means DefaultMaxMessageSize.
+	MaxMessageSize	int64
+	// Subprotocols lists the supported subprotocols, most preferred first.
+	Subprotocols	[]string
+	// CheckOrigin decides whether to accept a request given its Origin
+	// header. When nil, a request with an Origin header is only accepted
+	// if the origin's host is the request's Host.
+	CheckOrigin		func(req *request.Request) bool
+}
+
+// Upgrade validates the opening handshake, answers it with 101 Switching
+// Protocols and takes the connection over from the server. If the
+// handshake is invalid, an error response is sent and an error wrapping
+// ErrBadHandshake returned; the handler should then just return.
+func (u *Upgrader) Upgrade(w *response.Writer, req *request.Request) (*Conn, error) {
+	if req.RequestLine.Method != "GET" {
+		h := headers.NewHeaders()
+		h.Set("Allow", "GET")
+		return nil, writeHandshakeError(w, response.StatusCodeMethodNotAllowed, h, "method is not GET")
+	}
+	if req.RequestLine.HttpVersion == "1.0" {
+		return nil, writeHandshakeError(w, response.StatusCodeBadRequest, nil, "HTTP/1.0 cannot upgrade")
+	}
+	if !req.Headers.HasToken("connection", "upgrade") || !req.Headers.HasToken("upgrade", "websocket") {
+		return nil, writeHandshakeError(w, response.StatusCodeBadRequest, nil, "not a websocket upgrade")
+	}
+	if version, _ := req.Headers.Get("sec-websocket-version"); version != "13" {
+		h := headers.NewHeaders()
+		h.Set("Sec-WebSocket-Version", "13")
+		return nil, writeHandshakeError(w, response.StatusCodeUpgradeRequired, h, "unsupported version")
+	}
+	key, _ := req.Headers.Get("sec-websocket-key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, writeHandshakeError(w, response.StatusCodeBadRequest, nil, "invalid Sec-WebSocket-Key")
+	}
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(req) {
+		return nil, writeHandshakeError(w, response.StatusCodeForbidden, nil, "origin not allowed")
+	}
+
+	h := headers.NewHeaders()
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", AcceptKey(key))
+	subprotocol := u.selectSubprotocol(req)
+	if subprotocol != "" {
+		h.Set("Sec-WebSocket-Protocol", subprotocol)
+	}
+	if err := w.WriteStatusLine(response.StatusCodeSwitchingProtocols); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+
+	netConn, br, err := w.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	c := newConn(netConn, br, true, u.MaxMessageSize)
+	c.subprotocol = subprotocol
+	return c, nil
+}
+
+// AcceptKey computes the Sec-WebSocket-Accept value for a
+// Sec-WebSocket-Key.
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func (u *Upgrader) selectSubprotocol(req *request.Request) string {
+	var offered []string
+	for _, value := range req.Headers.Values("sec-websocket-protocol") {
+		for _, protocol := range strings.Split(value, ",") {
+			offered = append(offered, strings.TrimSpace(protocol))
+		}
+	}
+	for _, protocol := range u.Subprotocols {
+		if slices.Contains(offered, protocol) {
+			return protocol
+		}
+	}
+	return ""
+}
+
+func sameOrigin(req *request.Request) bool {
+	origin, exists := req.Headers.Get("origin")
+	if !exists {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	host, _ := req.Headers.Get("host")
+	return strings.EqualFold(u.Host, host)
+}
+
+func writeHandshakeError(w *response.Writer, statusCode response.StatusCode, h *headers.Headers, reason string) error {
+	response.WriteStatus(w, statusCode, h)
+	return fmt.Errorf("Error: %w: %s", ErrBadHandshake, reason)
+}
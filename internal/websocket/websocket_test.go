@@ -0,0 +1,450 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"voylento/httpfromtcp/internal/headers"
+	"voylento/httpfromtcp/internal/request"
+	"voylento/httpfromtcp/internal/response"
+	"voylento/httpfromtcp/internal/server"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const handshake = "GET /chat HTTP/1.1\r\n" +
+	"Host: localhost\r\n" +
+	"Upgrade: websocket\r\n" +
+	"Connection: Upgrade\r\n" +
+	"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+	"Sec-WebSocket-Version: 13\r\n"
+
+// echoHandler echoes every message back until the connection closes.
+func echoHandler(u *Upgrader) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		c, err := u.Upgrade(w, req)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			messageType, message, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := c.WriteMessage(messageType, message); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// serve starts a server for handler and returns its address.
+func serve(t *testing.T, handler server.Handler) string {
+	t.Helper()
+	s, err := server.Serve(0, handler)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s.Addr().String()
+}
+
+// dial sends the handshake plus extra, which may hold the first frames,
+// and returns the response headers and the client end of the connection.
+func dial(t *testing.T, addr, request, extra string) (string, *headers.Headers, *Conn) {
+	t.Helper()
+	netConn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { netConn.Close() })
+	netConn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(netConn, request+"\r\n"+extra)
+	require.NoError(t, err)
+
+	br := bufio.NewReader(netConn)
+	statusLine, err := br.ReadString('\n')
+	require.NoError(t, err)
+	h := headers.NewHeaders()
+	for {
+		line, err := br.ReadString('\n')
+		require.NoError(t, err)
+		_, done, err := h.Parse([]byte(line))
+		require.NoError(t, err)
+		if done {
+			break
+		}
+	}
+	return statusLine, h, newConn(netConn, br, false, 0)
+}
+
+func dialEcho(t *testing.T, u *Upgrader) *Conn {
+	t.Helper()
+	statusLine, _, c := dial(t, serve(t, echoHandler(u)), handshake, "")
+	require.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", statusLine)
+	return c
+}
+
+// rawFrame encodes a masked client frame with the given first byte, so
+// tests can set any combination of FIN, reserved bits and opcode.
+func rawFrame(b0 byte, payload []byte) []byte {
+	h := frameHeader{
+		fin:	b0&0x80 != 0,
+		rsv:	b0 & 0x70,
+		opcode:	opcode(b0 & 0x0F),
+		masked:	true,
+		length:	int64(len(payload)),
+	}
+	rand.Read(h.mask[:])
+	frame := appendFrameHeader(nil, h)
+	start := len(frame)
+	frame = append(frame, payload...)
+	maskBytes(h.mask, frame[start:])
+	return frame
+}
+
+func writeRaw(t *testing.T, c *Conn, frames ...[]byte) {
+	t.Helper()
+	_, err := c.conn.Write(bytes.Join(frames, nil))
+	require.NoError(t, err)
+}
+
+// readRaw reads the next frame from the server without interpreting it.
+func readRaw(t *testing.T, c *Conn) (frameHeader, []byte) {
+	t.Helper()
+	h, err := readFrameHeader(c.br)
+	require.NoError(t, err)
+	payload := make([]byte, h.length)
+	_, err = io.ReadFull(c.br, payload)
+	require.NoError(t, err)
+	return h, payload
+}
+
+// expectClose reads until the server's close frame and checks its code.
+func expectClose(t *testing.T, c *Conn, code CloseCode) {
+	t.Helper()
+	_, _, err := c.ReadMessage()
+	var closeErr *CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, code, closeErr.Code)
+}
+
+func closeFrame(code CloseCode, reason string) []byte {
+	return rawFrame(0x88, closePayload(code, reason))
+}
+
+func TestAcceptKey(t *testing.T) {
+	// Test: The example from RFC 6455 section 1.3
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestHandshake(t *testing.T) {
+	addr := serve(t, echoHandler(&Upgrader{Subprotocols: []string{"v2.chat", "v1.chat"}}))
+
+	// Test: A valid handshake switches protocols
+	statusLine, h, _ := dial(t, addr, handshake+"Sec-WebSocket-Protocol: v1.chat, v2.chat\r\n", "")
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", statusLine)
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", get(h, "sec-websocket-accept"))
+	assert.Equal(t, "websocket", get(h, "upgrade"))
+	assert.Equal(t, "Upgrade", get(h, "connection"))
+	assert.Equal(t, "v2.chat", get(h, "sec-websocket-protocol"))
+
+	// Test: No common subprotocol means none is named
+	_, h, _ = dial(t, addr, handshake+"Sec-WebSocket-Protocol: v3.chat\r\n", "")
+	_, exists := h.Get("sec-websocket-protocol")
+	assert.False(t, exists)
+
+	// Test: Frames sent along with the handshake are not lost
+	_, _, c := dial(t, addr, handshake, string(rawFrame(0x81, []byte("early"))))
+	messageType, message, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, TextMessage, messageType)
+	assert.Equal(t, "early", string(message))
+
+	// Test: Invalid handshakes are refused
+	cases := []struct {
+		request		string
+		statusLine	string
+	}{
+		{strings.Replace(handshake, "GET", "POST", 1) + "Content-Length: 0\r\n", "HTTP/1.1 405 Method Not Allowed\r\n"},
+		{strings.Replace(handshake, "Version: 13", "Version: 8", 1), "HTTP/1.1 426 Upgrade Required\r\n"},
+		{strings.Replace(handshake, "dGhlIHNhbXBsZSBub25jZQ==", "c2hvcnQ=", 1), "HTTP/1.1 400 Bad Request\r\n"},
+		{strings.Replace(handshake, "Upgrade: websocket", "Upgrade: h2c", 1), "HTTP/1.1 400 Bad Request\r\n"},
+		{strings.Replace(handshake, "Connection: Upgrade", "Connection: keep-alive", 1), "HTTP/1.1 400 Bad Request\r\n"},
+		{handshake + "Origin: https://evil.example.com\r\n", "HTTP/1.1 403 Forbidden\r\n"},
+	}
+	for _, tc := range cases {
+		statusLine, h, _ := dial(t, addr, tc.request, "")
+		assert.Equal(t, tc.statusLine, statusLine, tc.request)
+		if strings.Contains(tc.statusLine, "426") {
+			assert.Equal(t, "13", get(h, "sec-websocket-version"))
+		}
+	}
+
+	// Test: A same-origin browser request is accepted
+	statusLine, _, _ = dial(t, addr, handshake+"Origin: http://localhost\r\n", "")
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", statusLine)
+}
+
+func get(h *headers.Headers, key string) string {
+	value, _ := h.Get(key)
+	return value
+}
+
+// The cases below follow the sections of the Autobahn test suite.
+
+func TestFraming(t *testing.T) {
+	// Test: 1.1 and 1.2, text and binary messages of every length encoding
+	c := dialEcho(t, &Upgrader{})
+	for _, size := range []int{0, 125, 126, 127, 65535, 65536} {
+		for _, messageType := range []MessageType{TextMessage, BinaryMessage} {
+			payload := bytes.Repeat([]byte("*"), size)
+			require.NoError(t, c.WriteMessage(messageType, payload))
+			gotType, got, err := c.ReadMessage()
+			require.NoError(t, err)
+			assert.Equal(t, messageType, gotType)
+			assert.Equal(t, payload, got, "size %d", size)
+		}
+	}
+
+	// Test: 1.x, the server's frames are unmasked
+	require.NoError(t, c.WriteMessage(BinaryMessage, []byte{1, 2, 3}))
+	h, payload := readRaw(t, c)
+	assert.False(t, h.masked)
+	assert.True(t, h.fin)
+	assert.Equal(t, []byte{1, 2, 3}, payload)
+
+	// Test: 3.x, reserved bits fail the connection
+	for _, b0 := range []byte{0xC1, 0xA1, 0x91, 0xF1} {
+		c = dialEcho(t, &Upgrader{})
+		writeRaw(t, c, rawFrame(b0, []byte("hi")))
+		expectClose(t, c, CloseProtocolError)
+	}
+
+	// Test: 4.x, reserved opcodes fail the connection
+	for _, op := range []byte{0x3, 0x4, 0x5, 0x6, 0x7, 0xB, 0xC, 0xD, 0xE, 0xF} {
+		c = dialEcho(t, &Upgrader{})
+		writeRaw(t, c, rawFrame(0x80|op, nil))
+		expectClose(t, c, CloseProtocolError)
+	}
+
+	// Test: Unmasked client frames fail the connection
+	c = dialEcho(t, &Upgrader{})
+	_, err := c.conn.Write([]byte{0x81, 0x02, 'h', 'i'})
+	require.NoError(t, err)
+	expectClose(t, c, CloseProtocolError)
+}
+
+func TestPingPong(t *testing.T) {
+	// Test: 2.1 to 2.3, pings are answered with the same payload
+	c := dialEcho(t, &Upgrader{})
+	for _, payload := range [][]byte{nil, []byte("Hello, world!"), {0x00, 0xff, 0xfe, 0xfd}, bytes.Repeat([]byte{0xfe}, 125)} {
+		writeRaw(t, c, rawFrame(0x89, payload))
+		h, got := readRaw(t, c)
+		assert.Equal(t, opPong, h.opcode)
+		assert.Equal(t, len(payload), len(got))
+		assert.True(t, bytes.Equal(payload, got))
+	}
+
+	// Test: 2.4, unsolicited pongs are ignored
+	writeRaw(t, c, rawFrame(0x8A, []byte("unsolicited")), rawFrame(0x81, []byte("after pong")))
+	_, message, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "after pong", string(message))
+
+	// Test: 2.5, control frame payloads over 125 bytes fail the connection
+	c = dialEcho(t, &Upgrader{})
+	writeRaw(t, c, rawFrame(0x89, bytes.Repeat([]byte{0xfe}, 126)))
+	expectClose(t, c, CloseProtocolError)
+
+	// Test: Conn.Ping gets an answer, which ReadMessage skips
+	c = dialEcho(t, &Upgrader{})
+	require.NoError(t, c.Ping([]byte("ping")))
+	require.NoError(t, c.WriteMessage(TextMessage, []byte("after ping")))
+	_, message, err = c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "after ping", string(message))
+	assert.Error(t, c.Ping(make([]byte, 126)))
+}
+
+func TestFragmentation(t *testing.T) {
+	// Test: 5.3 to 5.9, fragments are reassembled, with control frames
+	// allowed in between
+	c := dialEcho(t, &Upgrader{})
+	writeRaw(t, c,
+		rawFrame(0x01, []byte("fragment1")),
+		rawFrame(0x89, []byte("ping")),
+		rawFrame(0x00, []byte("fragment2")),
+		rawFrame(0x80, []byte("fragment3")),
+	)
+	h, payload := readRaw(t, c)
+	assert.Equal(t, opPong, h.opcode)
+	assert.Equal(t, "ping", string(payload))
+	messageType, message, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, TextMessage, messageType)
+	assert.Equal(t, "fragment1fragment2fragment3", string(message))
+
+	// Test: 5.1 and 5.2, fragmented control frames fail the connection
+	c = dialEcho(t, &Upgrader{})
+	writeRaw(t, c, rawFrame(0x09, []byte("frag")), rawFrame(0x80, []byte("ment")))
+	expectClose(t, c, CloseProtocolError)
+
+	// Test: 5.9 to 5.14, continuations without a message to continue
+	for _, b0 := range []byte{0x80, 0x00} {
+		c = dialEcho(t, &Upgrader{})
+		writeRaw(t, c, rawFrame(b0, []byte("orphan")))
+		expectClose(t, c, CloseProtocolError)
+	}
+
+	// Test: 5.18, a new message may not start inside a fragmented one
+	c = dialEcho(t, &Upgrader{})
+	writeRaw(t, c, rawFrame(0x01, []byte("fragment1")), rawFrame(0x81, []byte("fragment2")))
+	expectClose(t, c, CloseProtocolError)
+
+	// Test: The server can send fragmented messages
+	done := make(chan struct{})
+	addr := serve(t, func(w *response.Writer, req *request.Request) {
+		defer close(done)
+		sc, err := (&Upgrader{}).Upgrade(w, req)
+		if err != nil {
+			return
+		}
+		mw, _ := sc.NextWriter(BinaryMessage)
+		mw.Write([]byte("ab"))
+		sc.Ping(nil)
+		mw.Write([]byte("cd"))
+		mw.Close()
+		sc.WriteClose(CloseNormal, "")
+		sc.ReadMessage()
+	})
+	_, _, c = dial(t, addr, handshake, "")
+	messageType, message, err = c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, BinaryMessage, messageType)
+	assert.Equal(t, "abcd", string(message))
+	expectClose(t, c, CloseNormal)
+	<-done
+}
+
+func TestUTF8(t *testing.T) {
+	valid := []byte("κόσμε")
+	invalid := []byte{0xce, 0xba, 0xe1, 0xbd, 0xb9, 0xcf, 0x83, 0xce, 0xbc, 0xce, 0xb5, 0xed, 0xa0, 0x80, 0x65, 0x64, 0x69, 0x74, 0x65, 0x64}
+
+	// Test: 6.x, valid text split inside a code point is reassembled
+	c := dialEcho(t, &Upgrader{})
+	writeRaw(t, c, rawFrame(0x01, valid[:3]), rawFrame(0x80, valid[3:]))
+	_, message, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, valid, message)
+
+	// Test: 6.x, invalid text fails with 1007
+	c = dialEcho(t, &Upgrader{})
+	writeRaw(t, c, rawFrame(0x81, invalid))
+	expectClose(t, c, CloseInvalidPayload)
+
+	// Test: Binary messages are not checked
+	c = dialEcho(t, &Upgrader{})
+	writeRaw(t, c, rawFrame(0x82, invalid))
+	_, message, err = c.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, invalid, message)
+}
+
+func TestCloseHandshake(t *testing.T) {
+	// Test: 7.1.1 and 7.3.x, close frames are echoed with their code
+	for _, code := range []CloseCode{1000, 1001, 1002, 1003, 1007, 1008, 1009, 1010, 1011, 3000, 3999, 4000, 4999} {
+		c := dialEcho(t, &Upgrader{})
+		writeRaw(t, c, closeFrame(code, "reason"))
+		expectClose(t, c, code)
+	}
+
+	// Test: 7.3.1, an empty close frame gets an empty answer
+	c := dialEcho(t, &Upgrader{})
+	writeRaw(t, c, rawFrame(0x88, nil))
+	expectClose(t, c, CloseNoStatus)
+
+	// Test: 7.1.x, frames after the close frame are ignored
+	c = dialEcho(t, &Upgrader{})
+	writeRaw(t, c, closeFrame(CloseNormal, ""), rawFrame(0x81, []byte("too late")))
+	expectClose(t, c, CloseNormal)
+
+	// Test: 7.3.2, a one byte payload fails the connection
+	c = dialEcho(t, &Upgrader{})
+	writeRaw(t, c, rawFrame(0x88, []byte{0x03}))
+	expectClose(t, c, CloseProtocolError)
+
+	// Test: 7.5.1, the close reason must be valid UTF-8
+	c = dialEcho(t, &Upgrader{})
+	writeRaw(t, c, rawFrame(0x88, append(closePayload(CloseNormal, ""), 0xce, 0xba, 0xe1, 0xbd, 0xb9, 0xcf, 0x83, 0xce, 0xbc, 0xce, 0xb5, 0xed, 0xa0, 0x80)))
+	expectClose(t, c, CloseInvalidPayload)
+
+	// Test: 7.9.x, codes that may not be sent fail the connection
+	for _, code := range []CloseCode{0, 999, 1004, 1005, 1006, 1015, 1016, 1100, 2000, 2999, 5000, 65535} {
+		c = dialEcho(t, &Upgrader{})
+		writeRaw(t, c, closeFrame(code, ""))
+		expectClose(t, c, CloseProtocolError)
+	}
+
+	// Test: The server can start the close handshake
+	result := make(chan error, 1)
+	addr := serve(t, func(w *response.Writer, req *request.Request) {
+		sc, err := (&Upgrader{}).Upgrade(w, req)
+		if err != nil {
+			return
+		}
+		sc.WriteClose(CloseGoingAway, "shutting down")
+		assert.ErrorIs(t, sc.WriteMessage(TextMessage, []byte("late")), ErrCloseSent)
+		_, _, err = sc.ReadMessage()
+		result <- err
+	})
+	_, _, c = dial(t, addr, handshake, "")
+	_, _, err := c.ReadMessage()
+	var closeErr *CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, CloseGoingAway, closeErr.Code)
+	assert.Equal(t, "shutting down", closeErr.Reason)
+	require.ErrorAs(t, <-result, &closeErr)
+	assert.Equal(t, CloseGoingAway, closeErr.Code)
+}
+
+func TestMessageSizeLimit(t *testing.T) {
+	// Test: 9.x, messages over the limit fail with 1009
+	c := dialEcho(t, &Upgrader{MaxMessageSize: 1024})
+	require.NoError(t, c.WriteMessage(BinaryMessage, make([]byte, 1024)))
+	_, message, err := c.ReadMessage()
+	require.NoError(t, err)
+	assert.Len(t, message, 1024)
+	require.NoError(t, c.WriteMessage(BinaryMessage, make([]byte, 1025)))
+	expectClose(t, c, CloseMessageTooBig)
+
+	// Test: The limit applies to the reassembled message
+	c = dialEcho(t, &Upgrader{MaxMessageSize: 1024})
+	writeRaw(t, c, rawFrame(0x02, make([]byte, 1000)), rawFrame(0x80, make([]byte, 25)))
+	expectClose(t, c, CloseMessageTooBig)
+}
+
+func TestConnectionLost(t *testing.T) {
+	// Test: A connection dropped without a close frame is an error, not a
+	// clean close
+	result := make(chan error, 1)
+	addr := serve(t, func(w *response.Writer, req *request.Request) {
+		sc, err := (&Upgrader{}).Upgrade(w, req)
+		if err != nil {
+			return
+		}
+		_, _, err = sc.ReadMessage()
+		result <- err
+	})
+	_, _, c := dial(t, addr, handshake, string(rawFrame(0x01, []byte("half"))))
+	c.Close()
+	err := <-result
+	var closeErr *CloseError
+	assert.False(t, errors.As(err, &closeErr))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}